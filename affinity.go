@@ -0,0 +1,73 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ParseAffinity parses the affinity of the Virtual Machine instance, as the
+// YAML or JSON of a Kubernetes Affinity, inline or as a path to a file.
+func ParseAffinity(src string) (*k8sapi.Affinity, error) {
+	if src == "" {
+		return nil, nil
+	}
+
+	data := []byte(src)
+	if !strings.ContainsAny(src, "\n{") {
+		contents, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("reading affinity: %w", err)
+		}
+		data = contents
+	}
+
+	var affinity k8sapi.Affinity
+	if err := yaml.UnmarshalStrict(data, &affinity); err != nil {
+		return nil, fmt.Errorf("invalid affinity: %w", err)
+	}
+	return &affinity, nil
+}
+
+// jobAffinity returns the affinity of the Virtual Machine instance of the
+// job. With jctx.SpreadAcrossNodes, the scheduler prefers nodes that run
+// no other instance of the runner fleet, i.e. with the job ID label of the
+// fleet, which KubeVirt copies over to the launcher pods.
+func jobAffinity(jctx *JobContext) *k8sapi.Affinity {
+	if !jctx.SpreadAcrossNodes {
+		return jctx.Affinity
+	}
+
+	affinity := &k8sapi.Affinity{}
+	if jctx.Affinity != nil {
+		affinity = jctx.Affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &k8sapi.PodAntiAffinity{}
+	}
+	anti := affinity.PodAntiAffinity
+	anti.PreferredDuringSchedulingIgnoredDuringExecution = append(anti.PreferredDuringSchedulingIgnoredDuringExecution, k8sapi.WeightedPodAffinityTerm{
+		Weight: 100,
+		PodAffinityTerm: k8sapi.PodAffinityTerm{
+			TopologyKey: k8sapi.LabelHostname,
+			LabelSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{
+						Key:      jobLabel(jctx, "id"),
+						Operator: metav1.LabelSelectorOpExists,
+					},
+				},
+			},
+		},
+	})
+	return affinity
+}
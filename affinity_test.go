@@ -0,0 +1,76 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestJobAffinitySpread(t *testing.T) {
+	for _, prefix := range []string{labelPrefix, "ci.example.com"} {
+		t.Run(prefix, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--spread-across-nodes",
+				`--default-affinity={"nodeAffinity": {"preferredDuringSchedulingIgnoredDuringExecution": [{"weight": 1, "preference": {"matchExpressions": [{"key": "disk", "operator": "In", "values": ["ssd"]}]}}]}}`)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.LabelPrefix = prefix
+			userAffinity := jctx.Affinity.DeepCopy()
+			rc := cmd.RunConfig
+
+			vm := createTestVM(t, c, jctx, &rc)
+
+			affinity := vm.Spec.Affinity
+			if affinity == nil || affinity.PodAntiAffinity == nil {
+				t.Fatalf("affinity = %+v, want a pod anti-affinity", affinity)
+			}
+			if affinity.NodeAffinity == nil || len(affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 {
+				t.Errorf("node affinity = %+v, want the configured one", affinity.NodeAffinity)
+			}
+			if jctx.Affinity.PodAntiAffinity != nil || jctx.Affinity.String() != userAffinity.String() {
+				t.Errorf("configured affinity was modified: %+v", jctx.Affinity)
+			}
+
+			terms := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+			if len(terms) != 1 {
+				t.Fatalf("anti-affinity terms = %+v, want one", terms)
+			}
+			term := terms[0].PodAffinityTerm
+			if term.TopologyKey != k8sapi.LabelHostname {
+				t.Errorf("topology key = %q, want %q", term.TopologyKey, k8sapi.LabelHostname)
+			}
+			want := []metav1.LabelSelectorRequirement{{Key: prefix + "/id", Operator: metav1.LabelSelectorOpExists}}
+			if got := term.LabelSelector.MatchExpressions; len(got) != 1 || got[0].Key != want[0].Key || got[0].Operator != want[0].Operator {
+				t.Errorf("anti-affinity selector = %+v, want %+v", got, want)
+			}
+
+			// The term must select the instances of the fleet, this one
+			// included.
+			selector, err := metav1.LabelSelectorAsSelector(term.LabelSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !selector.Matches(labels.Set(vm.ObjectMeta.Labels)) {
+				t.Errorf("anti-affinity selector %v does not match the instance labels %v", selector, vm.ObjectMeta.Labels)
+			}
+		})
+	}
+}
+
+func TestJobAffinityWithoutSpread(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+
+	vm := createTestVM(t, c, jctx, &rc)
+	if vm.Spec.Affinity != nil {
+		t.Errorf("affinity = %+v, want none", vm.Spec.Affinity)
+	}
+}
@@ -7,23 +7,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
 type CleanupCmd struct {
-	Timeout time.Duration `name:"timeout" default:"1h"`
-	SkipIf  []string      `name:"skip-if" sep:","`
+	Timeout     time.Duration `name:"timeout" default:"1h"`
+	SkipIf      []string      `name:"skip-if" sep:","`
+	Propagation string        `name:"propagation" default:"background" enum:"background,foreground" help:"whether to wait for dependent objects to be deleted before the Virtual Machine instance"`
+	GracePeriod time.Duration `name:"grace-period" default:"-1s" help:"time given to the guest to shut down before it gets killed; negative values use the grace period of the instance"`
+
+	ShutdownGracePeriod time.Duration `name:"shutdown-grace-period" help:"time to wait for the guest to power off after requesting a graceful shutdown before deleting it forcefully; overrides --grace-period when set"`
+
+	KeepOnFailure bool          `name:"keep-on-failure" help:"leave the Virtual Machine instance of a job whose script failed running, for investigation, rather than deleting it; the reaper deletes it once --keep-ttl has passed"`
+	KeepTTL       time.Duration `name:"keep-ttl" default:"2h" help:"how long to keep the Virtual Machine instance of a failed job with --keep-on-failure"`
+
+	PostScript string `name:"post-script" type:"existingfile" help:"local script to run on the Virtual Machine instance before it is deleted or returned to its pool, e.g. to tear down what --pre-script set up; failures are only reported"`
+
+	Pool PoolConfig `embed:"" prefix:"pool-" group:"Pool options:"`
+	Dirs `embed:""`
 }
 
 func (cmd *CleanupCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	if jctx.ShutdownGracePeriod == 0 {
+		jctx.ShutdownGracePeriod = cmd.ShutdownGracePeriod
+	}
+	jctx.PostScript = cmd.PostScript
+	jctx.KeepOnFailure = cmd.KeepOnFailure
+	jctx.KeepTTL = cmd.KeepTTL
+
 	vm, err := FindJobVM(ctx, client, jctx)
+	if errors.Is(err, ErrJobVMNotFound) {
+		fmt.Fprintf(os.Stderr, "Virtual Machine instance is already gone, nothing to clean up\n")
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -39,18 +66,134 @@ func (cmd *CleanupCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 		}
 	}
 
+	if _, failed := jobFailed(vm); failed && jctx.KeepOnFailure {
+		err := KeepJobVM(ctx, client, jctx, vm, jctx.KeepTTL)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Not keeping Virtual Machine instance %v: %v\n", vm.ObjectMeta.Name, err)
+	}
+
+	opts := metav1.DeleteOptions{}
+	propagation := metav1.DeletePropagationBackground
+	if cmd.Propagation == "foreground" {
+		propagation = metav1.DeletePropagationForeground
+	}
+	opts.PropagationPolicy = &propagation
+	if cmd.GracePeriod >= 0 {
+		seconds := int64(cmd.GracePeriod / time.Second)
+		opts.GracePeriodSeconds = &seconds
+	}
+
+	if jctx.PostScript != "" {
+		if err := runPostScript(ctx, client, jctx, vm); err != nil {
+			fmt.Fprintf(os.Stderr, "Post-script failed: %v\n", err)
+		}
+	}
+	DetachHotpluggedVolumes(ctx, client, vm)
+	if _, ok := vm.ObjectMeta.Labels[jobLabel(jctx, "pool")]; ok {
+		err := ReleasePoolVM(ctx, client, jctx, vm, cmd.Pool, cmd.Dirs)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Not returning Virtual Machine instance %v to its pool: %v\n", vm.ObjectMeta.Name, err)
+	}
+	return DeleteJobVM(ctx, client, jctx, vm, &opts, cmd.Timeout)
+}
+
+// runPostScript runs jctx.PostScript on the Virtual Machine instance, if it
+// is still running.
+func runPostScript(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	if vm.Status.Phase != kubevirtapi.Running {
+		return fmt.Errorf("Virtual Machine instance %s is not running (phase: %v)", vm.ObjectMeta.Name, vm.Status.Phase)
+	}
+	var rc RunConfig
+	if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err != nil {
+		return err
+	}
+	conn, err := Connect(ctx, client, jctx, vm, &rc, DialOptions{
+		Timeout:      10 * time.Second,
+		RetryTimeout: time.Minute,
+		PollInterval: 5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(os.Stderr, "Running post-script %s...\n", jctx.PostScript)
+	return RunRunnerScript(ctx, conn, rc.Shell, jctx.PostScript, "kubevirt_post_script")
+}
+
+// DeleteJobVM deletes the Virtual Machine instance of the job, and waits up
+// to timeout for it to go away. An instance that is already gone is not an
+// error.
+//
+// With a positive jctx.ShutdownGracePeriod, the guest is first asked to shut
+// down gracefully (KubeVirt sends it an ACPI power button event when the
+// instance is deleted with a grace period), and is only deleted forcefully
+// if it is still around once that period has elapsed.
+func DeleteJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	opts *metav1.DeleteOptions,
+	timeout time.Duration,
+) error {
+	if jctx.ShutdownGracePeriod > 0 {
+		fmt.Fprintf(os.Stderr, "Shutting down Virtual Machine instance %v\n", vm.ObjectMeta.Name)
+
+		graceful := *opts
+		seconds := int64(jctx.ShutdownGracePeriod / time.Second)
+		graceful.GracePeriodSeconds = &seconds
+
+		err := deleteJobVM(ctx, client, jctx, vm, &graceful, jctx.ShutdownGracePeriod)
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Virtual Machine instance %v did not shut down within %v, forcing deletion\n", vm.ObjectMeta.Name, jctx.ShutdownGracePeriod)
+
+		forced := *opts
+		seconds = 0
+		forced.GracePeriodSeconds = &seconds
+		opts = &forced
+	}
+
 	fmt.Fprintf(os.Stderr, "Deleting Virtual Machine instance %v\n", vm.ObjectMeta.Name)
+	err := deleteJobVM(ctx, client, jctx, vm, opts, timeout)
+	if err != nil {
+		logger.Error("deleting Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "err", err)
+		metricVMFailed.Inc(append(metricLabels(jctx), failureDelete)...)
+	} else {
+		logger.Info("deleted Virtual Machine instance", "vmi", vm.ObjectMeta.Name)
+		metricJobDuration.Observe(time.Since(vm.ObjectMeta.CreationTimestamp.Time), metricLabels(jctx)...)
+	}
+	return err
+}
 
-	if err := client.VirtualMachineInstance(jctx.Namespace).Delete(ctx, vm.ObjectMeta.Name, nil); err != nil {
+func deleteJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	opts *metav1.DeleteOptions,
+	timeout time.Duration,
+) error {
+	err := deleteInstance(ctx, client, jctx.Namespace, vm, opts)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
-	timeout, stop := context.WithTimeout(ctx, cmd.Timeout)
+	timeoutCtx, stop := context.WithTimeout(ctx, timeout)
 	defer stop()
 
 	// Wait for VM to go away
 
-	return WatchJobVM(timeout, client, jctx, vm, func(et watch.EventType, _ *kubevirtapi.VirtualMachineInstance) error {
+	return WatchJobVM(timeoutCtx, client, jctx, vm, func(et watch.EventType, _ *kubevirtapi.VirtualMachineInstance) error {
 		switch et {
 		case watch.Error:
 			// We can't just retry like we do in prepare, because the deleted
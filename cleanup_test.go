@@ -0,0 +1,57 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+// The deadline of the job bounds its scripts, not its cleanup, which must
+// still delete the instance once the deadline has passed.
+func TestCleanupPastJobDeadline(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+
+	deadline := time.Now().Add(50 * time.Millisecond)
+	vm := kubevirtapi.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "vm",
+			Namespace:   "ci",
+			Annotations: map[string]string{DeadlineKey: deadline.UTC().Format(time.RFC3339Nano)},
+		},
+		Status: kubevirtapi.VirtualMachineInstanceStatus{Phase: kubevirtapi.Running},
+	}
+	c.VMIs.EXPECT().List(gomock.Any(), gomock.Any()).Return(&kubevirtapi.VirtualMachineInstanceList{Items: []kubevirtapi.VirtualMachineInstance{vm}}, nil)
+
+	watcher := watch.NewFake()
+	c.VMIs.EXPECT().Delete(gomock.Any(), "vm", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ string, _ *metav1.DeleteOptions) error {
+			// The deadline passes while the instance is being deleted.
+			time.Sleep(time.Until(deadline) + 50*time.Millisecond)
+			if err := ctx.Err(); err != nil {
+				t.Errorf("deleting with a context that is done: %v", err)
+			}
+			return nil
+		})
+	c.VMIs.EXPECT().Watch(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, metav1.ListOptions) (watch.Interface, error) {
+			go watcher.Delete(vm.DeepCopy())
+			return watcher, nil
+		})
+
+	cleanup := &CleanupCmd{Timeout: time.Minute, Propagation: "background", GracePeriod: -time.Second}
+	if err := cleanup.Run(context.Background(), c, jctx); err != nil {
+		t.Fatal(err)
+	}
+}
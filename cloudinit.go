@@ -0,0 +1,305 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const cloudConfigHeader = "#cloud-config"
+
+// LoadCloudInit resolves cloud-init user-data from src, which is either
+// the user-data itself or the path to a file containing it. The contents
+// may be base64-encoded; since valid user-data always starts with a '#'
+// directive (#cloud-config, #!, ...) or a MIME header, anything else that
+// decodes as base64 is decoded.
+func LoadCloudInit(src string) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+
+	data, err := readInlineOrFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(data, "#") || isMIME(data) {
+		return data, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data)); err == nil {
+		return string(decoded), nil
+	}
+	return data, nil
+}
+
+// LoadCloudInitNetworkData resolves cloud-init network-config from src,
+// which is either the network-config itself or the path to a file
+// containing it. The contents may be base64-encoded, and must be a
+// non-empty YAML document, e.g. a version 2 network configuration.
+func LoadCloudInitNetworkData(src string) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+
+	data, err := readInlineOrFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{data}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data)); err == nil {
+		candidates = append(candidates, string(decoded))
+	}
+	for _, candidate := range candidates {
+		var config map[string]interface{}
+		if err := yaml.Unmarshal([]byte(candidate), &config); err == nil && len(config) > 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("network-config must be a non-empty YAML document")
+}
+
+// readInlineOrFile returns the contents of the file at src, if src is the
+// path of a regular file, or else src itself.
+func readInlineOrFile(src string) (string, error) {
+	if !strings.Contains(src, "\n") {
+		if fi, err := os.Stat(src); err == nil && fi.Mode().IsRegular() {
+			contents, err := os.ReadFile(src)
+			if err != nil {
+				return "", err
+			}
+			return string(contents), nil
+		}
+	}
+	return src, nil
+}
+
+func isMIME(userData string) bool {
+	return strings.HasPrefix(userData, "Content-Type:") || strings.HasPrefix(userData, "MIME-Version:")
+}
+
+func isCloudConfig(userData string) bool {
+	line := strings.SplitN(userData, "\n", 2)[0]
+	return strings.TrimSpace(line) == cloudConfigHeader
+}
+
+// InjectSSHKey adds authorizedKey to the authorized keys of user in the
+// cloud-init user-data. A user the user-data does not define is created with
+// passwordless sudo, and /bin/sh as its shell, which unlike bash every image
+// has.
+func InjectSSHKey(userData, user, authorizedKey string) (string, error) {
+	authorizedKey = strings.TrimSpace(authorizedKey)
+
+	return editCloudConfig(userData, func(config map[string]interface{}) error {
+		var users []interface{}
+		switch u := config["users"].(type) {
+		case nil:
+			// Keep the distribution's default user around, as cloud-init
+			// would only create the users listed otherwise.
+			users = []interface{}{"default"}
+		case []interface{}:
+			users = u
+		default:
+			return fmt.Errorf("cannot add ssh key to cloud-config: unsupported users field of type %T", u)
+		}
+
+		found := false
+		for _, u := range users {
+			entry, ok := u.(map[string]interface{})
+			if !ok || entry["name"] != user {
+				continue
+			}
+			keys, _ := entry["ssh_authorized_keys"].([]interface{})
+			entry["ssh_authorized_keys"] = append(keys, authorizedKey)
+			found = true
+		}
+		if !found {
+			users = append(users, map[string]interface{}{
+				"name":                user,
+				"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+				"shell":               "/bin/sh",
+				"ssh_authorized_keys": []interface{}{authorizedKey},
+			})
+		}
+		config["users"] = users
+		return nil
+	})
+}
+
+// InjectHostKey sets the ECDSA ssh host key of the guest in the cloud-init
+// user-data, as generated by GenerateHostKey.
+func InjectHostKey(userData, priv, pub string) (string, error) {
+	return editCloudConfig(userData, func(config map[string]interface{}) error {
+		keys := map[string]interface{}{}
+		switch k := config["ssh_keys"].(type) {
+		case nil:
+		case map[string]interface{}:
+			keys = k
+		default:
+			return fmt.Errorf("cannot add ssh host key to cloud-config: unsupported ssh_keys field of type %T", k)
+		}
+		keys["ecdsa_private"] = priv
+		keys["ecdsa_public"] = strings.TrimSpace(pub)
+		config["ssh_keys"] = keys
+		return nil
+	})
+}
+
+// InjectScratchDisks has cloud-init format the scratch disks that have a
+// filesystem, and mount those that have a mount point. The user-data is
+// left alone if there are none.
+func InjectScratchDisks(userData string, disks []ScratchDisk) (string, error) {
+	var formatted []ScratchDisk
+	for _, disk := range disks {
+		if disk.Filesystem != "" {
+			formatted = append(formatted, disk)
+		}
+	}
+	if len(formatted) == 0 {
+		return userData, nil
+	}
+	return editCloudConfig(userData, func(config map[string]interface{}) error {
+		fsSetup, ok := config["fs_setup"].([]interface{})
+		if !ok && config["fs_setup"] != nil {
+			return fmt.Errorf("cannot add scratch disks to cloud-config: unsupported fs_setup field of type %T", config["fs_setup"])
+		}
+		mounts, ok := config["mounts"].([]interface{})
+		if !ok && config["mounts"] != nil {
+			return fmt.Errorf("cannot add scratch disks to cloud-config: unsupported mounts field of type %T", config["mounts"])
+		}
+		for _, disk := range formatted {
+			fsSetup = append(fsSetup, map[string]interface{}{
+				"device":     disk.device(),
+				"filesystem": disk.Filesystem,
+			})
+			if disk.MountPoint != "" {
+				mounts = append(mounts, []interface{}{disk.device(), disk.MountPoint, disk.Filesystem, "defaults,nofail", "0", "2"})
+			}
+		}
+		config["fs_setup"] = fsSetup
+		if mounts != nil {
+			config["mounts"] = mounts
+		}
+		return nil
+	})
+}
+
+// editCloudConfig applies edit to the cloud-config of the cloud-init
+// user-data. Existing cloud-config documents are merged into; any other
+// kind of user-data is preserved by combining it with the generated
+// cloud-config into a multipart document.
+func editCloudConfig(userData string, edit func(config map[string]interface{}) error) (string, error) {
+	if userData != "" && !isCloudConfig(userData) {
+		config, err := editCloudConfig("", edit)
+		if err != nil {
+			return "", err
+		}
+		return combineUserData(userData, config)
+	}
+
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(userData), &config); err != nil {
+		return "", fmt.Errorf("parsing cloud-config: %w", err)
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	if err := edit(config); err != nil {
+		return "", err
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return cloudConfigHeader + "\n" + string(out), nil
+}
+
+// combineUserData bundles several user-data documents into a single
+// multipart/mixed document, which cloud-init processes part by part.
+func combineUserData(parts ...string) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		content := io.Reader(strings.NewReader(part))
+
+		if isMIME(part) {
+			msg, err := mail.ReadMessage(strings.NewReader(part))
+			if err != nil {
+				return "", fmt.Errorf("parsing MIME user-data: %w", err)
+			}
+			header = textproto.MIMEHeader(msg.Header)
+			header.Del("MIME-Version")
+			content = msg.Body
+		} else {
+			// cloud-init guesses the type of text/plain parts from their
+			// first line, just like it does for plain user-data.
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(pw, content); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Content-Type: multipart/mixed; boundary=%q\n", w.Boundary())
+	sb.WriteString("MIME-Version: 1.0\n\n")
+	sb.WriteString(body.String())
+	return sb.String(), nil
+}
+
+// Keys of the Secret holding the cloud-init data of a job, as KubeVirt
+// reads them.
+const (
+	cloudInitUserDataKey    = "userdata"
+	cloudInitNetworkDataKey = "networkdata"
+)
+
+// JobCloudInitSecret returns the Secret holding the cloud-init user-data and
+// network-config of the job. The user-data may hold secrets, like the
+// private ssh host key of the guest, so it must not end up in the spec of
+// the instance, which more people may read than Secrets.
+func JobCloudInitSecret(jctx *JobContext) *k8sapi.Secret {
+	secret := &k8sapi.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: jctx.BaseName + "-cloudinit-",
+			Labels: map[string]string{
+				jobLabel(jctx, "cloudinit-of"): jctx.ID,
+			},
+		},
+		// KubeVirt needs user-data, even if empty, to read network-config.
+		StringData: map[string]string{
+			cloudInitUserDataKey: jctx.CloudInitUserData,
+		},
+	}
+	if jctx.CloudInitNetworkData != "" {
+		secret.StringData[cloudInitNetworkDataKey] = jctx.CloudInitNetworkData
+	}
+	return secret
+}
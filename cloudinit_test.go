@@ -0,0 +1,132 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestJobCloudInitSecret(t *testing.T) {
+	jctx := &JobContext{BaseName: "runner-1", ID: "abc", LabelPrefix: labelPrefix}
+
+	tests := []struct {
+		name              string
+		userData, network string
+		want              map[string]string
+	}{
+		{"user-data", "#cloud-config\n", "", map[string]string{cloudInitUserDataKey: "#cloud-config\n"}},
+		{"network-config", "", "version: 2\n", map[string]string{cloudInitUserDataKey: "", cloudInitNetworkDataKey: "version: 2\n"}},
+		{"both", "#cloud-config\n", "version: 2\n", map[string]string{cloudInitUserDataKey: "#cloud-config\n", cloudInitNetworkDataKey: "version: 2\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jctx.CloudInitUserData = tt.userData
+			jctx.CloudInitNetworkData = tt.network
+			secret := JobCloudInitSecret(jctx)
+			if len(secret.StringData) != len(tt.want) {
+				t.Errorf("data = %q, want %q", secret.StringData, tt.want)
+			}
+			for k, v := range tt.want {
+				if got, ok := secret.StringData[k]; !ok || got != v {
+					t.Errorf("data[%q] = %q, want %q", k, got, v)
+				}
+			}
+			if _, ok := secret.ObjectMeta.Labels[jobLabel(jctx, "id")]; ok {
+				t.Errorf("secret has the id label, which FindJobSSHKey would pick up")
+			}
+		})
+	}
+}
+
+func TestLoadCloudInitNetworkData(t *testing.T) {
+	const config = "version: 2\nethernets:\n  eth0:\n    addresses: [10.0.0.2/24]\n"
+
+	path := filepath.Join(t.TempDir(), "network-config")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", src: ""},
+		{name: "inline", src: config, want: config},
+		{name: "base64", src: base64.StdEncoding.EncodeToString([]byte(config)), want: config},
+		{name: "file", src: path, want: config},
+		{name: "empty document", src: "---\n", wantErr: true},
+		{name: "not a mapping", src: "- eth0\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadCloudInitNetworkData(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectSSHKey(t *testing.T) {
+	const key = "ecdsa-sha2-nistp256 AAAA runner@job"
+	users := func(t *testing.T, userData string) []interface{} {
+		t.Helper()
+		var config struct {
+			Users []interface{} `json:"users"`
+		}
+		if err := yaml.Unmarshal([]byte(userData), &config); err != nil {
+			t.Fatal(err)
+		}
+		return config.Users
+	}
+
+	t.Run("new user", func(t *testing.T) {
+		userData, err := InjectSSHKey("#cloud-config\nusers:\n- default\n", "runner", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []interface{}{
+			"default",
+			map[string]interface{}{
+				"name":                "runner",
+				"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+				"shell":               "/bin/sh",
+				"ssh_authorized_keys": []interface{}{key},
+			},
+		}
+		if got := users(t, userData); !reflect.DeepEqual(got, want) {
+			t.Errorf("users = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("existing user", func(t *testing.T) {
+		userData, err := InjectSSHKey("#cloud-config\nusers:\n- name: runner\n  shell: /bin/zsh\n  ssh_authorized_keys: [other]\n", "runner", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []interface{}{
+			map[string]interface{}{
+				"name":                "runner",
+				"shell":               "/bin/zsh",
+				"ssh_authorized_keys": []interface{}{"other", key},
+			},
+		}
+		if got := users(t, userData); !reflect.DeepEqual(got, want) {
+			t.Errorf("users = %v, want %v", got, want)
+		}
+	})
+}
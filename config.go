@@ -7,47 +7,37 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
-	"runtime/debug"
 )
 
-type ConfigCmd struct{}
+type ConfigCmd struct {
+	Dirs `embed:""`
+}
 
-var version string
+func (cmd *ConfigCmd) Run(jctx *JobContext) error {
+	if jctx.BuildsDir == "" {
+		jctx.BuildsDir = cmd.BuildsDir
+	}
+	if jctx.CacheDir == "" {
+		jctx.CacheDir = cmd.CacheDir
+	}
 
-func (ConfigCmd) Run() error {
+	// See https://docs.gitlab.com/runner/executors/custom.html#config
 	var config struct {
-		Driver struct {
+		BuildsDir string `json:"builds_dir,omitempty"`
+		CacheDir  string `json:"cache_dir,omitempty"`
+		Hostname  string `json:"hostname,omitempty"`
+		Driver    struct {
 			Name    string `json:"name"`
 			Version string `json:"version"`
 		} `json:"driver"`
 	}
 
+	config.BuildsDir = jctx.BuildsDir
+	config.CacheDir = jctx.CacheDir
+	config.Hostname = jctx.BaseName
 	config.Driver.Name = "gitlab-runner-kubevirt"
-	if binfo, ok := debug.ReadBuildInfo(); ok {
-		var k8sdep *debug.Module
-		for _, mod := range binfo.Deps {
-			if mod.Path == "k8s.io/api" {
-				k8sdep = mod
-				break
-			}
-		}
-
-		if version == "" {
-			version = binfo.Main.Version
-		}
-		if version == "(devel)" {
-			for _, s := range binfo.Settings {
-				if s.Key == "vcs.revision" {
-					version = s.Value + " (devel)"
-					break
-				}
-			}
-		}
-		version = fmt.Sprintf("%v (%v; k8s.io/api: %v)", version, binfo.GoVersion, k8sdep.Version)
-	}
-	config.Driver.Version = version
+	config.Driver.Version = GetBuildInfo().String()
 
 	return json.NewEncoder(os.Stdout).Encode(&config)
 }
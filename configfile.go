@@ -0,0 +1,301 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// ConfigFile is the path to a configuration file providing defaults for
+// the flags of every subcommand. A missing file is not an error.
+//
+// The file uses a subset of TOML: top-level keys apply to any subcommand
+// having a flag of that name, while keys under a [<subcommand>] table only
+// apply to that subcommand. Values are strings, integers, floats, booleans,
+// single-line arrays, or single-line inline tables.
+//
+//	namespace = "gitlab-runner"
+//	ssh-user = "runner"
+//
+//	[prepare]
+//	default-cpu-request = "2"
+//	default-memory-request = "4Gi"
+//	default-node-selector = { "kubernetes.io/arch" = "amd64" }
+//
+// Flags set on the command line or through their environment variable
+// take precedence over the file.
+type ConfigFile string
+
+func (path ConfigFile) BeforeResolve(ctx *kong.Context) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(kong.ExpandPath(string(path)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resolver, err := LoadConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := resolver.Validate(ctx.Model); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	ctx.AddResolver(resolver)
+	return nil
+}
+
+type configEntry struct {
+	Value interface{}
+	Line  int
+}
+
+type configResolver map[string]configEntry
+
+// LoadConfig parses a configuration file into a kong resolver. Syntax
+// errors are reported with the line they occur on.
+func LoadConfig(r io.Reader) (kong.Resolver, error) {
+	values := configResolver{}
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if strings.HasPrefix(line, "[[") || end == -1 || !isConfigComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid table header %q", lineno, line)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !isBareKey(table) {
+				return nil, fmt.Errorf("line %d: invalid table name %q", lineno, table)
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !isBareKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineno, key)
+		}
+		value, rest, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineno, key, err)
+		}
+		if !isConfigComment(rest) {
+			return nil, fmt.Errorf("line %d: %s: unexpected %q after value", lineno, key, rest)
+		}
+
+		key = strings.ReplaceAll(key, "_", "-")
+		if table != "" {
+			key = table + "." + key
+		}
+		if prev, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: %s already set on line %d", lineno, key, prev.Line)
+		}
+		values[key] = configEntry{Value: value, Line: lineno}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (values configResolver) Validate(app *kong.Application) error {
+	known := map[string]bool{}
+	for _, flag := range app.Flags {
+		known[flag.Name] = true
+	}
+	for _, cmd := range app.Children {
+		for _, flag := range cmd.Flags {
+			known[flag.Name] = true
+			known[cmd.Name+"."+flag.Name] = true
+		}
+	}
+
+	var errs []string
+	for key, entry := range values {
+		if !known[key] {
+			errs = append(errs, fmt.Sprintf("line %d: unknown setting %q", entry.Line, key))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (values configResolver) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if flag.Tag.Env != "" && os.Getenv(flag.Tag.Env) != "" {
+		return nil, nil
+	}
+	if parent.Command != nil {
+		if entry, ok := values[parent.Command.Name+"."+flag.Name]; ok {
+			return entry.Value, nil
+		}
+	}
+	if entry, ok := values[flag.Name]; ok {
+		return entry.Value, nil
+	}
+	return nil, nil
+}
+
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isConfigComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// parseConfigValue parses the value at the start of s and returns it along
+// with the remainder of s.
+func parseConfigValue(s string) (interface{}, string, error) {
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				str, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return nil, "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return str, s[i+1:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end == -1 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '[':
+		var array []interface{}
+		rest := strings.TrimSpace(s[1:])
+		for {
+			if rest == "" {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+			if strings.HasPrefix(rest, "]") {
+				return array, rest[1:], nil
+			}
+			value, next, err := parseConfigValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			array = append(array, value)
+			rest = strings.TrimSpace(next)
+			switch {
+			case strings.HasPrefix(rest, ","):
+				rest = strings.TrimSpace(rest[1:])
+			case strings.HasPrefix(rest, "]"):
+			default:
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	case '{':
+		table := map[string]interface{}{}
+		rest := strings.TrimSpace(s[1:])
+		for {
+			if rest == "" {
+				return nil, "", fmt.Errorf("unterminated inline table")
+			}
+			if strings.HasPrefix(rest, "}") {
+				return table, rest[1:], nil
+			}
+			var key interface{}
+			if rest[0] == '"' || rest[0] == '\'' {
+				var err error
+				if key, rest, err = parseConfigValue(rest); err != nil {
+					return nil, "", err
+				}
+			} else {
+				end := strings.IndexAny(rest, " =")
+				if end == -1 || !isBareKey(rest[:end]) {
+					return nil, "", fmt.Errorf("invalid key in inline table")
+				}
+				key, rest = rest[:end], rest[end:]
+			}
+			rest = strings.TrimSpace(rest)
+			if !strings.HasPrefix(rest, "=") {
+				return nil, "", fmt.Errorf("expected = after %q in inline table", key)
+			}
+			value, next, err := parseConfigValue(strings.TrimSpace(rest[1:]))
+			if err != nil {
+				return nil, "", err
+			}
+			table[key.(string)] = value
+			rest = strings.TrimSpace(next)
+			switch {
+			case strings.HasPrefix(rest, ","):
+				rest = strings.TrimSpace(rest[1:])
+			case strings.HasPrefix(rest, "}"):
+			default:
+				return nil, "", fmt.Errorf("expected , or } in inline table")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, " \t,]}#")
+	if end == -1 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	number := strings.ReplaceAll(token, "_", "")
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return i, rest, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q", token)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    interface{}
+		rest    string
+		wantErr string
+	}{
+		{in: `"a\"b" # comment`, want: `a"b`, rest: " # comment"},
+		{in: `'C:\path'`, want: `C:\path`},
+		{in: `["a", 'b']`, want: []interface{}{"a", "b"}},
+		{in: `[]`, want: []interface{}(nil)},
+		{in: `{ a = "1", "b c" = ["2"] }`, want: map[string]interface{}{"a": "1", "b c": []interface{}{"2"}}},
+		{in: `{}`, want: map[string]interface{}{}},
+		{in: ``, wantErr: "missing value"},
+		{in: `"a`, wantErr: "unterminated string"},
+		{in: `'a`, wantErr: "unterminated string"},
+		{in: `[`, wantErr: "unterminated array"},
+		{in: `["a",`, wantErr: "unterminated array"},
+		{in: `["a" "b"]`, wantErr: "expected , or ]"},
+		{in: `{`, wantErr: "unterminated inline table"},
+		{in: `{ a = "1",`, wantErr: "unterminated inline table"},
+		{in: `{ a = "1"`, wantErr: "expected , or }"},
+		{in: `{ a }`, wantErr: "expected = after"},
+		{in: `{ a = }`, wantErr: "invalid value"},
+		{in: `{ = "1" }`, wantErr: "invalid key"},
+	}
+	for _, tt := range tests {
+		got, rest, err := parseConfigValue(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseConfigValue(%q): err = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseConfigValue(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || rest != tt.rest {
+			t.Errorf("parseConfigValue(%q) = %#v, %q, want %#v, %q", tt.in, got, rest, tt.want, tt.rest)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    configResolver
+		wantErr string
+	}{
+		{
+			name: "tables",
+			in:   "namespace = \"ci\"\n\n[prepare]\n# comment\ndefault_image = \"alpine\" # comment\n",
+			want: configResolver{
+				"namespace":             {Value: "ci", Line: 1},
+				"prepare.default-image": {Value: "alpine", Line: 5},
+			},
+		},
+		{name: "duplicate", in: "a = \"1\"\na = \"2\"\n", wantErr: "line 2: a already set on line 1"},
+		{name: "unterminated inline table", in: "x = {\n", wantErr: "line 1: x: unterminated inline table"},
+		{name: "trailing comma", in: "x = { a = 1,\n", wantErr: "line 1: x:"},
+		{name: "garbage after value", in: "x = \"1\" 2\n", wantErr: "unexpected"},
+		{name: "array of tables", in: "[[x]]\n", wantErr: "invalid table header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadConfig(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// consoleRetryInterval is how often connecting to the serial console is
+// attempted; it is unavailable until the instance is scheduled and running.
+const consoleRetryInterval = 2 * time.Second
+
+// CaptureConsole copies the serial console of the Virtual Machine instance
+// to w until ctx is done, reconnecting whenever the console is unavailable
+// or the stream ends.
+func CaptureConsole(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	w io.Writer,
+) {
+	for {
+		stream, err := client.VirtualMachineInstance(jctx.Namespace).SerialConsole(vm.ObjectMeta.Name, &kubevirt.SerialConsoleOptions{
+			ConnectionTimeout: consoleRetryInterval,
+		})
+		if err == nil {
+			// The stream only stops when one of its ends does, so closing
+			// its input is what ends it once ctx is done.
+			in, inw := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					inw.Close()
+				case <-done:
+				}
+			}()
+			err = stream.Stream(kubevirt.StreamOptions{In: in, Out: w})
+			close(done)
+		}
+		if err != nil {
+			logger.Debug("serial console unavailable", "vmi", vm.ObjectMeta.Name, "err", err)
+		}
+
+		select {
+		case <-time.After(consoleRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// openConsoleLog returns where to capture the serial console to: the job log
+// when path is empty, or the file at path otherwise.
+func openConsoleLog(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return nopCloser{os.Stderr}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
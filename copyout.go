@@ -0,0 +1,182 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/helloyi/go-sshclient"
+)
+
+// Dirs are the directories of the Virtual Machine instance in which GitLab
+// Runner stages builds and caches, as reported by the config stage. The run
+// stage needs the same ones to copy them out, so they are best set at the
+// top level of the configuration file.
+type Dirs struct {
+	BuildsDir string `name:"builds-dir" help:"directory of the Virtual Machine instance in which builds are staged; defaults to the builds_dir of the runner"`
+	CacheDir  string `name:"cache-dir" help:"directory of the Virtual Machine instance in which the cache is stored; defaults to the cache_dir of the runner"`
+}
+
+// CopyOut copies the remote file or directory tree to local over sftp,
+// replacing the files that already exist. Regular files are streamed, and
+// keep their permissions; symbolic links are recreated as they are, unless
+// they point outside of local, and anything else is skipped. Copies never
+// write through symbolic links, since those come from the guest: a link
+// left by a previous copy is replaced rather than followed, and entries
+// below one are refused.
+func CopyOut(ctx context.Context, conn *sshclient.Client, remote, local string) error {
+	sftp := conn.Sftp()
+	if _, err := sftp.Stat(remote); os.IsNotExist(err) {
+		logger.Debug("nothing to copy out", "path", remote)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	walker, err := sftp.Walk(remote)
+	if err != nil {
+		return err
+	}
+
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remote), "/")
+		dst, err := copyOutPath(local, rel)
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", walker.Path(), err)
+		}
+		fi := walker.Stat()
+
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			err = os.MkdirAll(dst, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			var target string
+			if target, err = sftp.ReadLink(walker.Path()); err != nil {
+				break
+			}
+			if !linksWithin(local, dst, target) {
+				logger.Warn("not copying symbolic link pointing outside of the copy", "path", walker.Path(), "target", target)
+				break
+			}
+			err = os.Symlink(target, dst)
+		case mode.IsRegular():
+			err = copyOutFile(sftp, walker.Path(), dst, mode.Perm())
+		default:
+			logger.Debug("not copying special file", "path", walker.Path(), "mode", mode)
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", walker.Path(), err)
+		}
+	}
+	return nil
+}
+
+// copyOutPath returns where to copy the entry at rel, a slash-separated
+// path relative to the root of the remote tree, under root. None of the
+// parents of the returned path below root are symbolic links, and the path
+// itself is not one anymore, so that writing there stays within root.
+func copyOutPath(root, rel string) (string, error) {
+	dst := root
+	if rel != "" {
+		parts := strings.Split(rel, "/")
+		for i, part := range parts {
+			if part == "" || part == "." || part == ".." {
+				return "", fmt.Errorf("invalid path %q", rel)
+			}
+			dst = filepath.Join(dst, part)
+			if i == len(parts)-1 {
+				break
+			}
+			// Parents are copied before their children, so they exist.
+			fi, err := os.Lstat(dst)
+			if err != nil {
+				return "", err
+			}
+			if !fi.IsDir() {
+				return "", fmt.Errorf("refusing to copy below %s, which is not a directory", dst)
+			}
+		}
+	}
+
+	fi, err := os.Lstat(dst)
+	switch {
+	case os.IsNotExist(err):
+		return dst, nil
+	case err != nil:
+		return "", err
+	case fi.Mode()&os.ModeSymlink != 0:
+		if err := os.Remove(dst); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+// linksWithin returns whether a symbolic link at dst pointing to target
+// resolves to a path within root.
+func linksWithin(root, dst, target string) bool {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) {
+		return false
+	}
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(dst), target))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func copyOutFile(sftp *sshclient.RemoteFileSystem, remote, local string, perm os.FileMode) (err error) {
+	src, err := sftp.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	_, err = src.WriteTo(dst)
+	return err
+}
+
+// CopyOutDirs copies the builds and cache directories of the Virtual
+// Machine instance to the builds and cache subdirectories of local.
+func CopyOutDirs(ctx context.Context, conn Transport, dirs Dirs, local string) error {
+	copies := []struct {
+		Remote, Local string
+	}{
+		{dirs.BuildsDir, "builds"},
+		{dirs.CacheDir, "cache"},
+	}
+	for _, c := range copies {
+		if c.Remote == "" {
+			continue
+		}
+		dst := filepath.Join(local, c.Local)
+		logger.Debug("copying files out", "remote", c.Remote, "local", dst)
+		if err := conn.CopyOut(ctx, path.Clean(c.Remote), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyOutPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"dir", "dir/sub"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"escape":     outside,
+		"dir/escape": outside,
+		"inside":     "dir",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{rel: "", want: root},
+		{rel: "new", want: filepath.Join(root, "new")},
+		{rel: "dir/sub/new", want: filepath.Join(root, "dir", "sub", "new")},
+		{rel: "escape", want: filepath.Join(root, "escape")},
+		{rel: "dir/escape", want: filepath.Join(root, "dir", "escape")},
+		{rel: "escape/new", wantErr: true},
+		{rel: "dir/escape/new", wantErr: true},
+		{rel: "inside/new", wantErr: true},
+		{rel: "file/new", wantErr: true},
+		{rel: "missing/new", wantErr: true},
+		{rel: "../new", wantErr: true},
+		{rel: "dir/../../new", wantErr: true},
+		{rel: "dir//new", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := copyOutPath(root, tt.rel)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("copyOutPath(%q) = %q, want an error", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("copyOutPath(%q): %v", tt.rel, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("copyOutPath(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+		if fi, err := os.Lstat(got); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("copyOutPath(%q) left the symbolic link at %q", tt.rel, got)
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries appeared outside of the copy", len(entries))
+	}
+}
+
+func TestLinksWithin(t *testing.T) {
+	root := filepath.FromSlash("/copy/builds")
+	tests := []struct {
+		dst, target string
+		want        bool
+	}{
+		{"/copy/builds/link", "file", true},
+		{"/copy/builds/dir/link", "../file", true},
+		{"/copy/builds/dir/link", "./sub/../file", true},
+		{"/copy/builds/link", ".", true},
+		{"/copy/builds/link", "..", false},
+		{"/copy/builds/dir/link", "../../cache", false},
+		{"/copy/builds/link", "../builds-other/file", false},
+		{"/copy/builds/link", "/copy/builds/file", false},
+		{"/copy/builds/link", "/home/gitlab-runner/.ssh", false},
+	}
+	for _, tt := range tests {
+		if got := linksWithin(root, filepath.FromSlash(tt.dst), tt.target); got != tt.want {
+			t.Errorf("linksWithin(%q, %q, %q) = %v, want %v", root, tt.dst, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// DeadlineKey is the annotation recording when the job must be done by,
+// with --job-timeout. The prepare stage sets it, and the run stage aborts
+// the scripts of the job once it has passed, independently of the timeout
+// of GitLab Runner.
+const DeadlineKey = labelPrefix + "/deadline"
+
+// timeoutConsoleCapture is how long the serial console is copied to the job
+// log once the job has timed out, to help tell what the guest was up to.
+const timeoutConsoleCapture = 5 * time.Second
+
+// jobDeadline returns the deadline of the job from the Virtual Machine
+// instance, if it has one.
+func jobDeadline(vm *kubevirtapi.VirtualMachineInstance) (time.Time, bool) {
+	deadline, err := time.Parse(time.RFC3339, vm.ObjectMeta.Annotations[DeadlineKey])
+	return deadline, err == nil
+}
+
+// SetJobDeadline records the deadline of the job on the Virtual Machine
+// instance, or removes it when deadline is zero.
+func SetJobDeadline(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, deadline time.Time) error {
+	var value interface{}
+	if !deadline.IsZero() {
+		value = deadline.UTC().Format(time.RFC3339)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				DeadlineKey: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.VirtualMachineInstance(jctx.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	return err
+}
+
+// withJobDeadline returns a context that is done once the deadline of the
+// job recorded on the Virtual Machine instance has passed, if any.
+func withJobDeadline(ctx context.Context, vm *kubevirtapi.VirtualMachineInstance) (context.Context, context.CancelFunc) {
+	if deadline, ok := jobDeadline(vm); ok {
+		return context.WithDeadline(ctx, deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// jobTimedOut returns whether jobCtx, derived from ctx by withJobDeadline,
+// is done because the job ran past its deadline.
+func jobTimedOut(ctx, jobCtx context.Context) bool {
+	return ctx.Err() == nil && errors.Is(jobCtx.Err(), context.DeadlineExceeded)
+}
+
+// jobTimeoutError reports that the job ran past its deadline, after copying
+// the serial console of the Virtual Machine instance to the job log for a
+// little while.
+func jobTimeoutError(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	deadline, _ := jobDeadline(vm)
+	fmt.Fprintf(os.Stderr, "Job timed out, serial console of Virtual Machine instance %s:\n", vm.ObjectMeta.Name)
+
+	consoleCtx, cancel := context.WithTimeout(ctx, timeoutConsoleCapture)
+	defer cancel()
+	CaptureConsole(consoleCtx, client, jctx, vm, os.Stderr)
+
+	return fmt.Errorf("job did not finish by its deadline (%v), see --job-timeout", deadline.Local().Format(time.RFC3339))
+}
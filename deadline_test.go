@@ -0,0 +1,58 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestJobDeadline(t *testing.T) {
+	withDeadline := func(deadline string) *kubevirtapi.VirtualMachineInstance {
+		vm := &kubevirtapi.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{Name: "vm"}}
+		if deadline != "" {
+			vm.ObjectMeta.Annotations = map[string]string{DeadlineKey: deadline}
+		}
+		return vm
+	}
+	soon := time.Now().Add(20 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name         string
+		vm           *kubevirtapi.VirtualMachineInstance
+		cancelParent bool
+		wantTimedOut bool
+	}{
+		{name: "deadline passes", vm: withDeadline(soon), wantTimedOut: true},
+		{name: "job cancelled before its deadline", vm: withDeadline(later), cancelParent: true},
+		{name: "job cancelled without a deadline", vm: withDeadline(""), cancelParent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, cancelParent := context.WithCancel(context.Background())
+			defer cancelParent()
+			ctx, cancel := withJobDeadline(parent, tt.vm)
+			defer cancel()
+
+			if tt.cancelParent {
+				cancelParent()
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("the job context is not done")
+			}
+			if got := jobTimedOut(parent, ctx); got != tt.wantTimedOut {
+				t.Errorf("jobTimedOut = %v, want %v", got, tt.wantTimedOut)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// HotplugVolume attaches the PersistentVolumeClaim of vol to the running
+// Virtual Machine instance, as a disk on the SCSI bus, which is the only
+// one supporting hotplug; vol.Bus is ignored. It requires the
+// HotplugVolumes feature gate of KubeVirt.
+func HotplugVolume(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, vol ExtraVolume) error {
+	if vm.Spec.Domain.Devices.DisableHotplug {
+		return fmt.Errorf("Virtual Machine instance %s does not support hotplug: it has no SCSI controller to attach volumes to", vm.ObjectMeta.Name)
+	}
+
+	err := client.VirtualMachineInstance(vm.ObjectMeta.Namespace).AddVolume(ctx, vm.ObjectMeta.Name, &kubevirtapi.AddVolumeOptions{
+		Name: vol.Name,
+		Disk: &kubevirtapi.Disk{
+			Name: vol.Name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{
+					Bus:      "scsi",
+					ReadOnly: vol.ReadOnly,
+				},
+			},
+		},
+		VolumeSource: &kubevirtapi.HotplugVolumeSource{
+			PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+					ClaimName: vol.ClaimName,
+					ReadOnly:  vol.ReadOnly,
+				},
+				Hotpluggable: true,
+			},
+		},
+	})
+	if err != nil && strings.Contains(err.Error(), "HotplugVolumes") {
+		return fmt.Errorf("hotplugging volume %s: is the HotplugVolumes feature gate enabled? %w", vol.Name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("hotplugging volume %s: %w", vol.Name, err)
+	}
+	return nil
+}
+
+// DetachVolume detaches a volume attached by HotplugVolume.
+func DetachVolume(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, name string) error {
+	err := client.VirtualMachineInstance(vm.ObjectMeta.Namespace).RemoveVolume(ctx, vm.ObjectMeta.Name, &kubevirtapi.RemoveVolumeOptions{
+		Name: name,
+	})
+	if err != nil {
+		return fmt.Errorf("detaching volume %s: %w", name, err)
+	}
+	return nil
+}
+
+// DetachHotpluggedVolumes detaches every hotplugged volume still attached to
+// the Virtual Machine instance, so that their claims are released before the
+// instance goes away. Failures are only logged.
+func DetachHotpluggedVolumes(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) {
+	for _, status := range vm.Status.VolumeStatus {
+		if status.HotplugVolume == nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Detaching hotplugged volume %v\n", status.Name)
+		if err := DetachVolume(ctx, client, vm, status.Name); err != nil {
+			logger.Warn("detaching hotplugged volume", "vmi", vm.ObjectMeta.Name, "volume", status.Name, "err", err)
+		}
+	}
+}
@@ -10,48 +10,81 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	k8sapi "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
+	cdiapi "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/yaml"
 )
 
 const (
+	// labelPrefix is the domain of the annotations owned by this runner, and
+	// the default domain of its labels, see --label-prefix.
 	labelPrefix = "gitlab-runner-kubevirt.snai.pe"
+
+	// freePageReportingDisabledKey is the annotation with which KubeVirt
+	// versions supporting free page reporting let instances opt out of it.
+	freePageReportingDisabledKey = "kubevirt.io/free-page-reporting-disabled"
 )
 
-func KubeConfig() (*rest.Config, error) {
-	config, err := rest.InClusterConfig()
-	if err == rest.ErrNotInCluster {
-		var kubeconfig string
+// jobLabel returns the key of the label with the given name, in the label
+// domain of the job.
+func jobLabel(jctx *JobContext, name string) string {
+	return jctx.LabelPrefix + "/" + name
+}
+
+// KubeConfig returns the configuration to connect to the cluster with: the
+// kubeconfig file at path if set, or else the in-cluster configuration when
+// running in a pod, or else the kubeconfig file given by KUBECONFIG, or
+// ~/.kube/config. A non-empty kubeContext selects another context of the
+// kubeconfig file than its current one, and skips the in-cluster
+// configuration, which has no contexts.
+func KubeConfig(path, kubeContext string) (*rest.Config, error) {
+	if path == "" && kubeContext == "" {
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return config, err
+		}
+	}
+	if path == "" {
 		if home := homedir.HomeDir(); home != "" {
-			kubeconfig = filepath.Join(home, ".kube", "config")
+			path = filepath.Join(home, ".kube", "config")
 		}
 		if kc := os.Getenv("KUBECONFIG"); kc != "" {
-			kubeconfig = kc
+			path = kc
 		}
-
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-	}
-	if err != nil {
-		return nil, err
 	}
-	return config, nil
+
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: path}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 }
 
 func KubeClient() (kubevirt.KubevirtClient, error) {
-	cfg, err := KubeConfig()
+	cfg, err := KubeConfig(cli.Kubeconfig, cli.KubeContext)
 	if err != nil {
 		return nil, err
 	}
+	logger.Debug("connecting to cluster", "host", cfg.Host)
 	return kubevirt.GetKubevirtClientFromRESTConfig(cfg)
 }
 
@@ -62,37 +95,205 @@ func CreateJobVM(
 	rc *RunConfig,
 ) (*kubevirtapi.VirtualMachineInstance, error) {
 
-	resources := kubevirtapi.ResourceRequirements{
-		Requests: k8sapi.ResourceList{},
-		Limits:   k8sapi.ResourceList{},
+	resources, err := JobResources(jctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resources: %w", err)
 	}
 
-	type entry struct {
-		List  k8sapi.ResourceList
-		Key   k8sapi.ResourceName
-		Value string
+	// The number of vCPUs seen by the guest is the product of the topology,
+	// with KubeVirt defaulting unset members to 1. Without a topology,
+	// KubeVirt derives the vCPUs from the CPU limit instead.
+	var cpu *kubevirtapi.CPU
+	if jctx.CPUSockets != 0 || jctx.CPUCores != 0 || jctx.CPUThreads != 0 {
+		cpu = &kubevirtapi.CPU{
+			Sockets: jctx.CPUSockets,
+			Cores:   jctx.CPUCores,
+			Threads: jctx.CPUThreads,
+		}
+		vcpus := int64(1)
+		for _, n := range []uint32{cpu.Sockets, cpu.Cores, cpu.Threads} {
+			if n != 0 {
+				vcpus *= int64(n)
+			}
+		}
+		if limit, ok := resources.Limits[k8sapi.ResourceCPU]; ok && limit.Cmp(*resource.NewQuantity(vcpus, resource.DecimalSI)) != 0 {
+			defaulted := ""
+			if jctx.CPULimit == "" {
+				defaulted = ", defaulted from the CPU request"
+			}
+			return nil, fmt.Errorf("CPU topology of %d vCPUs (sockets × cores × threads) does not match the CPU limit of %s%s", vcpus, limit.String(), defaulted)
+		}
 	}
-	toParse := []entry{
-		{resources.Requests, k8sapi.ResourceCPU, jctx.CPURequest},
-		{resources.Limits, k8sapi.ResourceCPU, jctx.CPULimit},
-		{resources.Requests, k8sapi.ResourceMemory, jctx.MemoryRequest},
-		{resources.Limits, k8sapi.ResourceMemory, jctx.MemoryLimit},
-		{resources.Requests, k8sapi.ResourceEphemeralStorage, jctx.EphemeralStorageRequest},
-		{resources.Limits, k8sapi.ResourceEphemeralStorage, jctx.EphemeralStorageLimit},
+
+	if jctx.DedicatedCPU {
+		// Dedicated CPUs are only handed out to pods with the Guaranteed
+		// QoS class.
+		for _, key := range []k8sapi.ResourceName{k8sapi.ResourceCPU, k8sapi.ResourceMemory} {
+			request, hasRequest := resources.Requests[key]
+			limit, hasLimit := resources.Limits[key]
+			if !hasRequest || !hasLimit || request.Cmp(limit) != 0 {
+				return nil, fmt.Errorf("dedicated CPU placement requires the %s request (%s) to equal the %s limit (%s)",
+					key, quantityString(request, hasRequest), key, quantityString(limit, hasLimit))
+			}
+		}
+		if cpu == nil {
+			cpu = &kubevirtapi.CPU{}
+		}
+		cpu.DedicatedCPUPlacement = true
 	}
 
-	for _, e := range toParse {
-		if e.Value == "" {
-			continue
+	var memory *kubevirtapi.Memory
+	if jctx.HugepagesPageSize != "" {
+		pageSize, err := resource.ParseQuantity(jctx.HugepagesPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("parsing hugepages page size: %w", err)
 		}
-		var err error
-		if e.List[e.Key], err = resource.ParseQuantity(e.Value); err != nil {
-			return nil, fmt.Errorf("parsing %s quantity: %w", e.Key, err)
+		if pageSize.Value() <= 0 {
+			return nil, fmt.Errorf("hugepages page size must be positive")
+		}
+		if request, ok := resources.Requests[k8sapi.ResourceMemory]; ok && request.Value()%pageSize.Value() != 0 {
+			return nil, fmt.Errorf("memory request %s is not a multiple of the hugepages page size %s", request.String(), pageSize.String())
+		}
+		memory = &kubevirtapi.Memory{
+			Hugepages: &kubevirtapi.Hugepages{
+				PageSize: jctx.HugepagesPageSize,
+			},
 		}
 	}
 
-	if jctx.Image == "" {
-		return nil, fmt.Errorf("must specify a containerdisk image")
+	// Without a guest memory, KubeVirt gives the guest the memory request.
+	if jctx.GuestMemory != "" {
+		guest, err := resource.ParseQuantity(jctx.GuestMemory)
+		if err != nil {
+			return nil, fmt.Errorf("parsing guest memory: %w", err)
+		}
+		if guest.Sign() <= 0 {
+			return nil, fmt.Errorf("guest memory must be positive")
+		}
+		if limit, ok := resources.Limits[k8sapi.ResourceMemory]; ok && guest.Cmp(limit) > 0 {
+			return nil, fmt.Errorf("guest memory %s exceeds the memory limit %s", guest.String(), limit.String())
+		}
+		if memory == nil {
+			memory = &kubevirtapi.Memory{}
+		} else if pageSize := resource.MustParse(memory.Hugepages.PageSize); guest.Value()%pageSize.Value() != 0 {
+			return nil, fmt.Errorf("guest memory %s is not a multiple of the hugepages page size %s", guest.String(), pageSize.String())
+		}
+		memory.Guest = &guest
+	}
+
+	// Requests are scaled down for density, while the guest keeps seeing the
+	// memory that it asked for. Dedicated CPUs need the requests whole, and
+	// hugepages back all of the memory of the guest.
+	var scaled []k8sapi.ResourceName
+	if !jctx.DedicatedCPU {
+		scaled = append(scaled, k8sapi.ResourceCPU)
+		// Without a topology or CPU limit, KubeVirt would give the guest as
+		// many vCPUs as the scaled request, so pin them to the unscaled one.
+		_, hasLimit := resources.Limits[k8sapi.ResourceCPU]
+		if request, ok := resources.Requests[k8sapi.ResourceCPU]; ok && cpu == nil && !hasLimit && jctx.RequestMultiplier != 1 {
+			cpu = &kubevirtapi.CPU{Sockets: uint32((request.MilliValue() + 999) / 1000)}
+		}
+		if request, ok := resources.Requests[k8sapi.ResourceMemory]; ok && (memory == nil || memory.Hugepages == nil) && jctx.RequestMultiplier != 1 {
+			if memory == nil {
+				guest := request.DeepCopy()
+				memory = &kubevirtapi.Memory{Guest: &guest}
+			}
+			scaled = append(scaled, k8sapi.ResourceMemory)
+		}
+	}
+	if err := ScaleRequests(resources, jctx.RequestMultiplier, scaled...); err != nil {
+		return nil, fmt.Errorf("invalid resources: %w", err)
+	}
+
+	if jctx.GuestNUMA {
+		// KubeVirt derives the guest NUMA topology from the host CPUs and
+		// hugepages of the pod, so it needs both.
+		if !jctx.DedicatedCPU || memory == nil || memory.Hugepages == nil {
+			return nil, fmt.Errorf("guest NUMA topology requires dedicated CPU placement and hugepages")
+		}
+		cpu.NUMA = &kubevirtapi.NUMA{
+			GuestMappingPassthrough: &kubevirtapi.NUMAGuestMappingPassthrough{},
+		}
+	}
+
+	if err := validateLabels("node selector", jctx.NodeSelector); err != nil {
+		return nil, err
+	}
+	if err := validateLabels("labels", jctx.Labels); err != nil {
+		return nil, err
+	}
+	if err := validateAnnotations("annotations", jctx.Annotations); err != nil {
+		return nil, err
+	}
+
+	gpus := map[string]bool{}
+	for _, gpu := range jctx.GPUs {
+		if gpus[gpu.Name] {
+			return nil, fmt.Errorf("GPU %q is requested more than once", gpu.Name)
+		}
+		gpus[gpu.Name] = true
+	}
+	hostDevices := map[string]bool{}
+	for _, dev := range jctx.HostDevices {
+		if dev.Name == "" || dev.DeviceName == "" {
+			return nil, fmt.Errorf("host device %q:%q: name and device name must not be empty", dev.Name, dev.DeviceName)
+		}
+		if hostDevices[dev.Name] {
+			return nil, fmt.Errorf("host device %q is requested more than once", dev.Name)
+		}
+		hostDevices[dev.Name] = true
+	}
+
+	dataVolume := jctx.DataVolumeName != "" || jctx.DataVolumeImage != ""
+	switch {
+	case jctx.DataVolumeName != "" && jctx.DataVolumeImage != "":
+		return nil, fmt.Errorf("cannot use both an existing data volume and a data volume image")
+	case dataVolume && jctx.Image != "":
+		return nil, fmt.Errorf("cannot use both a containerdisk image and a data volume")
+	case !dataVolume && jctx.Image == "":
+		return nil, fmt.Errorf("must specify a containerdisk image or a data volume")
+	}
+
+	// The secrets must already exist in the namespace of the instance.
+	// KubeVirt only takes a single pull secret per containerdisk, so reject
+	// anything that would silently be dropped.
+	var pullSecrets []string
+	for _, name := range jctx.ImagePullSecrets {
+		if name = strings.TrimSpace(name); name != "" {
+			pullSecrets = append(pullSecrets, name)
+		}
+	}
+	var pullSecret string
+	switch {
+	case len(pullSecrets) > 1:
+		return nil, fmt.Errorf("containerdisk images support a single image pull secret, got %s", strings.Join(pullSecrets, ", "))
+	case len(pullSecrets) == 1:
+		pullSecret = pullSecrets[0]
+	}
+
+	pullPolicy, err := imagePullPolicy(jctx.ImagePullPolicy, jctx.Image)
+	if err != nil {
+		return nil, err
+	}
+	if _, pinned := imageDigest(jctx.Image); pinned && pullPolicy == k8sapi.PullAlways {
+		logger.Warn("the image is pinned by digest, pulling it always only costs time", "image", jctx.Image)
+	}
+
+	rootDisk := containerDiskName
+	rootSource := kubevirtapi.VolumeSource{
+		ContainerDisk: &kubevirtapi.ContainerDiskSource{
+			Image:           jctx.Image,
+			ImagePullPolicy: pullPolicy,
+			ImagePullSecret: pullSecret,
+		},
+	}
+	if dataVolume {
+		rootDisk = dataVolumeDiskName
+		rootSource = kubevirtapi.VolumeSource{
+			DataVolume: &kubevirtapi.DataVolumeSource{
+				Name: jctx.DataVolumeName,
+			},
+		}
 	}
 
 	runConfigJSON, err := json.Marshal(rc)
@@ -100,8 +301,153 @@ func CreateJobVM(
 		return nil, err
 	}
 
+	if grace := jctx.TerminationGracePeriodSeconds; grace != nil && *grace < 0 {
+		return nil, fmt.Errorf("termination grace period must not be negative, got %ds", *grace)
+	}
+
+	if err := applyArchitecture(jctx); err != nil {
+		return nil, err
+	}
+	if err := checkMachineType(jctx.Architecture, jctx.MachineType, jctx.AllowedMachineTypes); err != nil {
+		return nil, err
+	}
+
+	// KubeVirt enables Secure Boot by default with EFI, so it has to be
+	// turned off explicitly.
+	if jctx.SecureBoot && jctx.Firmware != "efi" {
+		return nil, fmt.Errorf("secure boot requires EFI firmware")
+	}
+	var firmware *kubevirtapi.Firmware
+	var features *kubevirtapi.Features
+	switch jctx.Firmware {
+	case "":
+	case "bios":
+		firmware = &kubevirtapi.Firmware{
+			Bootloader: &kubevirtapi.Bootloader{BIOS: &kubevirtapi.BIOS{}},
+		}
+	case "efi":
+		secureBoot := jctx.SecureBoot
+		firmware = &kubevirtapi.Firmware{
+			Bootloader: &kubevirtapi.Bootloader{
+				EFI: &kubevirtapi.EFI{SecureBoot: &secureBoot},
+			},
+		}
+		if secureBoot {
+			enabled := true
+			features = &kubevirtapi.Features{
+				SMM: &kubevirtapi.FeatureState{Enabled: &enabled},
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown firmware %q, must be bios or efi", jctx.Firmware)
+	}
+
+	if err := checkClusterSMBIOS(client, jctx.SMBIOS); err != nil {
+		return nil, err
+	}
+	if jctx.SMBIOS.Serial != "" {
+		if firmware == nil {
+			firmware = &kubevirtapi.Firmware{}
+		}
+		firmware.Serial = jctx.SMBIOS.Serial
+	}
+
+	// The TPM state does not survive the instance; persisting it needs a
+	// newer KubeVirt API than the one this is built against.
+	var tpm *kubevirtapi.TPMDevice
+	if jctx.EnableTPM {
+		tpm = &kubevirtapi.TPMDevice{}
+	}
+
+	var rng *kubevirtapi.Rng
+	if jctx.EnableRNG {
+		rng = &kubevirtapi.Rng{}
+	}
+
+	// KubeVirt attaches a balloon device unless told otherwise, and has the
+	// guest report its free pages through it unless the instance opts out.
+	// Both are left to KubeVirt unless the balloon is requested, in which
+	// case free page reporting is only on when requested as well.
+	if jctx.EnableFreePageReporting && !jctx.EnableMemBalloon {
+		return nil, fmt.Errorf("free page reporting requires the memory balloon device")
+	}
+	var memBalloon *bool
+	if jctx.EnableMemBalloon {
+		memBalloon = &jctx.EnableMemBalloon
+	}
+
+	// The device only fires once armed by a watchdog daemon in the guest,
+	// and then whenever the daemon stops petting it.
+	var watchdog *kubevirtapi.Watchdog
+	switch action := kubevirtapi.WatchdogAction(jctx.Watchdog); action {
+	case "":
+	case kubevirtapi.WatchdogActionPoweroff, kubevirtapi.WatchdogActionReset, kubevirtapi.WatchdogActionShutdown:
+		watchdog = &kubevirtapi.Watchdog{
+			Name: "watchdog",
+			WatchdogDevice: kubevirtapi.WatchdogDevice{
+				I6300ESB: &kubevirtapi.I6300ESBWatchdog{Action: action},
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unknown watchdog action %q, must be poweroff, reset or shutdown", jctx.Watchdog)
+	}
+
+	var evictionStrategy *kubevirtapi.EvictionStrategy
+	switch strategy := kubevirtapi.EvictionStrategy(jctx.EvictionStrategy); strategy {
+	case "":
+	case kubevirtapi.EvictionStrategyNone, kubevirtapi.EvictionStrategyLiveMigrate, kubevirtapi.EvictionStrategyExternal:
+		evictionStrategy = &strategy
+	default:
+		return nil, fmt.Errorf("unknown eviction strategy %q, must be None, LiveMigrate or External", jctx.EvictionStrategy)
+	}
+
+	if jctx.PriorityClassName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(jctx.PriorityClassName) {
+			return nil, fmt.Errorf("invalid priority class name %q: %s", jctx.PriorityClassName, msg)
+		}
+	}
+
+	for _, name := range []struct{ What, Value string }{{"hostname", jctx.Hostname}, {"subdomain", jctx.Subdomain}} {
+		if name.Value == "" {
+			continue
+		}
+		for _, msg := range validation.IsDNS1123Label(name.Value) {
+			return nil, fmt.Errorf("invalid %s %q: %s", name.What, name.Value, msg)
+		}
+	}
+
+	interfaces, networks, err := jobNetworks(jctx)
+	if err != nil {
+		return nil, err
+	}
+	dnsPolicy, dnsConfig, err := jobDNS(jctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServices(jctx); err != nil {
+		return nil, err
+	}
+	if len(jctx.Services) > 0 {
+		if dnsConfig == nil {
+			dnsConfig = &k8sapi.PodDNSConfig{}
+		}
+		dnsConfig.Searches = append(dnsConfig.Searches, servicesSearchDomain(jctx))
+	}
+
 	timezone := kubevirtapi.ClockOffsetTimezone(jctx.Timezone)
 
+	labels := map[string]string{
+		jobLabel(jctx, "id"):       jctx.ID,
+		jobLabel(jctx, "project"):  sanitizeLabelValue(jctx.ProjectID),
+		jobLabel(jctx, "pipeline"): sanitizeLabelValue(jctx.PipelineID),
+		jobLabel(jctx, "job"):      sanitizeLabelValue(jctx.JobID),
+	}
+	if jctx.Pool != "" {
+		for k, v := range poolLabels(jctx, poolStateClaimed) {
+			labels[k] = v
+		}
+	}
+
 	instanceTemplate := kubevirtapi.VirtualMachineInstance{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: kubevirtapi.GroupVersion.String(),
@@ -109,10 +455,8 @@ func CreateJobVM(
 		},
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: jctx.BaseName,
-			Labels: map[string]string{
-				labelPrefix + "/id": jctx.ID,
-			},
-			Annotations: map[string]string{
+			Labels:       mergeMetadata("label", jctx.Labels, labels),
+			Annotations: mergeMetadata("annotation", jctx.Annotations, map[string]string{
 				// These annotations are set by the Kubernetes executor; borrow
 				// them for compatibility
 				"project.runner.gitlab.com/id":     jctx.ProjectID,
@@ -125,19 +469,44 @@ func CreateJobVM(
 
 				// These are owned by this runner.
 				RunConfigKey: string(runConfigJSON),
-			},
+			}),
 		},
 		Spec: kubevirtapi.VirtualMachineInstanceSpec{
+			NodeSelector: jctx.NodeSelector,
+			Tolerations:  jctx.Tolerations,
+			Affinity:     jobAffinity(jctx),
+			Networks:     networks,
+			DNSPolicy:    dnsPolicy,
+			DNSConfig:    dnsConfig,
+
+			EvictionStrategy:              evictionStrategy,
+			TerminationGracePeriodSeconds: jctx.TerminationGracePeriodSeconds,
+			PriorityClassName:             jctx.PriorityClassName,
+			SchedulerName:                 jctx.SchedulerName,
+			Hostname:                      jctx.Hostname,
+			Subdomain:                     jctx.Subdomain,
+
 			Domain: kubevirtapi.DomainSpec{
 				Resources: resources,
+				CPU:       cpu,
+				Memory:    memory,
 				Machine: &kubevirtapi.Machine{
 					Type: jctx.MachineType,
 				},
+				Firmware: firmware,
+				Features: features,
 				Devices: kubevirtapi.Devices{
+					GPUs:        jctx.GPUs,
+					HostDevices: jctx.HostDevices,
+					Interfaces:  interfaces,
+					TPM:         tpm,
+					Watchdog:    watchdog,
+					Rng:         rng,
+
+					AutoattachMemBalloon: memBalloon,
 					Disks: []kubevirtapi.Disk{
 						{
-							Name:  "containervolume",
-							Cache: "writethrough",
+							Name: rootDisk,
 							DiskDevice: kubevirtapi.DiskDevice{
 								Disk: &kubevirtapi.DiskTarget{Bus: "virtio"},
 							},
@@ -158,56 +527,820 @@ func CreateJobVM(
 			},
 			Volumes: []kubevirtapi.Volume{
 				{
-					Name: "containervolume",
-					VolumeSource: kubevirtapi.VolumeSource{
-						ContainerDisk: &kubevirtapi.ContainerDiskSource{
-							Image:           jctx.Image,
-							ImagePullPolicy: k8sapi.PullPolicy(jctx.ImagePullPolicy),
-							ImagePullSecret: jctx.ImagePullSecret,
-						},
-					},
+					Name:         rootDisk,
+					VolumeSource: rootSource,
 				},
 			},
 		},
 	}
-	if jctx.CloudInitBase64 != "" {
-		instanceTemplate.Spec.Domain.Devices.Disks = append(instanceTemplate.Spec.Domain.Devices.Disks, kubevirtapi.Disk{
-			Name: "cloudinitvolume",
+	if jctx.EnableMemBalloon && !jctx.EnableFreePageReporting {
+		instanceTemplate.ObjectMeta.Annotations[freePageReportingDisabledKey] = "true"
+	}
+	if !jctx.Deadline.IsZero() {
+		instanceTemplate.ObjectMeta.Annotations[DeadlineKey] = jctx.Deadline.UTC().Format(time.RFC3339)
+	}
+	// The name of the cloud-init Secret is only known once it is created.
+	var cloudInitRef *k8sapi.LocalObjectReference
+	if jctx.CloudInitUserData != "" || jctx.CloudInitNetworkData != "" {
+		cloudInitRef = &k8sapi.LocalObjectReference{}
+		source := kubevirtapi.CloudInitNoCloudSource{UserDataSecretRef: cloudInitRef}
+		if jctx.CloudInitNetworkData != "" {
+			source.NetworkDataSecretRef = cloudInitRef
+		}
+		attachVolume(&instanceTemplate, kubevirtapi.Disk{
+			Name: cloudInitDiskName,
 			DiskDevice: kubevirtapi.DiskDevice{
 				Disk: &kubevirtapi.DiskTarget{Bus: "virtio"},
 			},
+		}, kubevirtapi.VolumeSource{
+			CloudInitNoCloud: &source,
+		})
+	}
+
+	if err := validateBus(jctx.RootBus); err != nil {
+		return nil, fmt.Errorf("root disk: %w", err)
+	}
+	instanceTemplate.Spec.Domain.Devices.Disks[0].Disk.Bus = kubevirtapi.DiskBus(jctx.RootBus)
+
+	// Without boot orders, the guest boots from the disks in the order they
+	// are attached, i.e. from the root disk first.
+	orders := bootOrders{}
+	if err := orders.set(&instanceTemplate.Spec.Domain.Devices.Disks[0], jctx.RootBootOrder); err != nil {
+		return nil, err
+	}
+	if jctx.IOThrottle.DedicatedRootThread {
+		if err := setDedicatedIOThread(&instanceTemplate.Spec.Domain.Devices.Disks[0]); err != nil {
+			return nil, err
+		}
+	}
+	if jctx.RootCache != "" {
+		mode, err := parseCacheMode(jctx.RootCache)
+		if err != nil {
+			return nil, fmt.Errorf("root disk: %w", err)
+		}
+		instanceTemplate.Spec.Domain.Devices.Disks[0].Cache = kubevirtapi.DriverCache(mode)
+	}
+
+	names := diskNames{}
+	for _, vol := range jctx.ExtraVolumes {
+		if err := names.add(vol.Name); err != nil {
+			return nil, err
+		}
+		if err := validateBus(vol.Bus); err != nil {
+			return nil, fmt.Errorf("extra volume %s: %w", vol.Name, err)
+		}
+		if vol.VolumeMode != "" {
+			if err := checkClaimVolumeMode(ctx, client, jctx.Namespace, vol.ClaimName, vol.VolumeMode); err != nil {
+				return nil, fmt.Errorf("extra volume %s: %w", vol.Name, err)
+			}
+		}
+		disk := kubevirtapi.Disk{
+			Name: vol.Name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{
+					Bus:      kubevirtapi.DiskBus(vol.Bus),
+					ReadOnly: vol.ReadOnly,
+				},
+			},
+			Cache: kubevirtapi.DriverCache(vol.Cache),
+		}
+		if err := orders.set(&disk, vol.BootOrder); err != nil {
+			return nil, err
+		}
+		if vol.DedicatedIOThread {
+			if err := setDedicatedIOThread(&disk); err != nil {
+				return nil, err
+			}
+		}
+		attachVolume(&instanceTemplate, disk, kubevirtapi.VolumeSource{
+			PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+					ClaimName: vol.ClaimName,
+					ReadOnly:  vol.ReadOnly,
+				},
+			},
+		})
+	}
+	for _, disk := range jctx.ScratchDisks {
+		if err := names.add(disk.Name); err != nil {
+			return nil, err
+		}
+		if err := validateBus(disk.Bus); err != nil {
+			return nil, fmt.Errorf("scratch disk %s: %w", disk.Name, err)
+		}
+		attachVolume(&instanceTemplate, kubevirtapi.Disk{
+			Name:   disk.Name,
+			Serial: disk.Name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{Bus: kubevirtapi.DiskBus(disk.Bus)},
+			},
+		}, kubevirtapi.VolumeSource{
+			EmptyDisk: &kubevirtapi.EmptyDiskSource{
+				Capacity: disk.Size,
+			},
+		})
+	}
+	for _, fs := range jctx.Filesystems {
+		if err := names.add(fs.Name); err != nil {
+			return nil, err
+		}
+		instanceTemplate.Spec.Domain.Devices.Filesystems = append(instanceTemplate.Spec.Domain.Devices.Filesystems, kubevirtapi.Filesystem{
+			Name:     fs.Name,
+			Virtiofs: &kubevirtapi.FilesystemVirtiofs{},
 		})
 		instanceTemplate.Spec.Volumes = append(instanceTemplate.Spec.Volumes, kubevirtapi.Volume{
-			Name: "cloudinitvolume",
+			Name: fs.Name,
 			VolumeSource: kubevirtapi.VolumeSource{
-				CloudInitNoCloud: &kubevirtapi.CloudInitNoCloudSource{
-					UserDataBase64: jctx.CloudInitBase64,
+				PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+						ClaimName: fs.ClaimName,
+						ReadOnly:  fs.ReadOnly,
+					},
 				},
 			},
 		})
 	}
-	return client.VirtualMachineInstance(jctx.Namespace).Create(ctx, &instanceTemplate)
+	for _, vol := range jctx.SecretVolumes {
+		if vol.SecretName == "" {
+			return nil, fmt.Errorf("secret volume %s: missing secret name", vol.Name)
+		}
+		if err := names.add(vol.Name); err != nil {
+			return nil, err
+		}
+		attachVolume(&instanceTemplate, kubevirtapi.Disk{
+			Name: vol.Name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{Bus: "virtio"},
+			},
+		}, kubevirtapi.VolumeSource{
+			Secret: &kubevirtapi.SecretVolumeSource{
+				SecretName: vol.SecretName,
+			},
+		})
+	}
+	for _, vol := range jctx.ConfigMapVolumes {
+		if vol.ConfigMapName == "" {
+			return nil, fmt.Errorf("configmap volume %s: missing configmap name", vol.Name)
+		}
+		if err := names.add(vol.Name); err != nil {
+			return nil, err
+		}
+		optional := vol.Optional
+		attachVolume(&instanceTemplate, kubevirtapi.Disk{
+			Name: vol.Name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{Bus: "virtio", ReadOnly: true},
+			},
+		}, kubevirtapi.VolumeSource{
+			ConfigMap: &kubevirtapi.ConfigMapVolumeSource{
+				LocalObjectReference: k8sapi.LocalObjectReference{Name: vol.ConfigMapName},
+				Optional:             &optional,
+			},
+		})
+	}
+
+	switch policy := kubevirtapi.IOThreadsPolicy(jctx.IOThrottle.ThreadsPolicy); policy {
+	case "":
+		for _, disk := range instanceTemplate.Spec.Domain.Devices.Disks {
+			if disk.DedicatedIOThread != nil && *disk.DedicatedIOThread {
+				shared := kubevirtapi.IOThreadsPolicyShared
+				instanceTemplate.Spec.Domain.IOThreadsPolicy = &shared
+				break
+			}
+		}
+	case kubevirtapi.IOThreadsPolicyShared, kubevirtapi.IOThreadsPolicyAuto:
+		instanceTemplate.Spec.Domain.IOThreadsPolicy = &policy
+	default:
+		return nil, fmt.Errorf("unknown I/O threads policy %q, must be shared or auto", jctx.IOThrottle.ThreadsPolicy)
+	}
+
+	// Importing an image into a fresh data volume needs the DataVolume
+	// object to exist before the instance references it; it is then owned
+	// by the instance so that it gets garbage-collected alongside it.
+	var dv *cdiapi.DataVolume
+	if jctx.DataVolumeImage != "" {
+		dv, err = JobDataVolume(jctx)
+		if err != nil {
+			return nil, err
+		}
+		if !jctx.DryRun {
+			if dv, err = client.CdiClient().CdiV1beta1().DataVolumes(jctx.Namespace).Create(ctx, dv, metav1.CreateOptions{}); err != nil {
+				return nil, err
+			}
+		}
+		rootSource.DataVolume.Name = dv.ObjectMeta.Name
+	}
+
+	// So does the Secret holding the cloud-init data.
+	var cloudInit *k8sapi.Secret
+	if cloudInitRef != nil {
+		cloudInit = JobCloudInitSecret(jctx)
+		if !jctx.DryRun {
+			secret := cloudInit
+			err := retryNameCollisions("create cloud-init secret", func() error {
+				created, err := client.CoreV1().Secrets(jctx.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+				if err == nil {
+					cloudInit = created
+				}
+				return err
+			})
+			if err != nil {
+				if dv != nil {
+					_ = client.CdiClient().CdiV1beta1().DataVolumes(jctx.Namespace).Delete(ctx, dv.ObjectMeta.Name, metav1.DeleteOptions{})
+				}
+				return nil, fmt.Errorf("storing cloud-init data: %w", err)
+			}
+		}
+		cloudInitRef.Name = cloudInit.ObjectMeta.Name
+	}
+
+	var machine *kubevirtapi.VirtualMachine
+	if jctx.UseVirtualMachine {
+		machine = JobVirtualMachine(jctx, &instanceTemplate)
+	}
+
+	if jctx.DryRun {
+		if machine != nil {
+			return &instanceTemplate, PrintDryRun(os.Stdout, dv, cloudInit, machine)
+		}
+		return &instanceTemplate, PrintDryRun(os.Stdout, dv, cloudInit, &instanceTemplate)
+	}
+
+	createCtx := ctx
+	if jctx.CreateTimeout > 0 {
+		var cancel context.CancelFunc
+		createCtx, cancel = context.WithTimeout(ctx, jctx.CreateTimeout)
+		defer cancel()
+	}
+
+	var vm *kubevirtapi.VirtualMachineInstance
+	attempt := 0
+	err = retryAPI(createCtx, jctx, "create Virtual Machine instance", isTransientAPIError, func() error {
+		// The instance is created with a generated name, so a request that
+		// failed midway may still have created it: look for it before
+		// creating a duplicate.
+		attempt++
+		if machine != nil {
+			var err error
+			vm, err = createJobVirtualMachine(createCtx, client, jctx, machine, attempt > 1)
+			return err
+		}
+		if attempt > 1 {
+			if existing, err := findJobVM(createCtx, client, jctx); err == nil {
+				vm = existing
+				return nil
+			}
+		}
+		return retryNameCollisions("create Virtual Machine instance", func() error {
+			var err error
+			vm, err = client.VirtualMachineInstance(jctx.Namespace).Create(createCtx, &instanceTemplate)
+			return err
+		})
+	})
+	if err != nil && createCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %v creating Virtual Machine instance: %w", jctx.CreateTimeout, err)
+	}
+	if err != nil {
+		metricVMFailed.Inc(append(metricLabels(jctx), failureCreate)...)
+		if dv != nil {
+			_ = client.CdiClient().CdiV1beta1().DataVolumes(jctx.Namespace).Delete(ctx, dv.ObjectMeta.Name, metav1.DeleteOptions{})
+		}
+		if cloudInit != nil {
+			_ = client.CoreV1().Secrets(jctx.Namespace).Delete(ctx, cloudInit.ObjectMeta.Name, metav1.DeleteOptions{})
+		}
+		if len(jctx.Filesystems) > 0 && apierrors.IsInvalid(err) && strings.Contains(strings.ToLower(err.Error()), "virtiofs") {
+			return nil, fmt.Errorf("the cluster rejected virtiofs filesystems, is the ExperimentalVirtiofsSupport feature gate enabled? %w", err)
+		}
+		return nil, err
+	}
+	logger.Info("created Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "namespace", vm.ObjectMeta.Namespace)
+	metricVMCreated.Inc(metricLabels(jctx)...)
+
+	// The objects are patched rather than updated, since CDI starts
+	// reconciling the data volume right away, which makes the copy returned
+	// on creation stale. Without an owner, nothing would ever delete them,
+	// so the instance is deleted along with them if that fails.
+	ownerPatch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{OwnerReference(vm)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dv != nil {
+		if _, err := client.CdiClient().CdiV1beta1().DataVolumes(jctx.Namespace).Patch(ctx, dv.ObjectMeta.Name, types.MergePatchType, ownerPatch, metav1.PatchOptions{}); err != nil {
+			abandonJobVM(ctx, client, jctx, vm, dv, cloudInit)
+			return nil, fmt.Errorf("setting owner of data volume %s: %w", dv.ObjectMeta.Name, err)
+		}
+	}
+	if cloudInit != nil {
+		if _, err := client.CoreV1().Secrets(jctx.Namespace).Patch(ctx, cloudInit.ObjectMeta.Name, types.MergePatchType, ownerPatch, metav1.PatchOptions{}); err != nil {
+			abandonJobVM(ctx, client, jctx, vm, dv, cloudInit)
+			return nil, fmt.Errorf("setting owner of cloud-init secret %s: %w", cloudInit.ObjectMeta.Name, err)
+		}
+	}
+	return vm, nil
+}
+
+// abandonJobVM deletes a Virtual Machine instance that was just created,
+// along with the data volume and cloud-init secret created for it, if any,
+// which it may not own yet.
+func abandonJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	dv *cdiapi.DataVolume,
+	cloudInit *k8sapi.Secret,
+) {
+	if err := deleteInstance(ctx, client, jctx.Namespace, vm, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		logger.Warn("deleting abandoned Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "err", err)
+	}
+	if dv != nil {
+		_ = client.CdiClient().CdiV1beta1().DataVolumes(jctx.Namespace).Delete(ctx, dv.ObjectMeta.Name, metav1.DeleteOptions{})
+	}
+	if cloudInit != nil {
+		_ = client.CoreV1().Secrets(jctx.Namespace).Delete(ctx, cloudInit.ObjectMeta.Name, metav1.DeleteOptions{})
+	}
+}
+
+// JobDataVolume returns the DataVolume importing jctx.DataVolumeImage.
+func JobDataVolume(jctx *JobContext) (*cdiapi.DataVolume, error) {
+	if jctx.DataVolumeSize == "" {
+		return nil, fmt.Errorf("must specify a data volume size to import %s", jctx.DataVolumeImage)
+	}
+	size, err := resource.ParseQuantity(jctx.DataVolumeSize)
+	if err != nil {
+		return nil, fmt.Errorf("parsing data volume size: %w", err)
+	}
+
+	url := jctx.DataVolumeImage
+	if !strings.Contains(url, "://") {
+		url = cdiapi.RegistrySchemeDocker + "://" + url
+	}
+
+	dv := cdiapi.DataVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: jctx.BaseName,
+			Labels: map[string]string{
+				jobLabel(jctx, "id"): jctx.ID,
+			},
+		},
+		Spec: cdiapi.DataVolumeSpec{
+			Source: &cdiapi.DataVolumeSource{
+				Registry: &cdiapi.DataVolumeSourceRegistry{
+					URL: &url,
+				},
+			},
+			Storage: &cdiapi.StorageSpec{
+				Resources: k8sapi.ResourceRequirements{
+					Requests: k8sapi.ResourceList{
+						k8sapi.ResourceStorage: size,
+					},
+				},
+			},
+		},
+	}
+	return &dv, nil
+}
+
+// PrintDryRun writes the objects that CreateJobVM would create to w, as a
+// stream of YAML documents: the data volume and the cloud-init secret if
+// any, and the instance or the VirtualMachine wrapping it. Generated names
+// are left empty.
+func PrintDryRun(w io.Writer, dv *cdiapi.DataVolume, cloudInit *k8sapi.Secret, instance interface{}) error {
+	var objects []interface{}
+	if dv != nil {
+		dv := dv.DeepCopy()
+		dv.TypeMeta = metav1.TypeMeta{APIVersion: cdiapi.SchemeGroupVersion.String(), Kind: "DataVolume"}
+		objects = append(objects, dv)
+	}
+	if cloudInit != nil {
+		objects = append(objects, cloudInit)
+	}
+	objects = append(objects, instance)
+
+	for _, obj := range objects {
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("marshaling dry-run output: %w", err)
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckJobImage checks that the containerdisk image of the job is allowed,
+// and with jctx.CheckImage that it exists, then pins it to the digest that
+// its tag points to with jctx.ResolveImageDigest. It runs before anything
+// depends on jctx.Image, e.g. the pool profile, so that everything sees the
+// image that the job boots.
+func CheckJobImage(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	if jctx.Image == "" {
+		return nil
+	}
+	if err := checkImageAllowed(jctx.Image, jctx.AllowedImages); err != nil {
+		return err
+	}
+	if jctx.CheckImage {
+		err := CheckImageExists(ctx, client, jctx, jctx.Image, jctx.CheckImageTimeout)
+		if errors.Is(err, ErrImageNotFound) {
+			return err
+		}
+		if err != nil {
+			logger.Warn("could not check that the image exists", "image", jctx.Image, "err", err)
+		}
+	}
+	if _, pinned := imageDigest(jctx.Image); jctx.ResolveImageDigest && !pinned {
+		digest, err := ResolveImageDigest(ctx, client, jctx, jctx.Image, jctx.CheckImageTimeout)
+		if errors.Is(err, ErrImageNotFound) {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve the digest of image %v, using it as is: %v\n", jctx.Image, err)
+			return nil
+		}
+		logger.Info("resolved the digest of the image", "image", jctx.Image, "digest", digest)
+		fmt.Fprintf(os.Stderr, "Resolved image %v to %v\n", jctx.Image, digest)
+		jctx.Image = pinImage(jctx.Image, digest)
+	}
+	return nil
+}
+
+// checkImageAllowed returns an error unless image matches one of the glob
+// patterns in allowed. Wildcards do not match across slashes, so that
+// registry.internal/ci/* does not allow registry.internal/ci/sub/image. An
+// empty allowlist allows any image.
+func checkImageAllowed(image string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		ok, err := path.Match(pattern, image)
+		if err != nil {
+			return fmt.Errorf("invalid allowed image pattern %q: %w", pattern, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %q is not allowed; allowed images: %s", image, strings.Join(allowed, ", "))
+}
+
+// imagePullPolicy validates the pull policy of image, defaulting it like
+// Kubernetes does: Always for the latest tag, and IfNotPresent otherwise.
+func imagePullPolicy(policy, image string) (k8sapi.PullPolicy, error) {
+	switch k8sapi.PullPolicy(policy) {
+	case k8sapi.PullAlways, k8sapi.PullIfNotPresent, k8sapi.PullNever:
+		return k8sapi.PullPolicy(policy), nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid image pull policy %q: must be Always, IfNotPresent or Never", policy)
+	}
+	if ref, err := parseImageRef(image); err == nil && ref.Reference == "latest" {
+		return k8sapi.PullAlways, nil
+	}
+	return k8sapi.PullIfNotPresent, nil
+}
+
+func quantityString(q resource.Quantity, ok bool) string {
+	if !ok {
+		return "unset"
+	}
+	return q.String()
+}
+
+// validateAnnotations checks that annotations only has valid annotation
+// keys, reporting all of the invalid entries at once.
+func validateAnnotations(what string, annotations map[string]string) error {
+	var errs []string
+	for k := range annotations {
+		for _, msg := range validation.IsQualifiedName(strings.ToLower(k)) {
+			errs = append(errs, fmt.Sprintf("key %q: %s", k, msg))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid %s: %s", what, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// mergeMetadata returns the labels or annotations of user, overridden by
+// the ones of the runner, which must not be tampered with.
+func mergeMetadata(what string, user, runner map[string]string) map[string]string {
+	merged := make(map[string]string, len(user)+len(runner))
+	for k, v := range user {
+		merged[k] = v
+	}
+	for k, v := range runner {
+		if uv, ok := merged[k]; ok && uv != v {
+			logger.Warn("ignoring "+what+" reserved by the runner", "key", k)
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// sanitizeLabelValue turns s into a valid label value, by replacing the
+// characters that labels do not allow with dashes, and trimming it to the
+// maximum length of label values.
+func sanitizeLabelValue(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			b[i] = '-'
+		}
+	}
+	if len(b) > validation.LabelValueMaxLength {
+		b = b[:validation.LabelValueMaxLength]
+	}
+	// Label values must start and end with an alphanumeric character.
+	return strings.Trim(string(b), "-_.")
+}
+
+// maxBaseNameLength is the maximum length of the base name of the objects of
+// the job, which leaves room for the random suffix of generated names, and
+// for the names of instances to remain valid hostnames.
+const maxBaseNameLength = validation.DNS1123LabelMaxLength - 6
+
+// sanitizeBaseName turns s into a valid prefix of generated object names, by
+// lowercasing it, replacing the characters that names do not allow with
+// dashes, and trimming it to maxBaseNameLength.
+func sanitizeBaseName(s string) (string, error) {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+		default:
+			b[i] = '-'
+		}
+	}
+	if len(b) > maxBaseNameLength {
+		b = b[:maxBaseNameLength]
+	}
+	// Names must start and end with an alphanumeric character.
+	name := strings.Trim(string(b), "-")
+	if name == "" {
+		return "", fmt.Errorf("base name %q: no valid characters left", s)
+	}
+	return name, nil
+}
+
+// validateLabels checks that labels only has valid label keys and values,
+// reporting all of the invalid entries at once.
+func validateLabels(what string, labels map[string]string) error {
+	var errs []string
+	for k, v := range labels {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, fmt.Sprintf("key %q: %s", k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, fmt.Sprintf("value %q of %q: %s", v, k, msg))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid %s: %s", what, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ParseToleration parses a toleration from its compact key[=value][:Effect]
+// form. Without a value, the toleration matches any taint with the key;
+// tolerating any taint at all takes a spec of exactly *.
+func ParseToleration(spec string) (k8sapi.Toleration, error) {
+	var toleration k8sapi.Toleration
+
+	if spec == "*" {
+		toleration.Operator = k8sapi.TolerationOpExists
+		return toleration, nil
+	}
+
+	kv, effect := spec, ""
+	if i := strings.LastIndex(spec, ":"); i != -1 {
+		kv, effect = spec[:i], spec[i+1:]
+	}
+	switch k8sapi.TaintEffect(effect) {
+	case "", k8sapi.TaintEffectNoSchedule, k8sapi.TaintEffectPreferNoSchedule, k8sapi.TaintEffectNoExecute:
+		toleration.Effect = k8sapi.TaintEffect(effect)
+	default:
+		return toleration, fmt.Errorf("invalid toleration %q: unknown effect %q", spec, effect)
+	}
+
+	if i := strings.Index(kv, "="); i != -1 {
+		toleration.Key, toleration.Value = kv[:i], kv[i+1:]
+		toleration.Operator = k8sapi.TolerationOpEqual
+		if toleration.Key == "" {
+			return toleration, fmt.Errorf("invalid toleration %q: a value requires a key", spec)
+		}
+	} else {
+		toleration.Key = kv
+		toleration.Operator = k8sapi.TolerationOpExists
+		if toleration.Key == "" {
+			return toleration, fmt.Errorf("invalid toleration %q: missing key (use * to tolerate every taint)", spec)
+		}
+	}
+
+	if errs := validation.IsQualifiedName(toleration.Key); len(errs) > 0 {
+		return toleration, fmt.Errorf("invalid toleration %q: %s", spec, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(toleration.Value); len(errs) > 0 {
+		return toleration, fmt.Errorf("invalid toleration %q: %s", spec, strings.Join(errs, "; "))
+	}
+	return toleration, nil
+}
+
+// Device is a named reference to a permitted host device resource.
+type Device struct {
+	Name       string
+	DeviceName string
+}
+
+// ParseDevices parses a list of name:deviceName device specifications.
+func ParseDevices(what string, specs []string) ([]Device, error) {
+	var devices []Device
+	for _, spec := range specs {
+		i := strings.Index(spec, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid %s %q: expected name:deviceName", what, spec)
+		}
+		dev := Device{Name: spec[:i], DeviceName: spec[i+1:]}
+		if dev.Name == "" || dev.DeviceName == "" {
+			return nil, fmt.Errorf("invalid %s %q: name and device name must not be empty", what, spec)
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// OwnerReference returns a reference to the Virtual Machine instance, for
+// the objects of the job to be garbage-collected along with it. Instances
+// controlled by a VirtualMachine get replaced when restarting, so the
+// reference is to the VirtualMachine instead.
+func OwnerReference(vm *kubevirtapi.VirtualMachineInstance) metav1.OwnerReference {
+	if ref := controllingVM(vm); ref != nil {
+		return metav1.OwnerReference{
+			APIVersion: ref.APIVersion,
+			Kind:       ref.Kind,
+			Name:       ref.Name,
+			UID:        ref.UID,
+		}
+	}
+	return metav1.OwnerReference{
+		APIVersion: kubevirtapi.GroupVersion.String(),
+		Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+		Name:       vm.ObjectMeta.Name,
+		UID:        vm.ObjectMeta.UID,
+	}
 }
 
 func Selector(jctx *JobContext) *metav1.ListOptions {
 	return &metav1.ListOptions{
-		LabelSelector: fmt.Sprintf(labelPrefix+"/id=%s", jctx.ID),
+		LabelSelector: fmt.Sprintf("%s=%s", jobLabel(jctx, "id"), jctx.ID),
 	}
 }
 
+var ErrJobVMNotFound = errors.New("Virtual Machine instance disappeared while the job was running!")
+
+// FindJobVM returns the Virtual Machine instance of the job, retrying on
+// transient API errors, and starting over when the continue token of the
+// listing expires. Instances being restarted by their VirtualMachine are
+// waited for.
+//
+// An instance that was just created may not be listed yet, so it is only
+// reported as gone once it has not been found for jctx.FindTimeout.
 func FindJobVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (*kubevirtapi.VirtualMachineInstance, error) {
-	list, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, Selector(jctx))
-	if err != nil {
-		return nil, err
+	retryable := func(err error) bool {
+		return isTransientAPIError(err) || apierrors.IsResourceExpired(err)
 	}
+	deadline := time.Now().Add(virtualMachineStartTimeout)
+	notFoundDeadline := time.Now().Add(jctx.FindTimeout)
+	for {
+		var vm *kubevirtapi.VirtualMachineInstance
+		err := retryAPI(ctx, jctx, "find Virtual Machine instance", retryable, func() error {
+			var err error
+			vm, err = findJobVM(ctx, client, jctx)
+			return err
+		})
+		interval := 5 * time.Second
+		switch {
+		case errors.Is(err, ErrJobVMRestarting) && time.Now().Before(deadline):
+			logger.Info("waiting for the Virtual Machine instance to restart")
+		case errors.Is(err, ErrJobVMNotFound) && time.Now().Before(notFoundDeadline):
+			logger.Debug("Virtual Machine instance not found, retrying")
+			interval = time.Second
+		default:
+			return vm, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(interval):
+		}
+	}
+}
+
+func findJobVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (*kubevirtapi.VirtualMachineInstance, error) {
+	// Go through every page before counting: an empty first page does not
+	// mean that the instance is gone.
+	var items []kubevirtapi.VirtualMachineInstance
+	opts := Selector(jctx)
+	for {
+		list, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+		if list.Continue == "" {
+			break
+		}
+		opts.Continue = list.Continue
+	}
+
+	if len(items) == 0 {
+		// Not being able to list VirtualMachines just means that the runner
+		// does not use them.
+		list, err := client.VirtualMachine(jctx.Namespace).List(Selector(jctx))
+		if err == nil && len(list.Items) > 0 {
+			return nil, ErrJobVMRestarting
+		}
+		return nil, ErrJobVMNotFound
+	}
+	if len(items) > 1 {
+		return nil, fmt.Errorf("Virtual Machine instance has ambiguous ID! %d instances found with ID %v", len(items), jctx.ID)
+	}
+	vm := &items[0]
+	logger.Debug("found Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "phase", vm.Status.Phase)
+	return vm, nil
+}
+
+// ErrNoAddress is returned by JobVMAddress when the Virtual Machine instance
+// does not report a suitable address yet.
+var ErrNoAddress = errors.New("no address available yet")
+
+// JobVMAddress picks the address to connect to from the interfaces
+// reported in the status of the Virtual Machine instance. IPv4 addresses
+// are preferred, unless config.PreferIPv6 is set.
+func JobVMAddress(vm *kubevirtapi.VirtualMachineInstance, config AddressConfig) (string, error) {
+	var candidates []kubevirtapi.VirtualMachineInstanceNetworkInterface
+	switch config.Strategy {
+	case "", "first":
+		if len(vm.Status.Interfaces) > 0 {
+			candidates = vm.Status.Interfaces[:1]
+		}
+	case "interface":
+		if config.Interface == "" {
+			return "", fmt.Errorf("the interface address strategy requires an interface name")
+		}
+		for _, iface := range vm.Status.Interfaces {
+			if iface.Name == config.Interface {
+				candidates = append(candidates, iface)
+			}
+		}
+	case "guest-agent":
+		for _, iface := range vm.Status.Interfaces {
+			if strings.Contains(iface.InfoSource, "guest-agent") {
+				candidates = append(candidates, iface)
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown address strategy %q", config.Strategy)
+	}
+
+	for _, iface := range candidates {
+		if addr := pickAddress(iface, config.PreferIPv6); addr != "" {
+			return addr, nil
+		}
+	}
+	return "", ErrNoAddress
+}
 
-	if len(list.Items) == 0 {
-		return nil, fmt.Errorf("Virtual Machine instance disappeared while the job was running!")
+func pickAddress(iface kubevirtapi.VirtualMachineInstanceNetworkInterface, preferIPv6 bool) string {
+	ips := iface.IPs
+	if len(ips) == 0 && iface.IP != "" {
+		ips = []string{iface.IP}
 	}
-	if len(list.Items) > 1 {
-		return nil, fmt.Errorf("Virtual Machine instance has ambiguous ID! %d instances found with ID %v", len(list.Items), jctx.ID)
+
+	var fallback string
+	for _, addr := range ips {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ip.To4() == nil) == preferIPv6 {
+			return addr
+		}
+		if fallback == "" {
+			fallback = addr
+		}
 	}
-	return &list.Items[0], nil
+	return fallback
 }
 
 var ErrWatchDone = errors.New("watch done")
@@ -272,3 +1405,279 @@ outer:
 		}
 	}
 }
+
+// failureCheckInterval is how often the launcher pod gets inspected for
+// fatal conditions while waiting; those don't necessarily cause any update
+// to the Virtual Machine instance itself.
+const failureCheckInterval = 5 * time.Second
+
+// WaitForJobVM blocks until the Virtual Machine instance is Running, ready,
+// and has an IP address. It fails if the instance stops, if it or its
+// launcher pod reports one of jctx.FatalReasons, or if it does not become
+// ready within the timeout.
+//
+// What ready means depends on jctx.ReadinessMode: in "phase" mode, this is
+// the Ready condition of the instance, while in "agent" mode, the guest
+// agent must also have connected, which implies that the guest OS booted.
+// In "ssh" mode, the instance only needs to be Running, and readiness is
+// left to the caller connecting to it.
+func WaitForJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	timeout time.Duration,
+) (*kubevirtapi.VirtualMachineInstance, error) {
+	name := vm.ObjectMeta.Name
+
+	switch jctx.ReadinessMode {
+	case "", "phase", "agent", "ssh":
+	default:
+		return vm, fmt.Errorf("unknown readiness mode %q", jctx.ReadinessMode)
+	}
+	agentConnected := false
+
+	// Instances of a VirtualMachine get replaced when they fail, up to
+	// jctx.MaxRestarts times.
+	restartable := controllingVM(vm) != nil
+	restarts := 0
+	failedUIDs := map[types.UID]bool{}
+
+	timeoutCtx, stop := context.WithTimeout(ctx, timeout)
+	defer stop()
+
+	watchCtx, cancel := context.WithCancel(timeoutCtx)
+	defer cancel()
+
+	failed := make(chan error, 1)
+	// The launcher pod to check is the one of the current instance, which
+	// changes whenever the VirtualMachine restarts it.
+	var mu sync.Mutex
+	current := vm
+	if len(jctx.FatalReasons) > 0 {
+		go func() {
+			ticker := time.NewTicker(failureCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-watchCtx.Done():
+					return
+				}
+				mu.Lock()
+				instance := current
+				mu.Unlock()
+				if err := CheckLauncherPodFailure(watchCtx, client, jctx, instance); err != nil {
+					failed <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	err := WatchJobVM(watchCtx, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
+		switch et {
+		case watch.Error:
+			// Retry on watch failure
+			return nil
+		case watch.Deleted:
+			if restartable {
+				return nil
+			}
+			return fmt.Errorf("Virtual Machine instance %s was deleted while waiting for it to be ready", name)
+		}
+		if vm.Status.Phase != val.Status.Phase {
+			logger.Debug("Virtual Machine instance changed phase", "vmi", name, "from", vm.Status.Phase, "to", val.Status.Phase)
+		}
+		vm = val
+		mu.Lock()
+		current = val
+		mu.Unlock()
+		if err := checkConditionFailure(jctx, vm.Status.Conditions); err != nil {
+			return err
+		}
+		switch vm.Status.Phase {
+		case kubevirtapi.Running:
+			if jctx.ReadinessMode == "ssh" {
+				return ErrWatchDone
+			}
+		case kubevirtapi.Failed, kubevirtapi.Succeeded:
+			if restartable && vm.Status.Phase == kubevirtapi.Failed {
+				if failedUIDs[vm.ObjectMeta.UID] {
+					return nil
+				}
+				failedUIDs[vm.ObjectMeta.UID] = true
+				if restarts < jctx.MaxRestarts {
+					restarts++
+					fmt.Fprintf(os.Stderr, "Virtual Machine instance %s failed, waiting for it to restart (%d/%d)%s\n", name, restarts, jctx.MaxRestarts, describeConditions(vm))
+					return nil
+				}
+				return fmt.Errorf("Virtual Machine instance %s failed after %d restarts%s", name, restarts, describeConditions(vm))
+			}
+			return fmt.Errorf("Virtual Machine instance %s stopped before becoming ready (phase: %v)%s", name, vm.Status.Phase, describeConditions(vm))
+		default:
+			return nil
+		}
+		ready := false
+		for _, cond := range vm.Status.Conditions {
+			if cond.Status != k8sapi.ConditionTrue {
+				continue
+			}
+			switch cond.Type {
+			case kubevirtapi.VirtualMachineInstanceReady:
+				ready = true
+			case kubevirtapi.VirtualMachineInstanceAgentConnected:
+				agentConnected = true
+			}
+		}
+		if jctx.ReadinessMode == "agent" && !agentConnected {
+			return nil
+		}
+		if len(vm.Status.Interfaces) == 0 || vm.Status.Interfaces[0].IP == "" {
+			return nil
+		}
+		if ready {
+			return ErrWatchDone
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("waiting for Virtual Machine instance", "vmi", name, "phase", vm.Status.Phase, "err", err)
+	}
+	select {
+	case err := <-failed:
+		metricVMFailed.Inc(append(metricLabels(jctx), failureStart)...)
+		return vm, fmt.Errorf("Virtual Machine instance %s failed to start: %w", name, err)
+	default:
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		metricVMFailed.Inc(append(metricLabels(jctx), failureTimeout)...)
+		agent := ""
+		if jctx.ReadinessMode == "agent" {
+			agent = "; the guest agent never connected, is it installed in the image?"
+			if agentConnected {
+				agent = "; the guest agent connected"
+			}
+		}
+		return vm, fmt.Errorf("timed out after %v waiting for Virtual Machine instance %s to be ready (phase: %v)%s%s", timeout, name, vm.Status.Phase, describeConditions(vm), agent)
+	}
+	return vm, err
+}
+
+// ErrLauncherPodNotFound is returned by FindLauncherPod when KubeVirt has
+// not created the virt-launcher pod of the instance yet. It is worth
+// retrying.
+var ErrLauncherPodNotFound = errors.New("virt-launcher pod not found yet")
+
+// FindLauncherPod returns the virt-launcher pod of the Virtual Machine
+// instance, found in the namespace of the instance through the
+// kubevirt.io/created-by label and owner reference set by KubeVirt. Should
+// several pods exist, like during a migration, the one on the node the
+// instance reports running on is preferred, and the newest one otherwise.
+func FindLauncherPod(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) (*k8sapi.Pod, error) {
+	pods, err := client.CoreV1().Pods(vm.ObjectMeta.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=virt-launcher,%s=%s", kubevirtapi.AppLabel, kubevirtapi.CreatedByLabel, vm.ObjectMeta.UID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	onNode := func(pod *k8sapi.Pod) bool {
+		return vm.Status.NodeName != "" && pod.Spec.NodeName == vm.Status.NodeName
+	}
+	newer := func(pod, than *k8sapi.Pod) bool {
+		return than.ObjectMeta.CreationTimestamp.Before(&pod.ObjectMeta.CreationTimestamp)
+	}
+
+	var found *k8sapi.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		owned := false
+		for _, ref := range pod.ObjectMeta.OwnerReferences {
+			if ref.UID == vm.ObjectMeta.UID {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			continue
+		}
+		if found == nil || onNode(pod) && !onNode(found) || onNode(pod) == onNode(found) && newer(pod, found) {
+			found = pod
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("Virtual Machine instance %s: %w", vm.ObjectMeta.Name, ErrLauncherPodNotFound)
+	}
+	return found, nil
+}
+
+// CheckLauncherPodFailure inspects the virt-launcher pod of the job's
+// Virtual Machine instance, and returns an error describing the first of
+// jctx.FatalReasons found in its conditions or container statuses.
+func CheckLauncherPodFailure(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	pod, err := FindLauncherPod(ctx, client, vm)
+	if errors.Is(err, ErrLauncherPodNotFound) {
+		return nil
+	}
+	if err != nil {
+		// Not being able to look at the pod shouldn't fail the job.
+		logger.Warn("finding launcher pod", "vmi", vm.ObjectMeta.Name, "err", err)
+		return nil
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status == k8sapi.ConditionFalse && isFatalReason(jctx, cond.Reason) {
+			return reasonError(cond.Reason, cond.Message)
+		}
+	}
+	statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting != nil && isFatalReason(jctx, status.State.Waiting.Reason) {
+			return reasonError(status.State.Waiting.Reason, status.State.Waiting.Message)
+		}
+	}
+	return nil
+}
+
+func checkConditionFailure(jctx *JobContext, conds []kubevirtapi.VirtualMachineInstanceCondition) error {
+	for _, cond := range conds {
+		if cond.Status == k8sapi.ConditionFalse && isFatalReason(jctx, cond.Reason) {
+			return reasonError(cond.Reason, cond.Message)
+		}
+	}
+	return nil
+}
+
+func isFatalReason(jctx *JobContext, reason string) bool {
+	for _, r := range jctx.FatalReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func reasonError(reason, message string) error {
+	if strings.Contains(reason, "Image") {
+		return fmt.Errorf("image pull failed: %s: %s", reason, message)
+	}
+	return fmt.Errorf("%s: %s", strings.ToLower(reason), message)
+}
+
+func describeConditions(vm *kubevirtapi.VirtualMachineInstance) string {
+	if len(vm.Status.Conditions) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("; conditions:")
+	for _, cond := range vm.Status.Conditions {
+		fmt.Fprintf(&sb, " %s=%s", cond.Type, cond.Status)
+		if cond.Reason != "" || cond.Message != "" {
+			fmt.Fprintf(&sb, " (%s: %s)", cond.Reason, cond.Message)
+		}
+		sb.WriteString(";")
+	}
+	return strings.TrimSuffix(sb.String(), ";")
+}
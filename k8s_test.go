@@ -0,0 +1,1628 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/golang/mock/gomock"
+	k8sapi "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	cdifake "kubevirt.io/client-go/generated/containerized-data-importer/clientset/versioned/fake"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// fakeCluster is a KubevirtClient whose Virtual Machine instances are
+// served by the generated mocks of kubecli, and whose core and CDI objects
+// live in fake clientsets.
+type fakeCluster struct {
+	*kubevirt.MockKubevirtClient
+	VMIs *kubevirt.MockVirtualMachineInstanceInterface
+	VMs  *kubevirt.MockVirtualMachineInterface
+	Core *fake.Clientset
+	CDI  *cdifake.Clientset
+}
+
+func newFakeCluster(t *testing.T, objects ...runtime.Object) *fakeCluster {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	c := &fakeCluster{
+		MockKubevirtClient: kubevirt.NewMockKubevirtClient(ctrl),
+		VMIs:               kubevirt.NewMockVirtualMachineInstanceInterface(ctrl),
+		VMs:                kubevirt.NewMockVirtualMachineInterface(ctrl),
+		Core:               fake.NewSimpleClientset(objects...),
+		CDI:                cdifake.NewSimpleClientset(),
+	}
+	c.EXPECT().VirtualMachineInstance(gomock.Any()).Return(c.VMIs).AnyTimes()
+	c.EXPECT().VirtualMachine(gomock.Any()).Return(c.VMs).AnyTimes()
+	c.EXPECT().CoreV1().Return(c.Core.CoreV1()).AnyTimes()
+	c.EXPECT().CdiClient().Return(c.CDI).AnyTimes()
+
+	// Like the apiserver, name the objects created with a generated name.
+	generated := 0
+	generateName := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := meta.Accessor(action.(k8stesting.CreateAction).GetObject())
+		if err == nil && obj.GetName() == "" && obj.GetGenerateName() != "" {
+			generated++
+			obj.SetName(fmt.Sprintf("%sgen%d", obj.GetGenerateName(), generated))
+		}
+		return false, nil, nil
+	}
+	c.Core.PrependReactor("create", "*", generateName)
+	c.CDI.PrependReactor("create", "*", generateName)
+	return c
+}
+
+// expectCreate makes the fake cluster accept the creation of one Virtual
+// Machine instance, naming it after its GenerateName, and returns the
+// instance as created.
+func (c *fakeCluster) expectCreate() *kubevirtapi.VirtualMachineInstance {
+	created := &kubevirtapi.VirtualMachineInstance{}
+	c.VMIs.EXPECT().Create(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, vm *kubevirtapi.VirtualMachineInstance) (*kubevirtapi.VirtualMachineInstance, error) {
+			vm.DeepCopyInto(created)
+			created.ObjectMeta.Name = vm.ObjectMeta.GenerateName + "x7k2p"
+			created.ObjectMeta.UID = types.UID("uid-" + created.ObjectMeta.Name)
+			created.ObjectMeta.Namespace = "ci"
+			return created.DeepCopy(), nil
+		})
+	return created
+}
+
+// testPrepareCmd returns the prepare command with the defaults of its
+// flags, as overridden by args.
+func testPrepareCmd(t *testing.T, args ...string) *PrepareCmd {
+	t.Helper()
+	var cli struct {
+		Prepare PrepareCmd `cmd:""`
+	}
+	parser, err := kong.New(&cli, kong.Exit(func(int) { t.Fatal("kong exited") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Parse(append([]string{"prepare"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return &cli.Prepare
+}
+
+// testJobContext returns the context of a job running the prepare command.
+func testJobContext(t *testing.T, cmd *PrepareCmd) *JobContext {
+	t.Helper()
+	jctx := &JobContext{
+		Namespace:   "ci",
+		BaseName:    "runner-1-project-2-concurrent-0-",
+		ID:          "0123456789abcdef",
+		LabelPrefix: labelPrefix,
+		Image:       "registry.example/ci/image:1",
+	}
+	if err := cmd.applyDefaults(jctx); err != nil {
+		t.Fatal(err)
+	}
+	return jctx
+}
+
+// createTestVM runs CreateJobVM against a fake cluster, and returns the
+// instance it created.
+func createTestVM(t *testing.T, c *fakeCluster, jctx *JobContext, rc *RunConfig) *kubevirtapi.VirtualMachineInstance {
+	t.Helper()
+	created := c.expectCreate()
+	if _, err := CreateJobVM(context.Background(), c, jctx, rc); err != nil {
+		t.Fatalf("CreateJobVM: %v", err)
+	}
+	return created
+}
+
+// createTestVMError runs CreateJobVM against a fake cluster, and checks
+// that it fails with an error containing want, without creating anything.
+func createTestVMError(t *testing.T, c *fakeCluster, jctx *JobContext, rc *RunConfig, want string) {
+	t.Helper()
+	if _, err := CreateJobVM(context.Background(), c, jctx, rc); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+// volumeSource returns the source of the named volume of the instance.
+func volumeSource(vm *kubevirtapi.VirtualMachineInstance, name string) *kubevirtapi.VolumeSource {
+	for _, vol := range vm.Spec.Volumes {
+		if vol.Name == name {
+			return &vol.VolumeSource
+		}
+	}
+	return nil
+}
+
+func TestCreateJobVMCloudInitSecret(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	jctx.CloudInitUserData = "#cloud-config\nssh_keys:\n  ecdsa_private: secret\n"
+	jctx.CloudInitNetworkData = "version: 2\n"
+	rc := cmd.RunConfig
+
+	vm := createTestVM(t, c, jctx, &rc)
+
+	source := volumeSource(vm, cloudInitDiskName)
+	if source == nil || source.CloudInitNoCloud == nil {
+		t.Fatalf("no cloud-init volume in %+v", vm.Spec.Volumes)
+	}
+	noCloud := source.CloudInitNoCloud
+	if noCloud.UserData != "" || noCloud.UserDataBase64 != "" || noCloud.NetworkData != "" || noCloud.NetworkDataBase64 != "" {
+		t.Errorf("cloud-init data is inline in the spec: %+v", noCloud)
+	}
+	if noCloud.UserDataSecretRef == nil || noCloud.NetworkDataSecretRef == nil {
+		t.Fatalf("cloud-init volume does not reference a secret: %+v", noCloud)
+	}
+	if noCloud.UserDataSecretRef.Name == "" || noCloud.NetworkDataSecretRef.Name != noCloud.UserDataSecretRef.Name {
+		t.Errorf("cloud-init volume references secrets %q and %q", noCloud.UserDataSecretRef.Name, noCloud.NetworkDataSecretRef.Name)
+	}
+
+	secret, err := c.Core.CoreV1().Secrets("ci").Get(context.Background(), noCloud.UserDataSecretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := secret.StringData[cloudInitUserDataKey]; got != jctx.CloudInitUserData {
+		t.Errorf("secret user-data = %q, want %q", got, jctx.CloudInitUserData)
+	}
+	if got := secret.StringData[cloudInitNetworkDataKey]; got != jctx.CloudInitNetworkData {
+		t.Errorf("secret network-config = %q, want %q", got, jctx.CloudInitNetworkData)
+	}
+	owners := secret.ObjectMeta.OwnerReferences
+	if len(owners) != 1 || owners[0].UID != vm.ObjectMeta.UID {
+		t.Errorf("secret owners = %+v, want the instance %s", owners, vm.ObjectMeta.UID)
+	}
+}
+
+func TestCreateJobVMWithoutCloudInit(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+
+	vm := createTestVM(t, c, jctx, &rc)
+	if source := volumeSource(vm, cloudInitDiskName); source != nil {
+		t.Errorf("unexpected cloud-init volume %+v", source)
+	}
+	secrets, err := c.Core.CoreV1().Secrets("ci").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Errorf("%d secrets created", len(secrets.Items))
+	}
+}
+
+func TestParseToleration(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    k8sapi.Toleration
+		wantErr string
+	}{
+		{spec: "*", want: k8sapi.Toleration{Operator: k8sapi.TolerationOpExists}},
+		{spec: "ci", want: k8sapi.Toleration{Key: "ci", Operator: k8sapi.TolerationOpExists}},
+		{spec: "ci:NoSchedule", want: k8sapi.Toleration{Key: "ci", Operator: k8sapi.TolerationOpExists, Effect: k8sapi.TaintEffectNoSchedule}},
+		{spec: "example.com/ci=true:NoExecute", want: k8sapi.Toleration{Key: "example.com/ci", Operator: k8sapi.TolerationOpEqual, Value: "true", Effect: k8sapi.TaintEffectNoExecute}},
+		{spec: "ci=", want: k8sapi.Toleration{Key: "ci", Operator: k8sapi.TolerationOpEqual}},
+		{spec: "", wantErr: "missing key"},
+		{spec: ":NoSchedule", wantErr: "missing key"},
+		{spec: "*:NoSchedule", wantErr: "invalid toleration"},
+		{spec: "=true", wantErr: "a value requires a key"},
+		{spec: "ci:Sometimes", wantErr: "unknown effect"},
+	}
+	for _, tt := range tests {
+		got, err := ParseToleration(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseToleration(%q) = %+v, %v, want %q", tt.spec, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseToleration(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseToleration(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// disk returns the named disk of the instance.
+func disk(vm *kubevirtapi.VirtualMachineInstance, name string) *kubevirtapi.Disk {
+	for i := range vm.Spec.Domain.Devices.Disks {
+		if d := &vm.Spec.Domain.Devices.Disks[i]; d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func TestCreateJobVMRootCache(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want kubevirtapi.DriverCache
+	}{
+		{name: "default", want: ""},
+		{name: "writeback", args: []string{"--default-root-cache=writeback"}, want: kubevirtapi.CacheWriteBack},
+		{name: "none", args: []string{"--default-root-cache=none"}, want: kubevirtapi.CacheNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+			vm := createTestVM(t, newFakeCluster(t), jctx, &rc)
+			root := disk(vm, containerDiskName)
+			if root == nil {
+				t.Fatalf("no root disk in %+v", vm.Spec.Domain.Devices.Disks)
+			}
+			if root.Cache != tt.want {
+				t.Errorf("root disk cache = %q, want %q", root.Cache, tt.want)
+			}
+		})
+	}
+
+	cmd := testPrepareCmd(t, "--default-root-cache=unsafe")
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+	if _, err := CreateJobVM(context.Background(), newFakeCluster(t), jctx, &rc); err == nil || !strings.Contains(err.Error(), "unknown cache mode") {
+		t.Errorf("CreateJobVM with an unknown cache mode: err = %v", err)
+	}
+}
+
+func TestCreateJobVMRequestMultiplier(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantCPU     *kubevirtapi.CPU
+		wantLimits  k8sapi.ResourceList
+		wantGuest   string
+		wantRequest k8sapi.ResourceList
+	}{
+		{
+			name: "with limits",
+			args: []string{"--default-cpu-request=2", "--default-cpu-limit=2", "--default-memory-request=4Gi", "--default-memory-limit=4Gi"},
+			wantRequest: k8sapi.ResourceList{
+				k8sapi.ResourceCPU:    resource.MustParse("1"),
+				k8sapi.ResourceMemory: resource.MustParse("2Gi"),
+			},
+			wantLimits: k8sapi.ResourceList{
+				k8sapi.ResourceCPU:    resource.MustParse("2"),
+				k8sapi.ResourceMemory: resource.MustParse("4Gi"),
+			},
+			wantGuest: "4Gi",
+		},
+		{
+			name: "without a CPU limit",
+			args: []string{"--allow-overcommit", "--default-cpu-request=1500m", "--default-memory-request=4Gi"},
+			wantRequest: k8sapi.ResourceList{
+				k8sapi.ResourceCPU:    resource.MustParse("750m"),
+				k8sapi.ResourceMemory: resource.MustParse("2Gi"),
+			},
+			wantCPU:   &kubevirtapi.CPU{Sockets: 2},
+			wantGuest: "4Gi",
+		},
+		{
+			name: "with a topology",
+			args: []string{"--allow-overcommit", "--default-cpu-request=4", "--default-cpu-cores=4", "--default-memory-request=4Gi"},
+			wantRequest: k8sapi.ResourceList{
+				k8sapi.ResourceCPU:    resource.MustParse("2"),
+				k8sapi.ResourceMemory: resource.MustParse("2Gi"),
+			},
+			wantCPU:   &kubevirtapi.CPU{Cores: 4},
+			wantGuest: "4Gi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, append(tt.args, "--request-multiplier=0.5")...)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+			vm := createTestVM(t, newFakeCluster(t), jctx, &rc)
+
+			domain := vm.Spec.Domain
+			for name, want := range tt.wantRequest {
+				if got := domain.Resources.Requests[name]; got.Cmp(want) != 0 {
+					t.Errorf("%s request = %s, want %s", name, got.String(), want.String())
+				}
+			}
+			if len(domain.Resources.Limits) != len(tt.wantLimits) {
+				t.Errorf("limits = %v, want %v", domain.Resources.Limits, tt.wantLimits)
+			}
+			for name, want := range tt.wantLimits {
+				if got := domain.Resources.Limits[name]; got.Cmp(want) != 0 {
+					t.Errorf("%s limit = %s, want %s", name, got.String(), want.String())
+				}
+			}
+			if tt.wantCPU == nil {
+				if domain.CPU != nil {
+					t.Errorf("CPU = %+v, want none", domain.CPU)
+				}
+			} else if !reflect.DeepEqual(domain.CPU, tt.wantCPU) {
+				t.Errorf("CPU = %+v, want %+v", domain.CPU, tt.wantCPU)
+			}
+			if domain.Memory == nil || domain.Memory.Guest == nil || domain.Memory.Guest.Cmp(resource.MustParse(tt.wantGuest)) != 0 {
+				t.Errorf("guest memory = %+v, want %s", domain.Memory, tt.wantGuest)
+			}
+		})
+	}
+}
+
+func TestFindJobVMPages(t *testing.T) {
+	instance := func(name string) kubevirtapi.VirtualMachineInstance {
+		return kubevirtapi.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	expired := apierrors.NewResourceExpired("continue token expired")
+
+	type page struct {
+		items []kubevirtapi.VirtualMachineInstance
+		next  string
+		err   error
+	}
+	tests := []struct {
+		name         string
+		pages        []page
+		wantName     string
+		wantErr      string
+		wantContinue []string
+	}{
+		{
+			name:         "on a later page",
+			pages:        []page{{next: "t1"}, {next: "t2"}, {items: []kubevirtapi.VirtualMachineInstance{instance("vm")}}},
+			wantName:     "vm",
+			wantContinue: []string{"", "t1", "t2"},
+		},
+		{
+			name:         "expired continue token",
+			pages:        []page{{next: "t1"}, {err: expired}, {next: "t2"}, {items: []kubevirtapi.VirtualMachineInstance{instance("vm")}}},
+			wantName:     "vm",
+			wantContinue: []string{"", "t1", "", "t2"},
+		},
+		{
+			name:         "on several pages",
+			pages:        []page{{items: []kubevirtapi.VirtualMachineInstance{instance("a")}, next: "t1"}, {items: []kubevirtapi.VirtualMachineInstance{instance("b")}}},
+			wantErr:      "ambiguous ID",
+			wantContinue: []string{"", "t1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.APIRetries = 3
+			jctx.APIRetryMaxInterval = time.Millisecond
+
+			var continues []string
+			c.VMIs.EXPECT().List(gomock.Any(), gomock.Any()).Times(len(tt.pages)).DoAndReturn(
+				func(_ context.Context, opts *metav1.ListOptions) (*kubevirtapi.VirtualMachineInstanceList, error) {
+					p := tt.pages[len(continues)]
+					continues = append(continues, opts.Continue)
+					if p.err != nil {
+						return nil, p.err
+					}
+					list := &kubevirtapi.VirtualMachineInstanceList{Items: p.items}
+					list.Continue = p.next
+					return list, nil
+				})
+
+			vm, err := FindJobVM(context.Background(), c, jctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if vm.ObjectMeta.Name != tt.wantName {
+				t.Errorf("found %s, want %s", vm.ObjectMeta.Name, tt.wantName)
+			}
+			if !reflect.DeepEqual(continues, tt.wantContinue) {
+				t.Errorf("listed with continue tokens %q, want %q", continues, tt.wantContinue)
+			}
+		})
+	}
+}
+
+func TestFindJobVMNotListedYet(t *testing.T) {
+	tests := []struct {
+		name        string
+		findTimeout time.Duration
+		wantFound   bool
+	}{
+		{name: "listed within the find timeout", findTimeout: 5 * time.Second, wantFound: true},
+		{name: "without a find timeout", findTimeout: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.FindTimeout = tt.findTimeout
+
+			listed := 0
+			c.VMIs.EXPECT().List(gomock.Any(), gomock.Any()).MaxTimes(2).DoAndReturn(
+				func(context.Context, *metav1.ListOptions) (*kubevirtapi.VirtualMachineInstanceList, error) {
+					list := &kubevirtapi.VirtualMachineInstanceList{}
+					if listed++; listed > 1 {
+						list.Items = []kubevirtapi.VirtualMachineInstance{{ObjectMeta: metav1.ObjectMeta{Name: "vm"}}}
+					}
+					return list, nil
+				})
+			c.VMs.EXPECT().List(gomock.Any()).Return(&kubevirtapi.VirtualMachineList{}, nil)
+
+			vm, err := FindJobVM(context.Background(), c, jctx)
+			if !tt.wantFound {
+				if !errors.Is(err, ErrJobVMNotFound) {
+					t.Errorf("err = %v, want %v", err, ErrJobVMNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vm.ObjectMeta.Name != "vm" {
+				t.Errorf("found %s, want vm", vm.ObjectMeta.Name)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		image   string
+		want    k8sapi.PullPolicy
+		wantErr string
+	}{
+		{name: "Always", policy: "Always", image: "registry.example/ci/image:1", want: k8sapi.PullAlways},
+		{name: "IfNotPresent", policy: "IfNotPresent", image: "registry.example/ci/image:latest", want: k8sapi.PullIfNotPresent},
+		{name: "Never", policy: "Never", image: "registry.example/ci/image:1", want: k8sapi.PullNever},
+		{name: "default for a tag", image: "registry.example/ci/image:1", want: k8sapi.PullIfNotPresent},
+		{name: "default for latest", image: "registry.example/ci/image:latest", want: k8sapi.PullAlways},
+		{name: "default without a tag", image: "registry.example/ci/image", want: k8sapi.PullAlways},
+		{name: "invalid", policy: "Sometimes", image: "registry.example/ci/image:1", wantErr: "invalid image pull policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.policy != "" {
+				args = append(args, "--default-image-pull-policy="+tt.policy)
+			}
+			cmd := testPrepareCmd(t, args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.Image = tt.image
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				if _, err := CreateJobVM(context.Background(), c, jctx, &rc); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			source := volumeSource(vm, containerDiskName)
+			if source == nil || source.ContainerDisk == nil {
+				t.Fatalf("no containerdisk volume in %+v", vm.Spec.Volumes)
+			}
+			if got := source.ContainerDisk.ImagePullPolicy; got != tt.want {
+				t.Errorf("pull policy = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMScratchDisk(t *testing.T) {
+	cmd := testPrepareCmd(t, "--default-scratch-disk=name=scratch,size=10Gi,fs=ext4,mount=/scratch")
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+
+	vm := createTestVM(t, c, jctx, &rc)
+	source := volumeSource(vm, "scratch")
+	if source == nil || source.EmptyDisk == nil {
+		t.Fatalf("no scratch emptyDisk in %+v", vm.Spec.Volumes)
+	}
+	if want := resource.MustParse("10Gi"); source.EmptyDisk.Capacity.Cmp(want) != 0 {
+		t.Errorf("scratch disk capacity = %s, want %s", source.EmptyDisk.Capacity.String(), want.String())
+	}
+	d := disk(vm, "scratch")
+	if d == nil || d.Disk == nil {
+		t.Fatalf("no scratch disk in %+v", vm.Spec.Domain.Devices.Disks)
+	}
+	// The guest finds the disk to format by its serial.
+	if d.Serial != "scratch" || d.Disk.Bus != kubevirtapi.DiskBusVirtio {
+		t.Errorf("scratch disk has serial %q on bus %q, want scratch on virtio", d.Serial, d.Disk.Bus)
+	}
+
+	cmd = testPrepareCmd(t, "--default-scratch-disk=name=scratch,size=1Gi", "--default-scratch-disk=name=scratch,size=2Gi")
+	jctx = testJobContext(t, cmd)
+	if _, err := CreateJobVM(context.Background(), newFakeCluster(t), jctx, &rc); err == nil {
+		t.Error("CreateJobVM accepted two disks with the same name")
+	}
+}
+
+func TestCreateJobVMCloudInitVolume(t *testing.T) {
+	tests := []struct {
+		name              string
+		userData, network string
+	}{
+		{"user-data", "#cloud-config\n", ""},
+		{"network-config", "", "version: 2\n"},
+		{"both", "#cloud-config\n", "version: 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.CloudInitUserData = tt.userData
+			jctx.CloudInitNetworkData = tt.network
+			rc := cmd.RunConfig
+
+			vm := createTestVM(t, c, jctx, &rc)
+
+			// cloud-init only reads a single NoCloud datasource, so user-data
+			// and network-config have to share one volume.
+			var volumes []kubevirtapi.Volume
+			for _, volume := range vm.Spec.Volumes {
+				if volume.CloudInitNoCloud != nil || volume.CloudInitConfigDrive != nil {
+					volumes = append(volumes, volume)
+				}
+			}
+			if len(volumes) != 1 || volumes[0].Name != cloudInitDiskName {
+				t.Fatalf("cloud-init volumes = %+v, want one named %s", volumes, cloudInitDiskName)
+			}
+			if d := disk(vm, cloudInitDiskName); d == nil || d.Disk == nil {
+				t.Errorf("cloud-init volume is not attached as a disk: %+v", d)
+			}
+
+			noCloud := volumes[0].CloudInitNoCloud
+			if noCloud.UserDataSecretRef == nil {
+				t.Fatalf("cloud-init volume does not reference a secret: %+v", noCloud)
+			}
+			switch {
+			case tt.network == "" && noCloud.NetworkDataSecretRef != nil:
+				t.Errorf("cloud-init volume references network-config %+v", noCloud.NetworkDataSecretRef)
+			case tt.network != "" && (noCloud.NetworkDataSecretRef == nil || noCloud.NetworkDataSecretRef.Name != noCloud.UserDataSecretRef.Name):
+				t.Errorf("network-config is not in the user-data secret: %+v", noCloud)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMHostname(t *testing.T) {
+	tests := []struct {
+		name                string
+		hostname, subdomain string
+		wantErr             string
+	}{
+		{name: "default"},
+		{name: "hostname", hostname: "build-1"},
+		{name: "hostname and subdomain", hostname: "build-1", subdomain: "ci-builds"},
+		{name: "subdomain only", subdomain: "ci-builds"},
+		{name: "underscore", hostname: "Build_1", wantErr: `invalid hostname "Build_1"`},
+		{name: "dotted hostname", hostname: "build.example", wantErr: `invalid hostname "build.example"`},
+		{name: "invalid subdomain", hostname: "build-1", subdomain: "-ci", wantErr: `invalid subdomain "-ci"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.hostname != "" {
+				args = append(args, "--default-hostname="+tt.hostname)
+			}
+			if tt.subdomain != "" {
+				args = append(args, "--default-subdomain="+tt.subdomain)
+			}
+			cmd := testPrepareCmd(t, args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				if _, err := CreateJobVM(context.Background(), c, jctx, &rc); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			if vm.Spec.Hostname != tt.hostname || vm.Spec.Subdomain != tt.subdomain {
+				t.Errorf("hostname %q, subdomain %q, want %q, %q", vm.Spec.Hostname, vm.Spec.Subdomain, tt.hostname, tt.subdomain)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMGuestMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "default"},
+		{name: "below the limit", args: []string{"--default-guest-memory=768Mi"}, want: "768Mi"},
+		{name: "at the limit", args: []string{"--default-guest-memory=1Gi"}, want: "1Gi"},
+		{name: "above the limit", args: []string{"--default-guest-memory=1025Mi"}, wantErr: "exceeds the memory limit 1Gi"},
+		{name: "without a limit", args: []string{"--allow-overcommit", "--default-guest-memory=4Gi"}, want: "4Gi"},
+		{name: "scaled requests", args: []string{"--request-multiplier=0.5", "--default-guest-memory=768Mi"}, want: "768Mi"},
+		{name: "hugepages", args: []string{"--default-hugepages-page-size=2Mi", "--default-guest-memory=768Mi"}, want: "768Mi"},
+		{name: "not a multiple of hugepages", args: []string{"--default-hugepages-page-size=1Gi", "--default-guest-memory=768Mi"}, wantErr: "not a multiple of the hugepages page size"},
+		{name: "zero", args: []string{"--default-guest-memory=0"}, wantErr: "must be positive"},
+		{name: "garbage", args: []string{"--default-guest-memory=lots"}, wantErr: "parsing guest memory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				if _, err := CreateJobVM(context.Background(), c, jctx, &rc); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			memory := vm.Spec.Domain.Memory
+			if tt.want == "" {
+				if memory != nil && memory.Guest != nil {
+					t.Errorf("guest memory = %s, want none", memory.Guest.String())
+				}
+				return
+			}
+			if memory == nil || memory.Guest == nil {
+				t.Fatalf("no guest memory, want %s", tt.want)
+			}
+			if want := resource.MustParse(tt.want); memory.Guest.Cmp(want) != 0 {
+				t.Errorf("guest memory = %s, want %s", memory.Guest.String(), tt.want)
+			}
+			if limit, ok := vm.Spec.Domain.Resources.Limits[k8sapi.ResourceMemory]; ok && memory.Guest.Cmp(limit) > 0 {
+				t.Errorf("guest memory %s exceeds the memory limit %s", memory.Guest.String(), limit.String())
+			}
+		})
+	}
+}
+
+func TestCreateJobVMDataVolumeOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		patchErr error
+	}{
+		{name: "owned"},
+		{name: "patch fails", patchErr: apierrors.NewServiceUnavailable("try again")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--default-data-volume-image=registry.example/os/ubuntu:22.04", "--default-data-volume-size=20Gi")
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.Image = ""
+			jctx.CloudInitUserData = "#cloud-config\n"
+			rc := cmd.RunConfig
+
+			// CDI reconciles the data volume as soon as it exists, so the
+			// copy returned on creation goes stale before the owner is set.
+			c.CDI.PrependReactor("update", "datavolumes", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "datavolumes"}, "", errors.New("object was modified"))
+			})
+			if tt.patchErr != nil {
+				c.CDI.PrependReactor("patch", "datavolumes", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.patchErr
+				})
+				c.VMIs.EXPECT().Delete(gomock.Any(), jctx.BaseName+"x7k2p", gomock.Any()).Return(nil)
+			}
+			created := c.expectCreate()
+
+			_, err := CreateJobVM(context.Background(), c, jctx, &rc)
+			dvs, listErr := c.CDI.CdiV1beta1().DataVolumes("ci").List(context.Background(), metav1.ListOptions{})
+			if listErr != nil {
+				t.Fatal(listErr)
+			}
+			secrets, listErr := c.Core.CoreV1().Secrets("ci").List(context.Background(), metav1.ListOptions{})
+			if listErr != nil {
+				t.Fatal(listErr)
+			}
+
+			if tt.patchErr != nil {
+				if !errors.Is(err, tt.patchErr) {
+					t.Errorf("err = %v, want %v", err, tt.patchErr)
+				}
+				if len(dvs.Items) != 0 || len(secrets.Items) != 0 {
+					t.Errorf("%d data volumes and %d secrets left behind", len(dvs.Items), len(secrets.Items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dvs.Items) != 1 {
+				t.Fatalf("%d data volumes, want 1", len(dvs.Items))
+			}
+			for _, owners := range [][]metav1.OwnerReference{dvs.Items[0].ObjectMeta.OwnerReferences, secrets.Items[0].ObjectMeta.OwnerReferences} {
+				if len(owners) != 1 || owners[0].UID != created.ObjectMeta.UID {
+					t.Errorf("owners = %+v, want the instance %s", owners, created.ObjectMeta.UID)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobVMMemBalloon(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		name           string
+		args           []string
+		wantBalloon    *bool
+		wantAnnotation string
+		wantErr        string
+	}{
+		{name: "default"},
+		{name: "balloon", args: []string{"--default-memory-balloon"}, wantBalloon: &enabled, wantAnnotation: "true"},
+		{name: "balloon and free page reporting", args: []string{"--default-memory-balloon", "--default-free-page-reporting"}, wantBalloon: &enabled},
+		{name: "free page reporting alone", args: []string{"--default-free-page-reporting"}, wantErr: "requires the memory balloon device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				if _, err := CreateJobVM(context.Background(), c, jctx, &rc); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			got := vm.Spec.Domain.Devices.AutoattachMemBalloon
+			if (got == nil) != (tt.wantBalloon == nil) || (got != nil && *got != *tt.wantBalloon) {
+				t.Errorf("autoattachMemBalloon = %v, want %v", got, tt.wantBalloon)
+			}
+			annotation, ok := vm.ObjectMeta.Annotations[freePageReportingDisabledKey]
+			if annotation != tt.wantAnnotation || ok != (tt.wantAnnotation != "") {
+				t.Errorf("%s annotation = %q, want %q", freePageReportingDisabledKey, annotation, tt.wantAnnotation)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMWatchdog(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    kubevirtapi.WatchdogAction
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "reset", args: []string{"--default-watchdog=reset"}, want: kubevirtapi.WatchdogActionReset},
+		{name: "poweroff", args: []string{"--default-watchdog=poweroff"}, want: kubevirtapi.WatchdogActionPoweroff},
+		{name: "invalid", args: []string{"--default-watchdog=reboot"}, wantErr: `unknown watchdog action "reboot"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			watchdog := createTestVM(t, c, jctx, &rc).Spec.Domain.Devices.Watchdog
+			if tt.want == "" {
+				if watchdog != nil {
+					t.Errorf("unexpected watchdog %+v", watchdog)
+				}
+				return
+			}
+			if watchdog == nil || watchdog.I6300ESB == nil || watchdog.I6300ESB.Action != tt.want {
+				t.Errorf("watchdog = %+v, want an i6300esb with the action %s", watchdog, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMRng(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "default", want: true},
+		{name: "enabled", args: []string{"--default-rng"}, want: true},
+		{name: "disabled", args: []string{"--no-default-rng"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if rng := createTestVM(t, c, jctx, &rc).Spec.Domain.Devices.Rng; (rng != nil) != tt.want {
+				t.Errorf("rng = %+v, want one: %v", rng, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMTPM(t *testing.T) {
+	devices := func(t *testing.T, args ...string) kubevirtapi.Devices {
+		t.Helper()
+		cmd := testPrepareCmd(t, args...)
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+		return createTestVM(t, c, jctx, &rc).Spec.Domain.Devices
+	}
+
+	without := devices(t)
+	if without.TPM != nil {
+		t.Errorf("unexpected TPM %+v", without.TPM)
+	}
+	with := devices(t, "--default-tpm")
+	if with.TPM == nil {
+		t.Fatal("no TPM with --default-tpm")
+	}
+	with.TPM = nil
+	if !reflect.DeepEqual(with, without) {
+		t.Errorf("devices besides the TPM changed:\n%+v\nwant:\n%+v", with, without)
+	}
+}
+
+func TestCreateJobVMBootOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		root      uint
+		extra     string
+		wantRoot  uint
+		wantExtra uint
+		wantErr   string
+	}{
+		{name: "none", extra: "name=cache,claim=cache"},
+		{name: "root first", root: 1, extra: "name=cache,claim=cache,boot=2", wantRoot: 1, wantExtra: 2},
+		{name: "extra first", root: 2, extra: "name=cache,claim=cache,boot=1", wantRoot: 2, wantExtra: 1},
+		{name: "extra only", extra: "name=cache,claim=cache,boot=1", wantExtra: 1},
+		{name: "duplicate", root: 1, extra: "name=cache,claim=cache,boot=1", wantErr: "disks containervolume and cache have the same boot order 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, fmt.Sprintf("--default-root-boot-order=%d", tt.root))
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			vol, err := ParseExtraVolume(tt.extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jctx.ExtraVolumes = []ExtraVolume{vol}
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			for _, d := range []struct {
+				name string
+				want uint
+			}{{containerDiskName, tt.wantRoot}, {"cache", tt.wantExtra}} {
+				got := disk(vm, d.name)
+				if got == nil {
+					t.Fatalf("no disk %s", d.name)
+				}
+				switch {
+				case d.want == 0 && got.BootOrder != nil:
+					t.Errorf("disk %s has the boot order %d, want none", d.name, *got.BootOrder)
+				case d.want != 0 && (got.BootOrder == nil || *got.BootOrder != d.want):
+					t.Errorf("disk %s has the boot order %v, want %d", d.name, got.BootOrder, d.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobVMBlockVolume(t *testing.T) {
+	block := k8sapi.PersistentVolumeBlock
+	claims := []runtime.Object{
+		&k8sapi.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "ceph", Namespace: "ci"},
+			Spec:       k8sapi.PersistentVolumeClaimSpec{VolumeMode: &block},
+		},
+		&k8sapi.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "files", Namespace: "ci"}},
+	}
+
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{spec: "name=ceph,claim=ceph,mode=block"},
+		{spec: "name=ceph,claim=ceph"},
+		{spec: "name=files,claim=files,mode=filesystem"},
+		{spec: "name=files,claim=files,mode=block", wantErr: "claim files has volume mode Filesystem, not Block"},
+		{spec: "name=ceph,claim=ceph,mode=filesystem", wantErr: "claim ceph has volume mode Block, not Filesystem"},
+		{spec: "name=missing,claim=missing,mode=block", wantErr: "checking volume mode of claim missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t, claims...)
+			jctx := testJobContext(t, cmd)
+			vol, err := ParseExtraVolume(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jctx.ExtraVolumes = []ExtraVolume{vol}
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			if d := disk(vm, vol.Name); d == nil || d.Disk == nil {
+				t.Errorf("volume %s is not attached as a disk: %+v", vol.Name, d)
+			}
+			source := volumeSource(vm, vol.Name)
+			if source == nil || source.PersistentVolumeClaim == nil || source.PersistentVolumeClaim.ClaimName != vol.ClaimName {
+				t.Errorf("volume %s = %+v, want the claim %s", vol.Name, source, vol.ClaimName)
+			}
+			if fs := vm.Spec.Domain.Devices.Filesystems; len(fs) != 0 {
+				t.Errorf("unexpected filesystems %+v", fs)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMDiskBus(t *testing.T) {
+	tests := []struct {
+		name              string
+		root, extra       string
+		wantRoot, wantExt kubevirtapi.DiskBus
+		wantErr           string
+	}{
+		{name: "defaults", wantRoot: kubevirtapi.DiskBusVirtio, wantExt: kubevirtapi.DiskBusVirtio},
+		{name: "sata root", root: "sata", wantRoot: kubevirtapi.DiskBusSATA, wantExt: kubevirtapi.DiskBusVirtio},
+		{name: "scsi extra", extra: "scsi", wantRoot: kubevirtapi.DiskBusVirtio, wantExt: kubevirtapi.DiskBusSCSI},
+		{name: "unknown root bus", root: "ide", wantErr: `root disk: unknown disk bus "ide"`},
+		{name: "unknown extra bus", extra: "nvme", wantErr: `extra volume cache: unknown disk bus "nvme"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.root != "" {
+				args = append(args, "--default-root-bus="+tt.root)
+			}
+			cmd := testPrepareCmd(t, args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			spec := "name=cache,claim=cache"
+			if tt.extra != "" {
+				spec += ",bus=" + tt.extra
+			}
+			vol, err := ParseExtraVolume(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jctx.ExtraVolumes = []ExtraVolume{vol}
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			for _, d := range []struct {
+				name string
+				want kubevirtapi.DiskBus
+			}{{containerDiskName, tt.wantRoot}, {"cache", tt.wantExt}} {
+				if got := disk(vm, d.name); got == nil || got.Disk == nil || got.Disk.Bus != d.want {
+					t.Errorf("disk %s = %+v, want the bus %s", d.name, got, d.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobVMImagePullSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "empty", args: []string{"--default-image-pull-secret="}},
+		{name: "one", args: []string{"--default-image-pull-secret=registry-creds"}, want: "registry-creds"},
+		{name: "blank entries", args: []string{"--default-image-pull-secret= ,registry-creds"}, want: "registry-creds"},
+		{name: "several", args: []string{"--default-image-pull-secret=a,b"}, wantErr: "single image pull secret, got a, b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			source := volumeSource(createTestVM(t, c, jctx, &rc), containerDiskName)
+			if source == nil || source.ContainerDisk == nil {
+				t.Fatal("no containerdisk volume")
+			}
+			if got := source.ContainerDisk.ImagePullSecret; got != tt.want {
+				t.Errorf("image pull secret = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMEvictionStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		wantErr  string
+	}{
+		{strategy: ""},
+		{strategy: "None"},
+		{strategy: "LiveMigrate"},
+		{strategy: "External"},
+		{strategy: "livemigrate", wantErr: `unknown eviction strategy "livemigrate"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--default-eviction-strategy="+tt.strategy)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			got := createTestVM(t, c, jctx, &rc).Spec.EvictionStrategy
+			switch {
+			case tt.strategy == "" && got != nil:
+				t.Errorf("eviction strategy = %q, want the cluster default", *got)
+			case tt.strategy != "" && (got == nil || string(*got) != tt.strategy):
+				t.Errorf("eviction strategy = %v, want %q", got, tt.strategy)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMPriorityClass(t *testing.T) {
+	tests := []struct {
+		name    string
+		class   string
+		wantErr string
+	}{
+		{name: "cluster default"},
+		{name: "preemptible", class: "ci-preemptible"},
+		{name: "invalid", class: "CI_Preemptible", wantErr: `invalid priority class name "CI_Preemptible"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--default-priority-class="+tt.class)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			if got := createTestVM(t, c, jctx, &rc).Spec.PriorityClassName; got != tt.class {
+				t.Errorf("priority class = %q, want %q", got, tt.class)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMSchedulerName(t *testing.T) {
+	for _, scheduler := range []string{"", "numa-scheduler"} {
+		t.Run(scheduler, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--default-scheduler-name="+scheduler)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			vm := createTestVM(t, c, jctx, &rc)
+			if got := vm.Spec.SchedulerName; got != scheduler {
+				t.Errorf("scheduler name = %q, want %q", got, scheduler)
+			}
+			if vm.Spec.NodeSelector[k8sapi.LabelArchStable] != "amd64" || len(vm.Spec.Tolerations) != 0 {
+				t.Errorf("scheduler name changed the placement: node selector %v, tolerations %+v", vm.Spec.NodeSelector, vm.Spec.Tolerations)
+			}
+		})
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	got := mergeMetadata("label", map[string]string{
+		labelPrefix + "/id": "forged",
+		"team":              "ci",
+	}, map[string]string{
+		labelPrefix + "/id": "0123456789abcdef",
+	})
+	want := map[string]string{labelPrefix + "/id": "0123456789abcdef", "team": "ci"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged = %v, want %v", got, want)
+	}
+}
+
+func TestCreateJobVMLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "user labels", labels: "team=ci,example.com/cost-center=42", want: map[string]string{"team": "ci", "example.com/cost-center": "42"}},
+		{name: "reserved id", labels: labelPrefix + "/id=forged,team=ci", want: map[string]string{labelPrefix + "/id": "0123456789abcdef", "team": "ci"}},
+		{name: "invalid key", labels: "bad key=ci", wantErr: `invalid labels: key "bad key"`},
+		{name: "invalid value", labels: "team=c i", wantErr: `invalid labels: value "c i" of "team"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, "--labels="+tt.labels)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			labels := createTestVM(t, c, jctx, &rc).ObjectMeta.Labels
+			for k, v := range tt.want {
+				if labels[k] != v {
+					t.Errorf("label %s = %q, want %q", k, labels[k], v)
+				}
+			}
+		})
+	}
+
+	// Entries without a value are rejected as soon as they are parsed.
+	var cli struct {
+		Prepare PrepareCmd `cmd:""`
+	}
+	parser, err := kong.New(&cli, kong.Exit(func(int) { t.Fatal("kong exited") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Parse([]string{"prepare", "--labels=team"}); err == nil {
+		t.Error("parsed --labels=team")
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1234", "1234"},
+		{"main", "main"},
+		{"feature/login form", "feature-login-form"},
+		{"v1.2_rc", "v1.2_rc"},
+		{"-leading and trailing.", "leading-and-trailing"},
+		{"__x__", "x"},
+		{"ünïcode", "n--code"},
+		{strings.Repeat("a", 70), strings.Repeat("a", 63)},
+		{strings.Repeat("a", 62) + "/b", strings.Repeat("a", 62)},
+		{"///", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := sanitizeLabelValue(tt.in)
+		if got != tt.want {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if msgs := validation.IsValidLabelValue(got); len(msgs) > 0 {
+			t.Errorf("sanitizeLabelValue(%q) = %q, which is invalid: %v", tt.in, got, msgs)
+		}
+	}
+}
+
+func TestSanitizeBaseName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"runner-1-project-2-concurrent-0", "runner-1-project-2-concurrent-0"},
+		{"Runner-AbC-Project-2", "runner-abc-project-2"},
+		{"runner_1.project 2/x", "runner-1-project-2-x"},
+		{"--runner--", "runner"},
+		{"warm-ünïcode", "warm---n--code"},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxBaseNameLength)},
+		{strings.Repeat("a", maxBaseNameLength-1) + "_b", strings.Repeat("a", maxBaseNameLength-1)},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeBaseName(tt.in)
+		if err != nil {
+			t.Errorf("sanitizeBaseName(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeBaseName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		// The random suffix of generated names must keep them valid.
+		if msgs := validation.IsDNS1123Label(got + "x7k2p"); len(msgs) > 0 {
+			t.Errorf("sanitizeBaseName(%q) = %q, which makes invalid names: %v", tt.in, got, msgs)
+		}
+	}
+
+	for _, in := range []string{"", "---", "___", "ü"} {
+		if got, err := sanitizeBaseName(in); err == nil {
+			t.Errorf("sanitizeBaseName(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestSelectorLabelPrefix(t *testing.T) {
+	for _, prefix := range []string{labelPrefix, "ci.example.com"} {
+		t.Run(prefix, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.LabelPrefix = prefix
+			rc := cmd.RunConfig
+
+			vm := createTestVM(t, c, jctx, &rc)
+			selector, err := labels.Parse(Selector(jctx).LabelSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !selector.Matches(labels.Set(vm.ObjectMeta.Labels)) {
+				t.Errorf("selector %s does not match the labels %v", selector, vm.ObjectMeta.Labels)
+			}
+			if err := CreateJobSSHKeySecret(context.Background(), c, jctx, vm, []byte("key")); err != nil {
+				t.Fatal(err)
+			}
+			if key, err := FindJobSSHKey(context.Background(), c, jctx); err != nil || string(key) != "key" {
+				t.Errorf("FindJobSSHKey = %q, %v, want the key stored on creation", key, err)
+			}
+			for k := range vm.ObjectMeta.Labels {
+				if prefix != labelPrefix && strings.HasPrefix(k, labelPrefix+"/") {
+					t.Errorf("label %s is not under the prefix %s", k, prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobVMIOThreads(t *testing.T) {
+	shared, auto := kubevirtapi.IOThreadsPolicyShared, kubevirtapi.IOThreadsPolicyAuto
+
+	tests := []struct {
+		name         string
+		args         []string
+		extra        string
+		wantPolicy   *kubevirtapi.IOThreadsPolicy
+		wantDedicate []string
+		wantErr      string
+	}{
+		{name: "unconfigured", extra: "name=cache,claim=cache"},
+		{name: "root thread", args: []string{"--default-root-dedicated-io-thread"}, wantPolicy: &shared, wantDedicate: []string{containerDiskName}},
+		{name: "extra volume thread", extra: "name=cache,claim=cache,iothread", wantPolicy: &shared, wantDedicate: []string{"cache"}},
+		{name: "auto policy", args: []string{"--default-io-threads-policy=auto", "--default-root-dedicated-io-thread"}, wantPolicy: &auto, wantDedicate: []string{containerDiskName}},
+		{name: "policy alone", args: []string{"--default-io-threads-policy=shared"}, wantPolicy: &shared},
+		{name: "unknown policy", args: []string{"--default-io-threads-policy=dedicated"}, wantErr: `unknown I/O threads policy "dedicated"`},
+		{name: "not virtio", extra: "name=cache,claim=cache,bus=sata,iothread", wantErr: "virtio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			if tt.extra != "" {
+				vol, err := ParseExtraVolume(tt.extra)
+				if err != nil {
+					t.Fatal(err)
+				}
+				jctx.ExtraVolumes = []ExtraVolume{vol}
+			}
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			vm := createTestVM(t, c, jctx, &rc)
+			if got := vm.Spec.Domain.IOThreadsPolicy; (got == nil) != (tt.wantPolicy == nil) || (got != nil && *got != *tt.wantPolicy) {
+				t.Errorf("I/O threads policy = %v, want %v", got, tt.wantPolicy)
+			}
+			var dedicated []string
+			for _, disk := range vm.Spec.Domain.Devices.Disks {
+				if disk.DedicatedIOThread != nil && *disk.DedicatedIOThread {
+					dedicated = append(dedicated, disk.Name)
+				}
+			}
+			if !reflect.DeepEqual(dedicated, tt.wantDedicate) {
+				t.Errorf("disks with a dedicated I/O thread = %v, want %v", dedicated, tt.wantDedicate)
+			}
+		})
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	devices, err := ParseDevices("host device", []string{"fpga:xilinx.com/U250", "nic:intel.com/E810:vf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{{Name: "fpga", DeviceName: "xilinx.com/U250"}, {Name: "nic", DeviceName: "intel.com/E810:vf"}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices = %+v, want %+v", devices, want)
+	}
+
+	for _, spec := range []string{"fpga", ":xilinx.com/U250", "fpga:"} {
+		if _, err := ParseDevices("host device", []string{spec}); err == nil || !strings.Contains(err.Error(), "host device") {
+			t.Errorf("ParseDevices(%q): err = %v, want an invalid host device", spec, err)
+		}
+	}
+}
+
+func TestCreateJobVMHostDevices(t *testing.T) {
+	t.Run("passthrough", func(t *testing.T) {
+		cmd := testPrepareCmd(t, "--default-host-devices=fpga:xilinx.com/U250,nic:intel.com/E810")
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+
+		vm := createTestVM(t, c, jctx, &rc)
+		want := []kubevirtapi.HostDevice{
+			{Name: "fpga", DeviceName: "xilinx.com/U250"},
+			{Name: "nic", DeviceName: "intel.com/E810"},
+		}
+		if got := vm.Spec.Domain.Devices.HostDevices; !reflect.DeepEqual(got, want) {
+			t.Errorf("host devices = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		cmd := testPrepareCmd(t)
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+
+		vm := createTestVM(t, c, jctx, &rc)
+		if got := vm.Spec.Domain.Devices.HostDevices; len(got) != 0 {
+			t.Errorf("host devices = %+v, want none", got)
+		}
+	})
+
+	invalid := []struct {
+		name    string
+		devices []kubevirtapi.HostDevice
+		want    string
+	}{
+		{"duplicate", []kubevirtapi.HostDevice{{Name: "fpga", DeviceName: "xilinx.com/U250"}, {Name: "fpga", DeviceName: "xilinx.com/U280"}}, `host device "fpga" is requested more than once`},
+		{"blank name", []kubevirtapi.HostDevice{{DeviceName: "xilinx.com/U250"}}, "must not be empty"},
+		{"blank device name", []kubevirtapi.HostDevice{{Name: "fpga"}}, "must not be empty"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			jctx.HostDevices = tt.devices
+			rc := cmd.RunConfig
+
+			createTestVMError(t, c, jctx, &rc, tt.want)
+		})
+	}
+}
+
+func TestCreateJobVMGuestNUMA(t *testing.T) {
+	t.Run("dedicated CPUs and hugepages", func(t *testing.T) {
+		cmd := testPrepareCmd(t, "--default-dedicated-cpu", "--default-guest-numa", "--default-hugepages-page-size=2Mi",
+			"--default-cpu-request=4", "--default-cpu-limit=4", "--default-memory-request=8Gi", "--default-memory-limit=8Gi")
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+
+		vm := createTestVM(t, c, jctx, &rc)
+		domain := vm.Spec.Domain
+		if domain.CPU == nil || !domain.CPU.DedicatedCPUPlacement {
+			t.Errorf("CPU = %+v, want dedicated placement", domain.CPU)
+		}
+		if domain.CPU == nil || domain.CPU.NUMA == nil || domain.CPU.NUMA.GuestMappingPassthrough == nil {
+			t.Errorf("CPU = %+v, want a guest NUMA mapping passthrough", domain.CPU)
+		}
+		if domain.Memory == nil || domain.Memory.Hugepages == nil || domain.Memory.Hugepages.PageSize != "2Mi" {
+			t.Errorf("memory = %+v, want 2Mi hugepages", domain.Memory)
+		}
+		checkQuantities(t, "requests", domain.Resources.Requests, map[k8sapi.ResourceName]string{
+			k8sapi.ResourceCPU:    "4",
+			k8sapi.ResourceMemory: "8Gi",
+		})
+		checkQuantities(t, "limits", domain.Resources.Limits, map[k8sapi.ResourceName]string{
+			k8sapi.ResourceCPU:    "4",
+			k8sapi.ResourceMemory: "8Gi",
+		})
+	})
+
+	invalid := []struct {
+		name string
+		args []string
+	}{
+		{"without dedicated CPUs", []string{"--default-guest-numa", "--default-hugepages-page-size=2Mi"}},
+		{"without hugepages", []string{"--default-guest-numa", "--default-dedicated-cpu"}},
+		{"alone", []string{"--default-guest-numa"}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			createTestVMError(t, c, jctx, &rc, "guest NUMA topology requires dedicated CPU placement and hugepages")
+		})
+	}
+}
+
+func TestCreateJobVMDedicatedCPU(t *testing.T) {
+	t.Run("guaranteed", func(t *testing.T) {
+		cmd := testPrepareCmd(t, "--default-dedicated-cpu", "--request-multiplier=0.5",
+			"--default-cpu-request=2", "--default-cpu-limit=2", "--default-memory-request=4Gi", "--default-memory-limit=4Gi")
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+
+		vm := createTestVM(t, c, jctx, &rc)
+		domain := vm.Spec.Domain
+		if domain.CPU == nil || !domain.CPU.DedicatedCPUPlacement {
+			t.Errorf("CPU = %+v, want dedicated placement", domain.CPU)
+		}
+		// Dedicated CPUs keep their requests whole.
+		checkQuantities(t, "requests", domain.Resources.Requests, map[k8sapi.ResourceName]string{
+			k8sapi.ResourceCPU:    "2",
+			k8sapi.ResourceMemory: "4Gi",
+		})
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		cmd := testPrepareCmd(t)
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+
+		vm := createTestVM(t, c, jctx, &rc)
+		if cpu := vm.Spec.Domain.CPU; cpu != nil && cpu.DedicatedCPUPlacement {
+			t.Errorf("CPU = %+v, want shared placement", cpu)
+		}
+	})
+
+	invalid := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			"CPU request below limit",
+			[]string{"--default-cpu-request=1", "--default-cpu-limit=2"},
+			"dedicated CPU placement requires the cpu request (1) to equal the cpu limit (2)",
+		},
+		{
+			"memory request below limit",
+			[]string{"--default-memory-request=1Gi", "--default-memory-limit=2Gi"},
+			"dedicated CPU placement requires the memory request (1Gi) to equal the memory limit (2Gi)",
+		},
+		{
+			"no CPU limit",
+			[]string{"--allow-overcommit", "--default-cpu-limit=", "--default-memory-limit="},
+			"dedicated CPU placement requires the cpu request (1) to equal the cpu limit (unset)",
+		},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, append([]string{"--default-dedicated-cpu"}, tt.args...)...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			createTestVMError(t, c, jctx, &rc, tt.want)
+		})
+	}
+}
+
+func TestCreateJobVMFirmware(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name         string
+		args         []string
+		wantFirmware *kubevirtapi.Firmware
+		wantFeatures *kubevirtapi.Features
+		wantErr      string
+	}{
+		{name: "default"},
+		{
+			name:         "bios",
+			args:         []string{"--default-firmware=bios"},
+			wantFirmware: &kubevirtapi.Firmware{Bootloader: &kubevirtapi.Bootloader{BIOS: &kubevirtapi.BIOS{}}},
+		},
+		{
+			// KubeVirt would otherwise turn Secure Boot on with EFI.
+			name:         "efi",
+			args:         []string{"--default-firmware=efi"},
+			wantFirmware: &kubevirtapi.Firmware{Bootloader: &kubevirtapi.Bootloader{EFI: &kubevirtapi.EFI{SecureBoot: &disabled}}},
+		},
+		{
+			name:         "secure boot",
+			args:         []string{"--default-firmware=efi", "--default-secure-boot"},
+			wantFirmware: &kubevirtapi.Firmware{Bootloader: &kubevirtapi.Bootloader{EFI: &kubevirtapi.EFI{SecureBoot: &enabled}}},
+			wantFeatures: &kubevirtapi.Features{SMM: &kubevirtapi.FeatureState{Enabled: &enabled}},
+		},
+		{
+			name:    "secure boot without firmware",
+			args:    []string{"--default-secure-boot"},
+			wantErr: "secure boot requires EFI firmware",
+		},
+		{
+			name:    "secure boot with bios",
+			args:    []string{"--default-firmware=bios", "--default-secure-boot"},
+			wantErr: "secure boot requires EFI firmware",
+		},
+		{
+			name:    "unknown",
+			args:    []string{"--default-firmware=uefi"},
+			wantErr: `unknown firmware "uefi", must be bios or efi`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			domain := createTestVM(t, c, jctx, &rc).Spec.Domain
+			if !reflect.DeepEqual(domain.Firmware, tt.wantFirmware) {
+				t.Errorf("firmware = %s, want %s", specJSON(domain.Firmware), specJSON(tt.wantFirmware))
+			}
+			if !reflect.DeepEqual(domain.Features, tt.wantFeatures) {
+				t.Errorf("features = %s, want %s", specJSON(domain.Features), specJSON(tt.wantFeatures))
+			}
+		})
+	}
+}
+
+// specJSON formats a part of a spec for error messages, pointers followed.
+func specJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
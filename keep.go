@@ -0,0 +1,105 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// With --keep-on-failure, the Virtual Machine instance of a failed job is
+// left running at cleanup, for its owner to ssh in and investigate, rather
+// than being deleted. Since GitLab Runner does not tell the cleanup stage
+// how the job went, the run stage records failed scripts on the instance.
+// Kept instances get the kept label, and are deleted by the reaper once
+// their time to live has passed.
+
+// FailedStageKey is the annotation recording the stage whose script failed.
+const FailedStageKey = labelPrefix + "/failed-stage"
+
+// KeepUntilKey is the annotation recording until when a kept Virtual
+// Machine instance must not be reaped.
+const KeepUntilKey = labelPrefix + "/keep-until"
+
+// jobFailed returns whether the run stage recorded a failed script on the
+// Virtual Machine instance, and in which stage.
+func jobFailed(vm *kubevirtapi.VirtualMachineInstance) (string, bool) {
+	stage, ok := vm.ObjectMeta.Annotations[FailedStageKey]
+	return stage, ok
+}
+
+// keptUntil returns until when the Virtual Machine instance is kept, if it
+// is.
+func keptUntil(vm *kubevirtapi.VirtualMachineInstance) (time.Time, bool) {
+	until, err := time.Parse(time.RFC3339, vm.ObjectMeta.Annotations[KeepUntilKey])
+	return until, err == nil
+}
+
+// MarkJobFailed records on the Virtual Machine instance that the script of
+// stage failed.
+func MarkJobFailed(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, stage string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				FailedStageKey: stage,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.VirtualMachineInstance(jctx.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	return err
+}
+
+// KeepJobVM labels the Virtual Machine instance as kept for ttl, and tells
+// how to reach it.
+func KeepJobVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, ttl time.Duration) error {
+	until := time.Now().Add(ttl)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				jobLabel(jctx, "kept"): "true",
+			},
+			"annotations": map[string]string{
+				KeepUntilKey: until.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.VirtualMachineInstance(jctx.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	stage, _ := jobFailed(vm)
+	fmt.Fprintf(os.Stderr, "Keeping Virtual Machine instance %v of namespace %v until %v, since the %v stage failed\n",
+		vm.ObjectMeta.Name, vm.ObjectMeta.Namespace, until.Local().Format(time.RFC3339), stage)
+
+	var rc RunConfig
+	if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err == nil {
+		if addr, err := JobVMAddress(vm, rc.Address); err == nil {
+			fmt.Fprintf(os.Stderr, "It can be reached with ssh at %v@%v", rc.SSH.User, net.JoinHostPort(addr, rc.SSH.Port))
+			if rc.SSH.UseGeneratedKey() {
+				fmt.Fprintf(os.Stderr, ", with the key of the secret labeled %v=%v", jobLabel(jctx, "id"), jctx.ID)
+			}
+			fmt.Fprintf(os.Stderr, "\n")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Kept instances are listed by: kubectl get vmi -n %v -l %v=true\n", vm.ObjectMeta.Namespace, jobLabel(jctx, "kept"))
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// MonitorJobVM polls the Virtual Machine instance every interval until ctx is
+// done, and calls lost with the reason as soon as the instance stops
+// running, is deleted, or gets replaced by a restarted one. A crashed guest
+// otherwise leaves the ssh session of the running script hanging until
+// the job times out. Failing to poll is not fatal to the job. A
+// non-positive interval disables watching.
+func MonitorJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	interval time.Duration,
+	lost func(error),
+) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		current, err := client.VirtualMachineInstance(jctx.Namespace).Get(ctx, vm.ObjectMeta.Name, &metav1.GetOptions{})
+		switch {
+		case ctx.Err() != nil:
+			return
+		case apierrors.IsNotFound(err):
+			lost(fmt.Errorf("Virtual Machine instance %s was deleted while the script was running", vm.ObjectMeta.Name))
+			return
+		case err != nil:
+			logger.Warn("checking Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "err", err)
+		case current.ObjectMeta.UID != vm.ObjectMeta.UID:
+			lost(fmt.Errorf("Virtual Machine instance %s restarted while the script was running", vm.ObjectMeta.Name))
+			return
+		case current.Status.Phase != kubevirtapi.Running:
+			lost(fmt.Errorf("Virtual Machine instance %s stopped running while the script was running (phase: %v)%s", vm.ObjectMeta.Name, current.Status.Phase, describeConditions(current)))
+			return
+		}
+	}
+}
+
+// PingGuestAgent queries the guest agent of the Virtual Machine instance
+// every interval until ctx is done, and calls lost once the agent has not
+// answered for threshold, which catches guests whose kernel hung while the
+// instance still looks running. Transient API errors are not held against
+// the guest. A non-positive interval disables pinging.
+func PingGuestAgent(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	interval, threshold time.Duration,
+	lost func(error),
+) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastSeen := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		_, err := client.VirtualMachineInstance(jctx.Namespace).GuestOsInfo(ctx, vm.ObjectMeta.Name)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			lastSeen = time.Now()
+			continue
+		case isTransientAPIError(err):
+			logger.Warn("pinging guest agent", "vmi", vm.ObjectMeta.Name, "err", err)
+			continue
+		}
+		logger.Debug("guest agent did not answer", "vmi", vm.ObjectMeta.Name, "err", err)
+		if silent := time.Since(lastSeen); silent >= threshold {
+			lost(fmt.Errorf("guest agent of Virtual Machine instance %s has not answered for %v, the guest is unresponsive: %w", vm.ObjectMeta.Name, silent.Round(time.Second), err))
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestMonitorJobVM(t *testing.T) {
+	running := func(uid types.UID, phase kubevirtapi.VirtualMachineInstancePhase) *kubevirtapi.VirtualMachineInstance {
+		return &kubevirtapi.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: "vm", UID: uid},
+			Status:     kubevirtapi.VirtualMachineInstanceStatus{Phase: phase},
+		}
+	}
+	type poll struct {
+		vm  *kubevirtapi.VirtualMachineInstance
+		err error
+	}
+	tests := []struct {
+		name     string
+		polls    []poll
+		wantLost string
+	}{
+		{
+			name:     "deleted",
+			polls:    []poll{{vm: running("uid-1", kubevirtapi.Running)}, {err: apierrors.NewNotFound(kubevirtapi.Resource("virtualmachineinstances"), "vm")}},
+			wantLost: "was deleted",
+		},
+		{
+			name:     "restarted",
+			polls:    []poll{{vm: running("uid-2", kubevirtapi.Running)}},
+			wantLost: "restarted",
+		},
+		{
+			name:     "stopped",
+			polls:    []poll{{err: errors.New("connection refused")}, {vm: running("uid-1", kubevirtapi.Failed)}},
+			wantLost: "stopped running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+
+			polled := 0
+			c.VMIs.EXPECT().Get(gomock.Any(), "vm", gomock.Any()).Times(len(tt.polls)).DoAndReturn(
+				func(context.Context, string, *metav1.GetOptions) (*kubevirtapi.VirtualMachineInstance, error) {
+					p := tt.polls[polled]
+					polled++
+					return p.vm, p.err
+				})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var lost error
+			MonitorJobVM(ctx, c, jctx, running("uid-1", kubevirtapi.Running), time.Millisecond, func(err error) { lost = err })
+			if lost == nil || !strings.Contains(lost.Error(), tt.wantLost) {
+				t.Errorf("lost = %v, want %q", lost, tt.wantLost)
+			}
+		})
+	}
+}
+
+func TestMonitorJobVMRunning(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	vm := &kubevirtapi.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", UID: "uid-1"},
+		Status:     kubevirtapi.VirtualMachineInstanceStatus{Phase: kubevirtapi.Running},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	polled := 0
+	c.VMIs.EXPECT().Get(gomock.Any(), "vm", gomock.Any()).MinTimes(3).DoAndReturn(
+		func(context.Context, string, *metav1.GetOptions) (*kubevirtapi.VirtualMachineInstance, error) {
+			if polled++; polled == 3 {
+				cancel()
+			}
+			return vm.DeepCopy(), nil
+		})
+	MonitorJobVM(ctx, c, jctx, vm, time.Millisecond, func(err error) { t.Errorf("lost: %v", err) })
+}
@@ -0,0 +1,188 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(level))
+}
+
+// ParseLogLevel parses a level name, case-insensitively.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for _, level := range []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes the diagnostics of the executor as structured records, in
+// logfmt or JSON. Its API follows the one of log/slog, which is not
+// available to this module yet.
+//
+// Everything the executor writes to standard error ends up in the job log,
+// so diagnostics go to a file of the runner host instead, see --log-file.
+type Logger struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+	attrs []interface{}
+}
+
+// NewLogger returns a logger writing records of at least the given level
+// to w, in the "text" (logfmt) or "json" format.
+func NewLogger(w io.Writer, level LogLevel, format string) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		w:     w,
+		level: level,
+		json:  format == "json",
+	}
+}
+
+// OpenLogOutput returns where the diagnostics of --log-file go, and a
+// function closing it. Standard error ends up in the job log, which is for
+// the messages meant for whoever runs the job, so it is only used for "-".
+// Diagnostics are discarded when name is empty, or cannot be opened.
+func OpenLogOutput(name string) (io.Writer, func() error, error) {
+	nop := func() error { return nil }
+	switch name {
+	case "":
+		return io.Discard, nop, nil
+	case "-":
+		return os.Stderr, nop, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return io.Discard, nop, err
+	}
+	return f, f.Close, nil
+}
+
+// logger is the logger of the executor, set up once the command line has
+// been parsed.
+var logger = NewLogger(io.Discard, LevelError, "text")
+
+// With returns a logger adding the given key-value pairs to every record.
+func (l *Logger) With(args ...interface{}) *Logger {
+	with := *l
+	with.attrs = append(append([]interface{}{}, l.attrs...), args...)
+	return &with
+}
+
+// Enabled returns whether records of the given level are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, args ...interface{}) { l.Log(LevelDebug, msg, args...) }
+func (l *Logger) Info(msg string, args ...interface{})  { l.Log(LevelInfo, msg, args...) }
+func (l *Logger) Warn(msg string, args ...interface{})  { l.Log(LevelWarn, msg, args...) }
+func (l *Logger) Error(msg string, args ...interface{}) { l.Log(LevelError, msg, args...) }
+
+// Log writes a record with the given level, message, and key-value pairs.
+func (l *Logger) Log(level LogLevel, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	kvs := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	}
+	kvs = append(kvs, l.attrs...)
+	kvs = append(kvs, args...)
+	if len(kvs)%2 != 0 {
+		kvs = append(kvs[:len(kvs)-1], "!BADKEY", kvs[len(kvs)-1])
+	}
+
+	var sb strings.Builder
+	if l.json {
+		sb.WriteByte('{')
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		key, value := fmt.Sprint(kvs[i]), logValue(kvs[i+1])
+		switch {
+		case l.json:
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			sb.Write(k)
+			sb.WriteByte(':')
+			sb.Write(v)
+		default:
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(key)
+			sb.WriteByte('=')
+			sb.WriteString(logfmtQuote(fmt.Sprint(value)))
+		}
+	}
+	if l.json {
+		sb.WriteByte('}')
+	}
+	sb.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, sb.String())
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func logfmtQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' }) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
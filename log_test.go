@@ -0,0 +1,69 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLogOutput(t *testing.T) {
+	t.Run("discarded by default", func(t *testing.T) {
+		w, closeLog, err := OpenLogOutput("")
+		if err != nil || w != io.Discard {
+			t.Errorf("OpenLogOutput(\"\") = %v, %v, want to discard", w, err)
+		}
+		if err := closeLog(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("standard error", func(t *testing.T) {
+		w, _, err := OpenLogOutput("-")
+		if err != nil || w != os.Stderr {
+			t.Errorf("OpenLogOutput(\"-\") = %v, %v, want standard error", w, err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), "kubevirt.log")
+		if err := os.WriteFile(name, []byte("previous\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w, closeLog, err := OpenLogOutput(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "next\n")
+		if err := closeLog(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "previous\nnext\n" {
+			t.Errorf("log file = %q, want the diagnostics appended", data)
+		}
+	})
+
+	t.Run("unwritable", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), "missing", "kubevirt.log")
+		w, closeLog, err := OpenLogOutput(name)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("err = %v, want a missing directory", err)
+		}
+		if w != io.Discard {
+			t.Errorf("diagnostics go to %v, want them discarded", w)
+		}
+		if err := closeLog(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+)
+
+// defaultArchitecture is the CPU architecture of the guests, unless the
+// job says otherwise.
+const defaultArchitecture = "amd64"
+
+// architectures are the supported guest architectures, with their default
+// machine type and firmware. KubeVirt only boots arm64 guests with EFI.
+var architectures = map[string]struct {
+	MachineType string
+	Firmware    string
+}{
+	"amd64": {MachineType: "q35"},
+	"arm64": {MachineType: "virt", Firmware: "efi"},
+}
+
+// applyArchitecture fills in the machine type and firmware of the job that
+// are left to the defaults of its architecture, and restricts the Virtual
+// Machine instance to nodes of that architecture. It returns an error if
+// the job asks for anything that the architecture cannot do.
+func applyArchitecture(jctx *JobContext) error {
+	if jctx.Architecture == "" {
+		jctx.Architecture = defaultArchitecture
+	}
+	arch, ok := architectures[jctx.Architecture]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %q, must be amd64 or arm64", jctx.Architecture)
+	}
+
+	if jctx.MachineType == "" {
+		jctx.MachineType = arch.MachineType
+	}
+	if jctx.Firmware == "" {
+		jctx.Firmware = arch.Firmware
+	}
+	if arch.Firmware != "" && jctx.Firmware != arch.Firmware {
+		return fmt.Errorf("%s guests require %s firmware, not %s", jctx.Architecture, arch.Firmware, jctx.Firmware)
+	}
+
+	if nodeArch, ok := jctx.NodeSelector[k8sapi.LabelArchStable]; ok {
+		if nodeArch != jctx.Architecture {
+			return fmt.Errorf("cannot run %s guests on the %s nodes of the node selector", jctx.Architecture, nodeArch)
+		}
+		return nil
+	}
+	selector := map[string]string{k8sapi.LabelArchStable: jctx.Architecture}
+	for k, v := range jctx.NodeSelector {
+		selector[k] = v
+	}
+	jctx.NodeSelector = selector
+	return nil
+}
+
+// checkMachineType returns an error unless machineType matches one of the
+// allowed arch:pattern entries for arch, where pattern is a glob pattern,
+// e.g. amd64:pc-q35-*. Anything goes when allowed is empty.
+func checkMachineType(arch, machineType string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, entry := range allowed {
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid allowed machine type %q: must be arch:pattern", entry)
+		}
+		if kv[0] != arch {
+			continue
+		}
+		ok, err := path.Match(kv[1], machineType)
+		if err != nil {
+			return fmt.Errorf("invalid allowed machine type %q: %w", entry, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown machine type '%s' for arch %s", machineType, arch)
+}
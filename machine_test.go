@@ -0,0 +1,171 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+)
+
+func TestCheckMachineType(t *testing.T) {
+	allowed := []string{"amd64:q35", "amd64:pc-q35-*", "arm64:virt", "arm64:virt-*"}
+
+	tests := []struct {
+		arch, machineType string
+		allowed           []string
+		wantErr           string
+	}{
+		{arch: "amd64", machineType: "q35", allowed: allowed},
+		{arch: "amd64", machineType: "pc-q35-rhel8.6.0", allowed: allowed},
+		{arch: "arm64", machineType: "virt-rhel9.2.0", allowed: allowed},
+		{arch: "amd64", machineType: "pc-i440fx-2.12", allowed: allowed, wantErr: "unknown machine type 'pc-i440fx-2.12' for arch amd64"},
+		{arch: "amd64", machineType: "virt", allowed: allowed, wantErr: "unknown machine type 'virt' for arch amd64"},
+		{arch: "arm64", machineType: "q35", allowed: allowed, wantErr: "unknown machine type 'q35' for arch arm64"},
+		{arch: "amd64", machineType: "anything"},
+		{arch: "amd64", machineType: "q35", allowed: []string{"q35"}, wantErr: "must be arch:pattern"},
+		{arch: "amd64", machineType: "q35", allowed: []string{"amd64:["}, wantErr: "invalid allowed machine type"},
+	}
+	for _, tt := range tests {
+		err := checkMachineType(tt.arch, tt.machineType, tt.allowed)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkMachineType(%s, %s): %v", tt.arch, tt.machineType, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("checkMachineType(%s, %s): err = %v, want %q", tt.arch, tt.machineType, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCreateJobVMMachineType(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "default", want: "q35"},
+		{name: "versioned", args: []string{"--default-machine-type=pc-q35-rhel8.6.0"}, want: "pc-q35-rhel8.6.0"},
+		{name: "not allowed", args: []string{"--default-machine-type=pc-i440fx-2.12"}, wantErr: "unknown machine type 'pc-i440fx-2.12' for arch amd64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			machine := createTestVM(t, c, jctx, &rc).Spec.Domain.Machine
+			if machine == nil || machine.Type != tt.want {
+				t.Errorf("machine = %+v, want the type %s", machine, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyArchitecture(t *testing.T) {
+	tests := []struct {
+		name         string
+		jctx         JobContext
+		wantMachine  string
+		wantFirmware string
+		wantSelector map[string]string
+		wantErr      string
+	}{
+		{
+			name:         "default",
+			wantMachine:  "q35",
+			wantSelector: map[string]string{k8sapi.LabelArchStable: "amd64"},
+		},
+		{
+			name:         "arm64",
+			jctx:         JobContext{Architecture: "arm64"},
+			wantMachine:  "virt",
+			wantFirmware: "efi",
+			wantSelector: map[string]string{k8sapi.LabelArchStable: "arm64"},
+		},
+		{
+			name:         "explicit machine type",
+			jctx:         JobContext{Architecture: "amd64", MachineType: "pc-q35-rhel8.6.0", Firmware: "bios"},
+			wantMachine:  "pc-q35-rhel8.6.0",
+			wantFirmware: "bios",
+			wantSelector: map[string]string{k8sapi.LabelArchStable: "amd64"},
+		},
+		{
+			name:         "other node labels",
+			jctx:         JobContext{Architecture: "arm64", NodeSelector: map[string]string{"zone": "a"}},
+			wantMachine:  "virt",
+			wantFirmware: "efi",
+			wantSelector: map[string]string{k8sapi.LabelArchStable: "arm64", "zone": "a"},
+		},
+		{
+			name:         "matching node selector",
+			jctx:         JobContext{Architecture: "arm64", NodeSelector: map[string]string{k8sapi.LabelArchStable: "arm64"}},
+			wantMachine:  "virt",
+			wantFirmware: "efi",
+			wantSelector: map[string]string{k8sapi.LabelArchStable: "arm64"},
+		},
+		{name: "mismatching node selector", jctx: JobContext{Architecture: "arm64", NodeSelector: map[string]string{k8sapi.LabelArchStable: "amd64"}}, wantErr: "cannot run arm64 guests on the amd64 nodes"},
+		{name: "arm64 with bios", jctx: JobContext{Architecture: "arm64", Firmware: "bios"}, wantErr: "arm64 guests require efi firmware"},
+		{name: "unsupported", jctx: JobContext{Architecture: "riscv64"}, wantErr: `unsupported architecture "riscv64"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jctx := tt.jctx
+			err := applyArchitecture(&jctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jctx.MachineType != tt.wantMachine || jctx.Firmware != tt.wantFirmware {
+				t.Errorf("machine type %q, firmware %q, want %q, %q", jctx.MachineType, jctx.Firmware, tt.wantMachine, tt.wantFirmware)
+			}
+			if !reflect.DeepEqual(jctx.NodeSelector, tt.wantSelector) {
+				t.Errorf("node selector = %v, want %v", jctx.NodeSelector, tt.wantSelector)
+			}
+		})
+	}
+
+	// The job context of the caller is left alone.
+	selector := map[string]string{"zone": "a"}
+	jctx := JobContext{NodeSelector: selector}
+	if err := applyArchitecture(&jctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(selector) != 1 {
+		t.Errorf("node selector of the caller changed to %v", selector)
+	}
+
+	// And the instance lands on nodes of its architecture.
+	for _, arch := range []string{"amd64", "arm64"} {
+		cmd := testPrepareCmd(t)
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		jctx.Architecture = arch
+		rc := cmd.RunConfig
+		vm := createTestVM(t, c, jctx, &rc)
+		if got := vm.Spec.NodeSelector[k8sapi.LabelArchStable]; got != arch {
+			t.Errorf("%s: %s node selector = %q", arch, k8sapi.LabelArchStable, got)
+		}
+		if want := architectures[arch].MachineType; vm.Spec.Domain.Machine == nil || vm.Spec.Domain.Machine.Type != want {
+			t.Errorf("%s: machine = %+v, want the type %s", arch, vm.Spec.Domain.Machine, want)
+		}
+	}
+}
@@ -9,34 +9,145 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
+	"os/signal"
+	"path"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtapi "kubevirt.io/api/core/v1"
 )
 
 type JobContext struct {
-	ID              string
-	BaseName        string
-	Image           string
-	ImagePullPolicy string
-	ImagePullSecret string
-	Namespace       string
-	MachineType     string
+	ID               string
+	BaseName         string
+	Image            string
+	ImagePullPolicy  string
+	ImagePullSecrets []string
+	Namespace        string
+	LabelPrefix      string
+	Architecture     string
+	MachineType      string
+
+	AllowedMachineTypes []string
+
+	DataVolumeName  string
+	DataVolumeImage string
+	DataVolumeSize  string
+	RootBootOrder   uint
+	RootCache       string
+	RootBus         string
+
+	ExtraVolumes     []ExtraVolume
+	ScratchDisks     []ScratchDisk
+	SecretVolumes    []SecretVolume
+	ConfigMapVolumes []ConfigMapVolume
+	Filesystems      []Filesystem
+	IOThrottle       IOThrottle
+
+	NetworkBinding string
+	NetworkName    string
+	MACAddress     string
+	ExtraNetworks  []ExtraNetwork
+	DNSNameservers []string
+	DNSSearches    []string
+
+	Services      []Service
+	ClusterDomain string
+
+	Labels       map[string]string
+	Annotations  map[string]string
+	NodeSelector map[string]string
+	Tolerations  []k8sapi.Toleration
+
+	Affinity          *k8sapi.Affinity
+	SpreadAcrossNodes bool
+
+	GPUs        []kubevirtapi.GPU
+	HostDevices []kubevirtapi.HostDevice
+
+	CPUSockets   uint32
+	CPUCores     uint32
+	CPUThreads   uint32
+	DedicatedCPU bool
+	GuestNUMA    bool
+
+	HugepagesPageSize string
+
+	Firmware   string
+	SMBIOS     SMBIOS
+	SecureBoot bool
+	EnableTPM  bool
+	Watchdog   string
+	EnableRNG  bool
+
+	EnableMemBalloon        bool
+	EnableFreePageReporting bool
+
+	EvictionStrategy              string
+	PriorityClassName             string
+	SchedulerName                 string
+	Hostname                      string
+	Subdomain                     string
+	TerminationGracePeriodSeconds *int64
 
 	CPURequest              string
 	CPULimit                string
 	MemoryRequest           string
 	MemoryLimit             string
+	GuestMemory             string
 	EphemeralStorageRequest string
 	EphemeralStorageLimit   string
+	AllowOvercommit         bool
+	RequestMultiplier       float64
 	Timezone                string
-	CloudInitBase64         string
+	CloudInitUserData       string
+	CloudInitNetworkData    string
+	FatalReasons            []string
+	CaptureConsole          bool
+	ConsoleLog              string
+	ReadinessMode           string
+	ReadinessCommand        string
+	PreScript               string
+	PostScript              string
+	AllowedImages           []string
+	CheckImage              bool
+	CheckImageTimeout       time.Duration
+	ResolveImageDigest      bool
+	DryRun                  bool
+	CreateTimeout           time.Duration
+	UseVirtualMachine       bool
+	MaxRestarts             int
+
+	Pool        string
+	PoolProfile string
+
+	BuildsDir string
+	CacheDir  string
+
+	ShutdownGracePeriod time.Duration
+
+	KeepOnFailure bool
+	KeepTTL       time.Duration
+
+	JobTimeout time.Duration
+	Deadline   time.Time
+
+	APIRetries          int
+	APIRetryMaxInterval time.Duration
+	FindTimeout         time.Duration
 
 	ProjectID    string
+	PipelineID   string
 	JobID        string
 	JobName      string
 	JobRef       string
@@ -46,64 +157,222 @@ type JobContext struct {
 }
 
 var cli struct {
-	RunnerID     string `name:"runner-id" env:"CUSTOM_ENV_CI_RUNNER_ID"`
-	ProjectID    string `name:"project-id" env:"CUSTOM_ENV_CI_PROJECT_ID"`
-	ConcurrentID string `name:"concurrent-id" env:"CUSTOM_ENV_CI_CONCURRENT_PROJECT_ID"`
-	JobID        string `name:"job-id" env:"CUSTOM_ENV_CI_JOB_ID"`
-	JobName      string `name:"job-name" env:"CUSTOM_ENV_CI_COMMIT_BEFORE_SHA"`
-	JobRef       string `name:"job-ref" env:"CUSTOM_ENV_CI_COMMIT_REF_NAME"`
-	JobSha       string `name:"job-sha" env:"CUSTOM_ENV_CI_COMMIT_SHA"`
-	JobBeforeSha string `name:"job-before-sha" env:"CUSTOM_ENV_CI_COMMIT_BEFORE_SHA"`
-	JobURL       string `name:"job-url" env:"CUSTOM_ENV_CI_JOB_URL"`
-	JobImage     string `name:"image" env:"CUSTOM_ENV_CI_JOB_IMAGE"`
-	Namespace    string `name:"namespace" env:"KUBEVIRT_NAMESPACE" default:"gitlab-runner"`
-	Debug        bool
+	RunnerID          string            `name:"runner-id" env:"CUSTOM_ENV_CI_RUNNER_ID"`
+	ProjectID         string            `name:"project-id" env:"CUSTOM_ENV_CI_PROJECT_ID"`
+	ProjectPath       string            `name:"project-path" env:"CUSTOM_ENV_CI_PROJECT_PATH"`
+	ConcurrentID      string            `name:"concurrent-id" env:"CUSTOM_ENV_CI_CONCURRENT_PROJECT_ID"`
+	JobID             string            `name:"job-id" env:"CUSTOM_ENV_CI_JOB_ID"`
+	PipelineID        string            `name:"pipeline-id" env:"CUSTOM_ENV_CI_PIPELINE_ID"`
+	JobName           string            `name:"job-name" env:"CUSTOM_ENV_CI_COMMIT_BEFORE_SHA"`
+	JobRef            string            `name:"job-ref" env:"CUSTOM_ENV_CI_COMMIT_REF_NAME"`
+	JobSha            string            `name:"job-sha" env:"CUSTOM_ENV_CI_COMMIT_SHA"`
+	JobBeforeSha      string            `name:"job-before-sha" env:"CUSTOM_ENV_CI_COMMIT_BEFORE_SHA"`
+	JobURL            string            `name:"job-url" env:"CUSTOM_ENV_CI_JOB_URL"`
+	JobImage          string            `name:"image" env:"CUSTOM_ENV_CI_JOB_IMAGE"`
+	JobServices       string            `name:"services" env:"CUSTOM_ENV_CI_JOB_SERVICES" help:"JSON list of the services of the job"`
+	Kubeconfig        string            `name:"kubeconfig" env:"KUBEVIRT_KUBECONFIG" help:"kubeconfig file to connect to the cluster with, instead of the in-cluster configuration, KUBECONFIG or ~/.kube/config"`
+	KubeContext       string            `name:"context" env:"KUBEVIRT_CONTEXT" help:"context of the kubeconfig file to use instead of its current one"`
+	Namespace         string            `name:"namespace" env:"KUBEVIRT_NAMESPACE" default:"gitlab-runner"`
+	Namespaces        map[string]string `name:"project-namespaces" mapsep:"," env:"KUBEVIRT_PROJECT_NAMESPACES" help:"comma-separated project-id=namespace pairs giving the namespace of the jobs of a project, instead of --namespace"`
+	AllowedNamespaces []string          `name:"allowed-namespaces" sep:"," env:"KUBEVIRT_ALLOWED_NAMESPACES" help:"comma-separated glob patterns of the namespaces that jobs may run in; jobs may then pick theirs by setting KUBEVIRT_NAMESPACE"`
+	JobNamespace      string            `name:"job-namespace" env:"CUSTOM_ENV_KUBEVIRT_NAMESPACE" help:"namespace requested by the job, which must be allowed by --allowed-namespaces"`
+
+	LabelPrefix string `name:"label-prefix" env:"KUBEVIRT_LABEL_PREFIX" default:"gitlab-runner-kubevirt.snai.pe" help:"domain of the labels identifying the Virtual Machine instances of this runner fleet"`
+	Debug       bool   `help:"log debug diagnostics; same as --log-level=debug"`
+
+	LogLevel  string `name:"log-level" env:"KUBEVIRT_LOG_LEVEL" default:"warn" enum:"debug,info,warn,error" help:"minimum level of the diagnostics to log"`
+	LogFormat string `name:"log-format" env:"KUBEVIRT_LOG_FORMAT" default:"text" enum:"text,json" help:"format of the diagnostics"`
+	LogFile   string `name:"log-file" env:"KUBEVIRT_LOG_FILE" help:"file of the runner host to append diagnostics to, keeping them out of the job log, e.g. /var/log/gitlab-runner/kubevirt.log; - for standard error; discarded when empty; only the config stage reports failing to open it"`
+
+	APIRetries          int           `name:"api-retries" env:"KUBEVIRT_API_RETRIES" default:"5" help:"number of times to retry Kubernetes API calls failing with transient errors"`
+	APIRetryMaxInterval time.Duration `name:"api-retry-max-interval" env:"KUBEVIRT_API_RETRY_MAX_INTERVAL" default:"10s" help:"maximum delay between retries of Kubernetes API calls"`
+	JobTimeout          time.Duration `name:"job-timeout" env:"KUBEVIRT_JOB_TIMEOUT" help:"time after which the run stage aborts the job, counting from the start of the prepare stage, regardless of the timeout of GitLab Runner; disabled when zero"`
+	FindTimeout         time.Duration `name:"find-timeout" env:"KUBEVIRT_FIND_TIMEOUT" default:"5s" help:"how long to keep looking for the Virtual Machine instance of the job before deciding that it is gone, since the API may not list a freshly created one right away"`
+
+	MetricsFile string `name:"metrics-file" env:"KUBEVIRT_METRICS_FILE" help:"file to add the Prometheus metrics of each stage to, for the textfile collector of node_exporter, e.g. /var/lib/node_exporter/textfile/gitlab-runner-kubevirt.prom; disabled when empty"`
+
+	ConfigFile ConfigFile `name:"config" env:"KUBEVIRT_CONFIG" default:"/etc/gitlab-runner-kubevirt/config.toml" help:"configuration file providing defaults for flags"`
+
+	// Per-job overrides, settable from the CI variables of the job. When
+	// unset, the prepare stage falls back to its --default-* flags.
+	CPURequest    string `name:"cpu-request" env:"CUSTOM_ENV_KUBEVIRT_CPU_REQUEST" help:"CPU request of the Virtual Machine instance"`
+	CPULimit      string `name:"cpu-limit" env:"CUSTOM_ENV_KUBEVIRT_CPU_LIMIT" help:"CPU limit of the Virtual Machine instance"`
+	MemoryRequest string `name:"memory-request" env:"CUSTOM_ENV_KUBEVIRT_MEMORY_REQUEST" help:"memory request of the Virtual Machine instance"`
+	MemoryLimit   string `name:"memory-limit" env:"CUSTOM_ENV_KUBEVIRT_MEMORY_LIMIT" help:"memory limit of the Virtual Machine instance"`
+	GuestMemory   string `name:"guest-memory" env:"CUSTOM_ENV_KUBEVIRT_GUEST_MEMORY" help:"memory seen by the guest"`
+	Architecture  string `name:"arch" env:"CUSTOM_ENV_KUBEVIRT_ARCH" help:"CPU architecture of the Virtual Machine instance"`
+	MachineType   string `name:"machine-type" env:"CUSTOM_ENV_KUBEVIRT_MACHINE_TYPE" help:"machine type of the Virtual Machine instance"`
+	RootBus       string `name:"root-bus" env:"CUSTOM_ENV_KUBEVIRT_ROOT_BUS" help:"bus of the root disk of the Virtual Machine instance"`
+	Hostname      string `name:"hostname" env:"CUSTOM_ENV_KUBEVIRT_HOSTNAME" help:"hostname of the guest"`
 
 	Config  ConfigCmd  `cmd`
 	Prepare PrepareCmd `cmd`
 	Run     RunCmd     `cmd`
 	Cleanup CleanupCmd `cmd`
+	Reap    ReapCmd    `cmd`
+	Warm    WarmCmd    `cmd:""`
+	Version VersionCmd `cmd:""`
 }
 
-var Debug io.Writer = io.Discard
-
 func main() {
 
 	ctx := kong.Parse(&cli)
 
-	if cli.Debug {
-		Debug = os.Stderr
+	jctx, err := LoadJobContext()
+	if err != nil {
+		failureExit(err)
 	}
 
-	jctx := contextFromEnv()
+	level, _ := ParseLogLevel(cli.LogLevel)
+	if cli.Debug {
+		level = LevelDebug
+	}
+	// Diagnostics are not worth failing the job over, nor warning about
+	// in the log of every stage of the job.
+	logOutput, closeLog, err := OpenLogOutput(cli.LogFile)
+	if err != nil && ctx.Command() == "config" {
+		fmt.Fprintf(os.Stderr, "%s: not logging diagnostics: %v\n", os.Args[0], err)
+	}
+	defer closeLog()
+	logger = NewLogger(logOutput, level, cli.LogFormat).With("job", jctx.ID)
 
 	ctx.Bind(jctx)
 	ctx.BindToProvider(KubeClient)
+
+	// GitLab Runner terminates the stage's process when the job gets
+	// cancelled or times out.
+	sigctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	ctx.BindToProvider(func() (context.Context, error) {
-		return context.Background(), nil
+		return sigctx, nil
 	})
 
-	if err := ctx.Run(jctx); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
-		systemFailureExit()
+	err = ctx.Run(jctx)
+	if err := WriteMetricsFile(cli.MetricsFile); err != nil {
+		logger.Warn("writing metrics", "file", cli.MetricsFile, "err", err)
+	}
+	if err != nil {
+		failureExit(err)
 	}
 }
 
-func contextFromEnv() *JobContext {
+// LoadJobContext builds the job context from the CUSTOM_ENV_* variables
+// passed by GitLab Runner and the KUBEVIRT_* variables of the runner, as
+// parsed into cli. Every invalid field is reported in the returned error.
+func LoadJobContext() (*JobContext, error) {
 	var jctx JobContext
-	jctx.BaseName = fmt.Sprintf(`runner-%s-project-%s-concurrent-%s`, cli.RunnerID, cli.ProjectID, cli.ConcurrentID)
+	// The job ID comes first, so that it survives the truncation of long
+	// project paths.
+	jctx.BaseName = fmt.Sprintf(`job-%s-%s`, cli.JobID, cli.ProjectPath)
 	jctx.ID = digest(sha1.New, cli.RunnerID, cli.ProjectID, cli.ConcurrentID, cli.JobID)
 	jctx.Image = cli.JobImage
-	jctx.Namespace = cli.Namespace
+	jctx.LabelPrefix = cli.LabelPrefix
+	jctx.Architecture = cli.Architecture
+	jctx.MachineType = cli.MachineType
+	jctx.RootBus = cli.RootBus
+	jctx.Hostname = cli.Hostname
+
+	jctx.CPURequest = cli.CPURequest
+	jctx.CPULimit = cli.CPULimit
+	jctx.MemoryRequest = cli.MemoryRequest
+	jctx.MemoryLimit = cli.MemoryLimit
+	jctx.GuestMemory = cli.GuestMemory
+
+	jctx.APIRetries = cli.APIRetries
+	jctx.APIRetryMaxInterval = cli.APIRetryMaxInterval
+	jctx.FindTimeout = cli.FindTimeout
+	jctx.JobTimeout = cli.JobTimeout
 
 	jctx.ProjectID = cli.ProjectID
+	jctx.PipelineID = cli.PipelineID
 	jctx.JobID = cli.JobID
 	jctx.JobName = cli.JobName
 	jctx.JobRef = cli.JobRef
 	jctx.JobSha = cli.JobSha
 	jctx.JobBeforeSha = cli.JobBeforeSha
 	jctx.JobURL = cli.JobURL
-	return &jctx
+
+	var errs []string
+	baseName, err := sanitizeBaseName(jctx.BaseName)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	jctx.BaseName = baseName
+
+	services, err := ParseServices(cli.JobServices)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	jctx.Services = services
+
+	jctx.Namespace, err = JobNamespace(cli.Namespace, cli.JobNamespace, cli.ProjectID, cli.Namespaces, cli.AllowedNamespaces)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else if jctx.Namespace == "" {
+		errs = append(errs, "namespace: must not be empty")
+	} else {
+		for _, msg := range validation.IsDNS1123Label(jctx.Namespace) {
+			errs = append(errs, fmt.Sprintf("namespace %q: %s", jctx.Namespace, msg))
+		}
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(jctx.LabelPrefix) {
+		errs = append(errs, fmt.Sprintf("label prefix %q: %s", jctx.LabelPrefix, msg))
+	}
+	if jctx.APIRetries < 0 {
+		errs = append(errs, fmt.Sprintf("api retries %d: must not be negative", jctx.APIRetries))
+	}
+	if jctx.APIRetryMaxInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("api retry max interval %v: must be positive", jctx.APIRetryMaxInterval))
+	}
+	if jctx.JobTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("job timeout %v: must not be negative", jctx.JobTimeout))
+	}
+	if jctx.FindTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("find timeout %v: must not be negative", jctx.FindTimeout))
+	}
+	if strings.TrimSpace(jctx.MachineType) != jctx.MachineType {
+		errs = append(errs, fmt.Sprintf("machine type %q: must not contain leading or trailing spaces", jctx.MachineType))
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid job context: %s", strings.Join(errs, "; "))
+	}
+	return &jctx, nil
+}
+
+// JobNamespace returns the namespace of the job: the one it requests, or
+// else the one of its project in namespaces, or else the default one.
+//
+// Jobs may only request a namespace when there is an allowlist of glob
+// patterns, since they could otherwise run anywhere the runner has access
+// to. The namespace must then match the allowlist, wherever it comes from.
+func JobNamespace(fallback, requested, projectID string, namespaces map[string]string, allowed []string) (string, error) {
+	namespace := fallback
+	if ns, ok := namespaces[projectID]; ok && projectID != "" {
+		namespace = ns
+	}
+	if requested != "" {
+		if len(allowed) == 0 {
+			// The logger isn't set up yet.
+			fmt.Fprintf(os.Stderr, "Ignoring namespace %s requested by the job: no namespaces are allowed, see --allowed-namespaces\n", requested)
+		} else {
+			namespace = requested
+		}
+	}
+
+	if len(allowed) == 0 {
+		return namespace, nil
+	}
+	for _, pattern := range allowed {
+		ok, err := path.Match(pattern, namespace)
+		if err != nil {
+			return "", fmt.Errorf("invalid allowed namespace pattern %q: %w", pattern, err)
+		}
+		if ok {
+			return namespace, nil
+		}
+	}
+	return "", fmt.Errorf("namespace %q is not allowed; allowed namespaces: %s", namespace, strings.Join(allowed, ", "))
 }
 
 func digest(hashfunc func() hash.Hash, v ...interface{}) string {
@@ -136,6 +405,20 @@ func envExit(status int, env string) {
 	os.Exit(status)
 }
 
+// failureExit reports err and exits with the code GitLab Runner expects for
+// it: scripts of the job that ran but failed are build failures, while
+// anything else (provisioning the Virtual Machine instance, connecting to
+// it, ...) is a system failure.
+func failureExit(err error) {
+	var scripterr *ScriptError
+	if errors.As(err, &scripterr) {
+		fmt.Fprintln(os.Stderr, scripterr)
+		buildFailureExit()
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	systemFailureExit()
+}
+
 func systemFailureExit() {
 	envExit(2, "SYSTEM_FAILURE_EXIT_CODE")
 }
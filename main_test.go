@@ -0,0 +1,176 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobNamespace(t *testing.T) {
+	projects := map[string]string{"42": "team-a", "43": "other"}
+
+	tests := []struct {
+		name      string
+		requested string
+		project   string
+		allowed   []string
+		want      string
+		wantErr   string
+	}{
+		{name: "default", want: "gitlab-runner"},
+		{name: "project mapping", project: "42", want: "team-a"},
+		{name: "unmapped project", project: "7", want: "gitlab-runner"},
+		{name: "request ignored without allowlist", requested: "team-b", want: "gitlab-runner"},
+		{name: "allowed request", requested: "ci-team-b", allowed: []string{"ci-*"}, want: "ci-team-b"},
+		{name: "request over project mapping", requested: "ci-team-b", project: "42", allowed: []string{"ci-*", "team-a"}, want: "ci-team-b"},
+		{name: "denied request", requested: "kube-system", allowed: []string{"ci-*"}, wantErr: `namespace "kube-system" is not allowed`},
+		{name: "denied project mapping", project: "43", allowed: []string{"team-*"}, wantErr: `namespace "other" is not allowed`},
+		{name: "denied default", allowed: []string{"ci-*"}, wantErr: `namespace "gitlab-runner" is not allowed`},
+		{name: "invalid pattern", requested: "ci-a", allowed: []string{"ci-["}, wantErr: "invalid allowed namespace pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JobNamespace("gitlab-runner", tt.requested, tt.project, projects, tt.allowed)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("namespace = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeKubeconfig writes a kubeconfig file whose current context connects
+// to https://<name>, and whose other context connects to https://<name>-other.
+func writeKubeconfig(t *testing.T, dir, name string) string {
+	t.Helper()
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: main
+  cluster: {server: "https://%[1]s"}
+- name: other
+  cluster: {server: "https://%[1]s-other"}
+users:
+- name: user
+  user: {token: secret}
+contexts:
+- name: main
+  context: {cluster: main, user: user}
+- name: other
+  context: {cluster: other, user: user}
+current-context: main
+`, name)
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJobContextBaseName(t *testing.T) {
+	saved := cli
+	t.Cleanup(func() { cli = saved })
+
+	tests := []struct {
+		jobID, projectPath string
+		want               string
+	}{
+		{"1234", "group/project", "job-1234-group-project"},
+		{"1234", "Group/Sub.Group/My_Project", "job-1234-group-sub-group-my-project"},
+		{"1234", "group/" + strings.Repeat("p", 60), "job-1234-group-" + strings.Repeat("p", maxBaseNameLength-len("job-1234-group-"))},
+		{"", "", "job"},
+	}
+	for _, tt := range tests {
+		cli.Namespace = "ci"
+		cli.LabelPrefix = labelPrefix
+		cli.APIRetryMaxInterval = time.Second
+		cli.JobID = tt.jobID
+		cli.ProjectPath = tt.projectPath
+
+		jctx, err := LoadJobContext()
+		if err != nil {
+			t.Errorf("job %q of %q: %v", tt.jobID, tt.projectPath, err)
+			continue
+		}
+		if jctx.BaseName != tt.want {
+			t.Errorf("base name of job %q of %q = %q, want %q", tt.jobID, tt.projectPath, jctx.BaseName, tt.want)
+		}
+	}
+}
+
+func TestKubeConfig(t *testing.T) {
+	home := t.TempDir()
+	writeKubeconfig(t, filepath.Join(home, ".kube"), "config")
+	flag := writeKubeconfig(t, t.TempDir(), "flag")
+	env := writeKubeconfig(t, t.TempDir(), "env")
+
+	tests := []struct {
+		name       string
+		path       string
+		context    string
+		kubeconfig string
+		inCluster  bool
+		want       string
+		wantErr    bool
+	}{
+		{name: "home", want: "https://config"},
+		{name: "KUBECONFIG", kubeconfig: env, want: "https://env"},
+		{name: "flag", path: flag, kubeconfig: env, want: "https://flag"},
+		{name: "flag in a pod", path: flag, inCluster: true, want: "https://flag"},
+		{name: "in a pod", kubeconfig: env, inCluster: true, want: "https://10.0.0.1:443"},
+		{name: "context in a pod", context: "other", kubeconfig: env, inCluster: true, want: "https://env-other"},
+		{name: "context", context: "other", want: "https://config-other"},
+		{name: "unknown context", context: "missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", home)
+			t.Setenv("KUBECONFIG", tt.kubeconfig)
+			if tt.inCluster {
+				t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+				t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+			} else {
+				t.Setenv("KUBERNETES_SERVICE_HOST", "")
+			}
+
+			config, err := KubeConfig(tt.path, tt.context)
+			if tt.want == "https://10.0.0.1:443" && errors.Is(err, os.ErrNotExist) {
+				// There is no service account token outside of a pod, which
+				// still shows that the in-cluster configuration got picked.
+				return
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("connecting to %s, want an error", config.Host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Host != tt.want {
+				t.Errorf("host = %s, want %s", config.Host, tt.want)
+			}
+		})
+	}
+}
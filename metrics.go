@@ -0,0 +1,385 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics of the Virtual Machine instances, in the Prometheus text
+// exposition format. They are always recorded, and only written out when
+// --metrics-file is set.
+//
+// Every stage of a job is a separate process, which would not live long
+// enough to be scraped, so each stage adds its values to those of the
+// metrics file as it exits, for node_exporter to serve.
+var (
+	metricVMCreated = newCounter("vm_created_total",
+		"Virtual Machine instances created.",
+		"namespace", "image")
+	metricVMFailed = newCounter("vm_failed_total",
+		"Virtual Machine instances that failed, by stage of the failure.",
+		"namespace", "image", "reason")
+	metricVMReady = newHistogram("vm_ready_duration_seconds",
+		"Time from the creation of a Virtual Machine instance to it being reachable.",
+		[]float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+		"namespace", "image")
+	metricJobDuration = newHistogram("vm_job_duration_seconds",
+		"Time from the creation of a Virtual Machine instance to its deletion.",
+		[]float64{60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400, 28800},
+		"namespace", "image")
+)
+
+// Reasons of metricVMFailed.
+const (
+	failureCreate      = "create"
+	failureStart       = "start"
+	failureTimeout     = "timeout"
+	failureUnreachable = "unreachable"
+	failureNotReady    = "not_ready"
+	failureDelete      = "delete"
+)
+
+type metric interface {
+	metricName() string
+	writeTo(w io.Writer)
+}
+
+var metricsRegistry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+}
+
+// metricLabels returns the namespace and image labels of the job.
+func metricLabels(jctx *JobContext) []string {
+	image := jctx.Image
+	switch {
+	case image != "":
+	case jctx.DataVolumeImage != "":
+		image = jctx.DataVolumeImage
+	default:
+		image = jctx.DataVolumeName
+	}
+	return []string{jctx.Namespace, image}
+}
+
+type counter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values.
+func (c *counter) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(values)]++
+}
+
+func (c *counter) metricName() string {
+	return c.name
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Observe records a duration for the given label values.
+func (h *histogram) Observe(d time.Duration, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelKey(values)
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	seconds := d.Seconds()
+	for i, le := range h.buckets {
+		if seconds <= le {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += seconds
+}
+
+func (h *histogram) metricName() string {
+	return h.name
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		v := h.values[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, key+"\xff"+formatFloat(le)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, key+"\xff+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), v.count)
+	}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteMetrics writes all metrics in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer) {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	for _, m := range metricsRegistry.metrics {
+		m.writeTo(w)
+	}
+}
+
+// metricsLockTimeout is how long to wait for concurrent jobs to be done
+// writing the metrics file, after which the lock is considered stale.
+const metricsLockTimeout = 10 * time.Second
+
+// WriteMetricsFile adds the metrics of the stage to those already in the
+// file at path, for the textfile collector of node_exporter to serve. The
+// file is replaced atomically, under a lock file shared with the other
+// jobs of the host.
+func WriteMetricsFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	unlock, err := lockMetricsFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var old []byte
+	if old, err = os.ReadFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := AccumulateMetrics(tmp, bytes.NewReader(old)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lockMetricsFile creates the lock file at path, waiting for whoever holds
+// it, and returns the function releasing it.
+func lockMetricsFile(path string) (unlock func(), err error) {
+	deadline := time.Now().Add(metricsLockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			// Whoever held it died while writing.
+			logger.Warn("breaking stale metrics lock", "lock", path)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			deadline = time.Now().Add(metricsLockTimeout)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// AccumulateMetrics writes the metrics to w like WriteMetrics, adding to
+// them the samples of old, a previous output of AccumulateMetrics. Every
+// sample that is recorded is a count or a sum, so accumulating several
+// stages adds up their samples.
+func AccumulateMetrics(w io.Writer, old io.Reader) error {
+	previous := map[string]float64{}
+	var order []string
+	scanner := bufio.NewScanner(old)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i == -1 {
+			return fmt.Errorf("invalid metrics sample %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid metrics sample %q: %w", line, err)
+		}
+		series := line[:i]
+		if _, ok := previous[series]; !ok {
+			order = append(order, series)
+		}
+		previous[series] += value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+
+	for _, m := range metricsRegistry.metrics {
+		var buf bytes.Buffer
+		m.writeTo(&buf)
+
+		name := m.metricName()
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if strings.HasPrefix(line, "#") {
+				fmt.Fprintln(w, line)
+				continue
+			}
+			i := strings.LastIndexByte(line, ' ')
+			series := line[:i]
+			value, err := strconv.ParseFloat(line[i+1:], 64)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s %s\n", series, formatFloat(value+previous[series]))
+			delete(previous, series)
+		}
+		// Series that only previous stages recorded.
+		for _, series := range order {
+			value, ok := previous[series]
+			if !ok || !sampleOf(series, name) {
+				continue
+			}
+			fmt.Fprintf(w, "%s %s\n", series, formatFloat(value))
+			delete(previous, series)
+		}
+	}
+	return nil
+}
+
+// sampleOf returns whether the series is one of those of the named metric.
+func sampleOf(series, name string) bool {
+	if i := strings.IndexByte(series, '{'); i != -1 {
+		series = series[:i]
+	}
+	switch series {
+	case name, name + "_bucket", name + "_sum", name + "_count":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gitlab-runner-kubevirt.prom")
+
+	// A series that an earlier stage recorded, but not this one.
+	earlier := `vm_failed_total{namespace="earlier",image="alpine",reason="start"} 2` + "\n"
+	if err := os.WriteFile(path, []byte(earlier), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metricVMCreated.Inc("metrics-test", "alpine")
+	metricVMReady.Observe(15*time.Second, "metrics-test", "alpine")
+	for i := 0; i < 2; i++ {
+		if err := WriteMetricsFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"# TYPE vm_created_total counter\n",
+		`vm_created_total{namespace="metrics-test",image="alpine"} 2` + "\n",
+		`vm_failed_total{namespace="earlier",image="alpine",reason="start"} 2` + "\n",
+		`vm_ready_duration_seconds_bucket{namespace="metrics-test",image="alpine",le="10"} 0` + "\n",
+		`vm_ready_duration_seconds_bucket{namespace="metrics-test",image="alpine",le="20"} 2` + "\n",
+		`vm_ready_duration_seconds_sum{namespace="metrics-test",image="alpine"} 30` + "\n",
+		`vm_ready_duration_seconds_count{namespace="metrics-test",image="alpine"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics file lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, "# TYPE vm_failed_total") != 1 {
+		t.Errorf("vm_failed_total is declared more than once:\n%s", got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files left next to the metrics file, want none", len(entries)-1)
+	}
+}
+
+func TestAccumulateMetricsInvalid(t *testing.T) {
+	for _, old := range []string{"garbage\n", "vm_created_total one\n"} {
+		if err := AccumulateMetrics(&strings.Builder{}, strings.NewReader(old)); err == nil {
+			t.Errorf("AccumulateMetrics(%q) succeeded", old)
+		}
+	}
+}
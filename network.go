@@ -0,0 +1,192 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+const primaryNetworkName = "default"
+
+// ExtraNetwork is a secondary network interface of the Virtual Machine
+// instance, attached to a Multus network attachment definition.
+type ExtraNetwork struct {
+	Name        string
+	NetworkName string
+	Binding     string
+	MACAddress  string
+}
+
+// ParseExtraNetwork parses an extra network from a comma-separated list of
+// options, e.g. "name=lab,network=lab-net,binding=bridge,mac=02:00:00:00:00:01".
+func ParseExtraNetwork(spec string) (ExtraNetwork, error) {
+	network := ExtraNetwork{Binding: "bridge"}
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			network.Name = value
+		case "network":
+			network.NetworkName = value
+		case "binding":
+			network.Binding = value
+		case "mac":
+			network.MACAddress = value
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return network, fmt.Errorf("invalid extra network %q: %w", spec, err)
+	}
+	if network.NetworkName == "" {
+		return network, fmt.Errorf("invalid extra network %q: missing network name", spec)
+	}
+	if network.Name == "" {
+		// Network attachment definitions may be namespaced.
+		network.Name = network.NetworkName[strings.LastIndex(network.NetworkName, "/")+1:]
+	}
+	return network, nil
+}
+
+// validateMAC checks that mac is a unicast MAC-48 address written as six
+// colon-separated hexadecimal octets.
+func validateMAC(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 || strings.Count(mac, ":") != 5 {
+		return fmt.Errorf("invalid MAC address %q: must be six colon-separated hexadecimal octets", mac)
+	}
+	if hw[0]&1 != 0 {
+		return fmt.Errorf("invalid MAC address %q: must be a unicast address", mac)
+	}
+	return nil
+}
+
+// jobNetworks returns the network interfaces of the Virtual Machine instance
+// of the job, and the networks backing them. Without a network binding or
+// extra networks, both are nil, and KubeVirt attaches the instance to the pod
+// network with the binding configured cluster-wide. Since KubeVirt stops
+// doing so as soon as any interface is specified, the primary interface
+// defaults to masquerade on the pod network when there are extra networks
+// or a MAC address to set.
+func jobNetworks(jctx *JobContext) ([]kubevirtapi.Interface, []kubevirtapi.Network, error) {
+	iface := kubevirtapi.Interface{Name: primaryNetworkName}
+	network := kubevirtapi.Network{Name: primaryNetworkName}
+
+	binding := jctx.NetworkBinding
+	if binding == "" && jctx.NetworkName == "" && (len(jctx.ExtraNetworks) > 0 || jctx.MACAddress != "") {
+		binding = "masquerade"
+	}
+
+	switch binding {
+	case "":
+		if jctx.NetworkName != "" {
+			return nil, nil, fmt.Errorf("network %s: a network binding must be specified", jctx.NetworkName)
+		}
+		return nil, nil, nil
+	case "masquerade":
+		if jctx.NetworkName != "" {
+			return nil, nil, fmt.Errorf("network %s: masquerade binding is only supported on the pod network", jctx.NetworkName)
+		}
+		iface.Masquerade = &kubevirtapi.InterfaceMasquerade{}
+		network.Pod = &kubevirtapi.PodNetwork{}
+	case "bridge":
+		if jctx.NetworkName == "" {
+			return nil, nil, fmt.Errorf("bridge binding requires the name of a network attachment definition")
+		}
+		iface.Bridge = &kubevirtapi.InterfaceBridge{}
+		network.Multus = &kubevirtapi.MultusNetwork{
+			NetworkName: jctx.NetworkName,
+			Default:     true,
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown network binding %q, must be masquerade or bridge", jctx.NetworkBinding)
+	}
+
+	macs := map[string]string{}
+	if jctx.MACAddress != "" {
+		if err := validateMAC(jctx.MACAddress); err != nil {
+			return nil, nil, fmt.Errorf("network interface %s: %w", primaryNetworkName, err)
+		}
+		macs[strings.ToLower(jctx.MACAddress)] = primaryNetworkName
+		iface.MacAddress = jctx.MACAddress
+	}
+
+	interfaces := []kubevirtapi.Interface{iface}
+	networks := []kubevirtapi.Network{network}
+
+	names := map[string]bool{primaryNetworkName: true}
+	for _, extra := range jctx.ExtraNetworks {
+		if errs := validation.IsDNS1123Label(extra.Name); len(errs) > 0 {
+			return nil, nil, fmt.Errorf("invalid network interface name %q: %s", extra.Name, strings.Join(errs, "; "))
+		}
+		if names[extra.Name] {
+			return nil, nil, fmt.Errorf("network interface name %q is used more than once", extra.Name)
+		}
+		names[extra.Name] = true
+
+		iface := kubevirtapi.Interface{Name: extra.Name}
+		switch extra.Binding {
+		case "bridge":
+			iface.Bridge = &kubevirtapi.InterfaceBridge{}
+		case "sriov":
+			iface.SRIOV = &kubevirtapi.InterfaceSRIOV{}
+		default:
+			return nil, nil, fmt.Errorf("network interface %s: unknown binding %q, must be bridge or sriov", extra.Name, extra.Binding)
+		}
+		if extra.MACAddress != "" {
+			if err := validateMAC(extra.MACAddress); err != nil {
+				return nil, nil, fmt.Errorf("network interface %s: %w", extra.Name, err)
+			}
+			mac := strings.ToLower(extra.MACAddress)
+			if other, ok := macs[mac]; ok {
+				return nil, nil, fmt.Errorf("network interface %s: MAC address %s is already used by %s", extra.Name, extra.MACAddress, other)
+			}
+			macs[mac] = extra.Name
+			iface.MacAddress = extra.MACAddress
+		}
+
+		interfaces = append(interfaces, iface)
+		networks = append(networks, kubevirtapi.Network{
+			Name: extra.Name,
+			NetworkSource: kubevirtapi.NetworkSource{
+				Multus: &kubevirtapi.MultusNetwork{NetworkName: extra.NetworkName},
+			},
+		})
+	}
+
+	return interfaces, networks, nil
+}
+
+// jobDNS returns the DNS policy and configuration of the Virtual Machine
+// instance of the job. Custom nameservers replace the cluster DNS entirely,
+// while search domains on their own are appended to those of the cluster.
+// Without either, the instance uses the cluster DNS.
+func jobDNS(jctx *JobContext) (k8sapi.DNSPolicy, *k8sapi.PodDNSConfig, error) {
+	if len(jctx.DNSNameservers) == 0 && len(jctx.DNSSearches) == 0 {
+		return "", nil, nil
+	}
+	for _, ns := range jctx.DNSNameservers {
+		if net.ParseIP(ns) == nil {
+			return "", nil, fmt.Errorf("invalid DNS nameserver %q: must be an IP address", ns)
+		}
+	}
+
+	config := &k8sapi.PodDNSConfig{
+		Nameservers: jctx.DNSNameservers,
+		Searches:    jctx.DNSSearches,
+	}
+	if len(jctx.DNSNameservers) == 0 {
+		return "", config, nil
+	}
+	return k8sapi.DNSNone, config, nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestJobNetworks(t *testing.T) {
+	masquerade := kubevirtapi.Interface{
+		Name:                   primaryNetworkName,
+		InterfaceBindingMethod: kubevirtapi.InterfaceBindingMethod{Masquerade: &kubevirtapi.InterfaceMasquerade{}},
+	}
+	podNetwork := kubevirtapi.Network{
+		Name:          primaryNetworkName,
+		NetworkSource: kubevirtapi.NetworkSource{Pod: &kubevirtapi.PodNetwork{}},
+	}
+
+	tests := []struct {
+		name           string
+		jctx           JobContext
+		wantInterfaces []kubevirtapi.Interface
+		wantNetworks   []kubevirtapi.Network
+		wantErr        string
+	}{
+		{name: "cluster default"},
+		{
+			name:           "masquerade",
+			jctx:           JobContext{NetworkBinding: "masquerade"},
+			wantInterfaces: []kubevirtapi.Interface{masquerade},
+			wantNetworks:   []kubevirtapi.Network{podNetwork},
+		},
+		{
+			name: "bridge",
+			jctx: JobContext{NetworkBinding: "bridge", NetworkName: "ci/lab-net"},
+			wantInterfaces: []kubevirtapi.Interface{{
+				Name:                   primaryNetworkName,
+				InterfaceBindingMethod: kubevirtapi.InterfaceBindingMethod{Bridge: &kubevirtapi.InterfaceBridge{}},
+			}},
+			wantNetworks: []kubevirtapi.Network{{
+				Name:          primaryNetworkName,
+				NetworkSource: kubevirtapi.NetworkSource{Multus: &kubevirtapi.MultusNetwork{NetworkName: "ci/lab-net", Default: true}},
+			}},
+		},
+		{
+			name: "masquerade defaulted by a MAC address",
+			jctx: JobContext{MACAddress: "02:00:00:00:00:01"},
+			wantInterfaces: []kubevirtapi.Interface{{
+				Name:                   primaryNetworkName,
+				InterfaceBindingMethod: kubevirtapi.InterfaceBindingMethod{Masquerade: &kubevirtapi.InterfaceMasquerade{}},
+				MacAddress:             "02:00:00:00:00:01",
+			}},
+			wantNetworks: []kubevirtapi.Network{podNetwork},
+		},
+		{
+			name: "masquerade defaulted by extra networks",
+			jctx: JobContext{ExtraNetworks: []ExtraNetwork{{Name: "lab", NetworkName: "lab-net", Binding: "sriov"}}},
+			wantInterfaces: []kubevirtapi.Interface{masquerade, {
+				Name:                   "lab",
+				InterfaceBindingMethod: kubevirtapi.InterfaceBindingMethod{SRIOV: &kubevirtapi.InterfaceSRIOV{}},
+			}},
+			wantNetworks: []kubevirtapi.Network{podNetwork, {
+				Name:          "lab",
+				NetworkSource: kubevirtapi.NetworkSource{Multus: &kubevirtapi.MultusNetwork{NetworkName: "lab-net"}},
+			}},
+		},
+		{
+			name:    "masquerade on a network attachment",
+			jctx:    JobContext{NetworkBinding: "masquerade", NetworkName: "lab-net"},
+			wantErr: "masquerade binding is only supported on the pod network",
+		},
+		{
+			name:    "bridge without a network attachment",
+			jctx:    JobContext{NetworkBinding: "bridge"},
+			wantErr: "bridge binding requires the name of a network attachment definition",
+		},
+		{
+			name:    "network attachment without a binding",
+			jctx:    JobContext{NetworkName: "lab-net"},
+			wantErr: "a network binding must be specified",
+		},
+		{
+			name:    "unknown binding",
+			jctx:    JobContext{NetworkBinding: "slirp"},
+			wantErr: `unknown network binding "slirp"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interfaces, networks, err := jobNetworks(&tt.jctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(interfaces, tt.wantInterfaces) {
+				t.Errorf("interfaces = %+v, want %+v", interfaces, tt.wantInterfaces)
+			}
+			if !reflect.DeepEqual(networks, tt.wantNetworks) {
+				t.Errorf("networks = %+v, want %+v", networks, tt.wantNetworks)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMNetworkBinding(t *testing.T) {
+	cmd := testPrepareCmd(t, "--default-network-binding=bridge", "--default-network-name=lab-net")
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+
+	vm := createTestVM(t, c, jctx, &rc)
+	interfaces := vm.Spec.Domain.Devices.Interfaces
+	if len(interfaces) != 1 || interfaces[0].Name != primaryNetworkName || interfaces[0].Bridge == nil {
+		t.Errorf("interfaces = %+v, want a bridged %s interface", interfaces, primaryNetworkName)
+	}
+	networks := vm.Spec.Networks
+	if len(networks) != 1 || networks[0].Name != primaryNetworkName || networks[0].Multus == nil || networks[0].Multus.NetworkName != "lab-net" {
+		t.Errorf("networks = %+v, want the lab-net %s network", networks, primaryNetworkName)
+	}
+}
+
+func TestJobDNS(t *testing.T) {
+	tests := []struct {
+		name                string
+		nameservers, search []string
+		wantPolicy          k8sapi.DNSPolicy
+		wantConfig          *k8sapi.PodDNSConfig
+		wantErr             string
+	}{
+		{name: "none"},
+		{
+			name:        "nameservers",
+			nameservers: []string{"10.0.0.53", "fd00::53"},
+			wantPolicy:  k8sapi.DNSNone,
+			wantConfig:  &k8sapi.PodDNSConfig{Nameservers: []string{"10.0.0.53", "fd00::53"}},
+		},
+		{
+			name:       "search domains",
+			search:     []string{"corp.example"},
+			wantConfig: &k8sapi.PodDNSConfig{Searches: []string{"corp.example"}},
+		},
+		{
+			name:        "both",
+			nameservers: []string{"10.0.0.53"},
+			search:      []string{"corp.example"},
+			wantPolicy:  k8sapi.DNSNone,
+			wantConfig:  &k8sapi.PodDNSConfig{Nameservers: []string{"10.0.0.53"}, Searches: []string{"corp.example"}},
+		},
+		{name: "hostname nameserver", nameservers: []string{"dns.example"}, wantErr: `invalid DNS nameserver "dns.example"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jctx := &JobContext{DNSNameservers: tt.nameservers, DNSSearches: tt.search}
+			policy, config, err := jobDNS(jctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy != tt.wantPolicy {
+				t.Errorf("policy = %q, want %q", policy, tt.wantPolicy)
+			}
+			if !reflect.DeepEqual(config, tt.wantConfig) {
+				t.Errorf("config = %+v, want %+v", config, tt.wantConfig)
+			}
+		})
+	}
+
+	// The policy only replaces the default one of the cluster in the spec
+	// when there are nameservers.
+	specs := []struct {
+		args       []string
+		wantPolicy k8sapi.DNSPolicy
+		wantConfig bool
+	}{
+		{},
+		{args: []string{"--default-dns-searches=corp.example"}, wantConfig: true},
+		{args: []string{"--default-dns-nameservers=10.0.0.53"}, wantPolicy: k8sapi.DNSNone, wantConfig: true},
+	}
+	for _, tt := range specs {
+		cmd := testPrepareCmd(t, tt.args...)
+		c := newFakeCluster(t)
+		jctx := testJobContext(t, cmd)
+		rc := cmd.RunConfig
+		vm := createTestVM(t, c, jctx, &rc)
+		if vm.Spec.DNSPolicy != tt.wantPolicy {
+			t.Errorf("%v: DNS policy = %q, want %q", tt.args, vm.Spec.DNSPolicy, tt.wantPolicy)
+		}
+		if (vm.Spec.DNSConfig != nil) != tt.wantConfig {
+			t.Errorf("%v: DNS config = %+v, want one: %v", tt.args, vm.Spec.DNSConfig, tt.wantConfig)
+		}
+	}
+}
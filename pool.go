@@ -0,0 +1,300 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"barney.ci/shutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Instances of a warm pool outlive their jobs: rather than being deleted,
+// they get their builds and cache directories wiped at cleanup, and wait for
+// the next job of the same project with the same image and resources to
+// claim them.
+//
+// Besides the id label, which always identifies the job holding the
+// instance, pool members carry the name of their pool, the profile of the
+// jobs they can run, and whether they are idle or claimed. Idle instances
+// get an id of their own, so that they never match the Selector of a job.
+
+const (
+	poolStateIdle    = "idle"
+	poolStateClaimed = "claimed"
+)
+
+// PoolConfig configures the warm pool of Virtual Machine instances. The
+// prepare and cleanup stages need the same one, so it is best set at the
+// top level of the configuration file.
+type PoolConfig struct {
+	Name string `name:"name" help:"name of the warm pool of reusable Virtual Machine instances that jobs claim an idle instance from, and return theirs to at cleanup, rather than creating and deleting one each; disabled when empty"`
+	Size int    `name:"size" default:"1" help:"maximum number of Virtual Machine instances of the same project, image and resources kept in the pool; the instances of jobs that would go past it are deleted"`
+}
+
+// poolProfile returns a digest of what the Virtual Machine instance of the
+// job is made of, and of how the job reaches it, which jobs must share to
+// reuse an instance. Everything but what is specific to the job or to the
+// stage at hand takes part in it, so that no setting reaching the instance
+// can be left out. The project is part of it too: a job can leave anything
+// behind outside of the directories that get wiped, so instances never cross
+// from one project to another.
+func poolProfile(jctx *JobContext, rc *RunConfig) (string, error) {
+	profile := *jctx
+	profile.ID = ""
+	profile.BaseName = ""
+	profile.Pool = ""
+	profile.PoolProfile = ""
+	profile.DryRun = false
+	profile.CaptureConsole = false
+	profile.ConsoleLog = ""
+	profile.CheckImage = false
+	profile.CheckImageTimeout = 0
+	profile.CreateTimeout = 0
+	profile.KeepOnFailure = false
+	profile.KeepTTL = 0
+	profile.JobTimeout = 0
+	profile.Deadline = time.Time{}
+	profile.APIRetries = 0
+	profile.APIRetryMaxInterval = 0
+	profile.FindTimeout = 0
+	profile.PipelineID = ""
+	profile.JobID = ""
+	profile.JobName = ""
+	profile.JobRef = ""
+	profile.JobSha = ""
+	profile.JobBeforeSha = ""
+	profile.JobURL = ""
+
+	data, err := json.Marshal(struct {
+		Job JobContext
+		Run RunConfig
+	}{profile, *rc})
+	if err != nil {
+		return "", err
+	}
+	return digest(sha1.New, data)[:16], nil
+}
+
+// poolLabels returns the labels of a Virtual Machine instance of the pool
+// of the job, in the given state.
+func poolLabels(jctx *JobContext, state string) map[string]string {
+	return map[string]string{
+		jobLabel(jctx, "pool"):         jctx.Pool,
+		jobLabel(jctx, "pool-profile"): jctx.PoolProfile,
+		jobLabel(jctx, "pool-state"):   state,
+	}
+}
+
+// idleID returns the id label of an idle member of a pool.
+func idleID(vm *kubevirtapi.VirtualMachineInstance) string {
+	return "idle-" + string(vm.ObjectMeta.UID)
+}
+
+// ClaimPoolVM claims a running idle Virtual Machine instance of the pool of
+// the job, and hands over its ssh key secret, if any. It returns nil if
+// there are none. The claim fails if the instance changed since it was
+// listed, so that concurrent jobs never claim the same one.
+func ClaimPoolVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (*kubevirtapi.VirtualMachineInstance, error) {
+	selector := metav1.FormatLabelSelector(metav1.SetAsLabelSelector(poolLabels(jctx, poolStateIdle)))
+	list, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, &metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("listing pool %s: %w", jctx.Pool, err)
+	}
+
+	for i := range list.Items {
+		vm := &list.Items[i]
+		if vm.ObjectMeta.DeletionTimestamp != nil || vm.Status.Phase != kubevirtapi.Running {
+			continue
+		}
+		labels := poolLabels(jctx, poolStateClaimed)
+		labels[jobLabel(jctx, "id")] = jctx.ID
+		labels[jobLabel(jctx, "project")] = sanitizeLabelValue(jctx.ProjectID)
+		labels[jobLabel(jctx, "pipeline")] = sanitizeLabelValue(jctx.PipelineID)
+		labels[jobLabel(jctx, "job")] = sanitizeLabelValue(jctx.JobID)
+
+		claimed, err := patchPoolVM(ctx, client, vm, labels)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			logger.Debug("pool instance claimed by another job", "vmi", vm.ObjectMeta.Name)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("claiming Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
+		}
+		if err := relabelJobSSHKey(ctx, client, jctx, vm.ObjectMeta.Labels[jobLabel(jctx, "id")], jctx.ID); err != nil {
+			return claimed, fmt.Errorf("claiming ssh key of Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
+		}
+		logger.Info("claimed Virtual Machine instance from pool", "vmi", vm.ObjectMeta.Name, "pool", jctx.Pool)
+		return claimed, nil
+	}
+	return nil, nil
+}
+
+// ReleasePoolVM returns the Virtual Machine instance of the job to its
+// pool, after wiping the directories of dirs. It fails if the instance cannot be
+// reused, in which case it should be deleted instead.
+func ReleasePoolVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	pool PoolConfig,
+	dirs Dirs,
+) error {
+	jctx.Pool = vm.ObjectMeta.Labels[jobLabel(jctx, "pool")]
+	jctx.PoolProfile = vm.ObjectMeta.Labels[jobLabel(jctx, "pool-profile")]
+	switch {
+	case jctx.Pool != pool.Name:
+		return fmt.Errorf("it belongs to pool %q rather than %q", jctx.Pool, pool.Name)
+	case dirs.BuildsDir == "":
+		return fmt.Errorf("resetting it requires --builds-dir")
+	case vm.Status.Phase != kubevirtapi.Running:
+		return fmt.Errorf("it is not running (phase: %v)", vm.Status.Phase)
+	}
+
+	selector := fmt.Sprintf("%s=%s,%s=%s",
+		jobLabel(jctx, "pool"), jctx.Pool,
+		jobLabel(jctx, "pool-profile"), jctx.PoolProfile)
+	members, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, &metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("listing pool %s: %w", jctx.Pool, err)
+	}
+	if len(members.Items) > pool.Size {
+		return fmt.Errorf("pool %s is full (%d instances, size %d)", jctx.Pool, len(members.Items), pool.Size)
+	}
+
+	if err := resetPoolVM(ctx, client, jctx, vm, dirs); err != nil {
+		return fmt.Errorf("resetting it: %w", err)
+	}
+
+	id := idleID(vm)
+	if err := relabelJobSSHKey(ctx, client, jctx, jctx.ID, id); err != nil {
+		return fmt.Errorf("releasing its ssh key: %w", err)
+	}
+	labels := poolLabels(jctx, poolStateIdle)
+	labels[jobLabel(jctx, "id")] = id
+	err = retryConflicts("releasing Virtual Machine instance", func() error {
+		latest, err := client.VirtualMachineInstance(jctx.Namespace).Get(ctx, vm.ObjectMeta.Name, &metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		_, err = patchPoolVM(ctx, client, latest, labels)
+		return err
+	})
+	if err != nil {
+		if err := relabelJobSSHKey(ctx, client, jctx, id, jctx.ID); err != nil {
+			logger.Warn("taking back ssh key", "vmi", vm.ObjectMeta.Name, "err", err)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Returned Virtual Machine instance %v to pool %v\n", vm.ObjectMeta.Name, jctx.Pool)
+	return nil
+}
+
+// resetPoolVM wipes the builds and cache directories of the Virtual Machine
+// instance.
+func resetPoolVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, dirs Dirs) error {
+	var rc RunConfig
+	if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err != nil {
+		return err
+	}
+	if rc.GuestOS != "linux" {
+		return fmt.Errorf("only linux guests can be reset")
+	}
+
+	conn, err := Connect(ctx, client, jctx, vm, &rc, DialOptions{
+		Timeout:      10 * time.Second,
+		RetryTimeout: time.Minute,
+		PollInterval: 5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	wiped := poolResetDirs(dirs)
+	fmt.Fprintf(os.Stderr, "Wiping %v\n", strings.Join(wiped, ", "))
+	out, err := conn.RunCommand(ctx, shutil.Quote(append([]string{"rm", "-rf", "--"}, wiped...)))
+	if err != nil {
+		return fmt.Errorf("wiping %s: %w: %s", strings.Join(wiped, ", "), err, out)
+	}
+	return nil
+}
+
+// poolResetDirs returns the directories of dirs to wipe before an instance
+// is returned to its pool.
+func poolResetDirs(dirs Dirs) []string {
+	wiped := []string{path.Clean(dirs.BuildsDir)}
+	if dirs.CacheDir != "" {
+		wiped = append(wiped, path.Clean(dirs.CacheDir))
+	}
+	return wiped
+}
+
+// patchPoolVM sets labels on the Virtual Machine instance, refreshes its
+// heartbeat, and forgets the failure of its previous job, if any. The
+// heartbeat of idle instances is when they went idle, for the reaper to only
+// delete those that nobody claimed for a while; setting it along with the
+// labels keeps the reaper from ever seeing an instance that just went idle
+// with the heartbeat of its last job. The patch fails with a conflict if the
+// instance changed since vm was read, so that concurrent writers never
+// overwrite the labels of one another.
+func patchPoolVM(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, labels map[string]string) (*kubevirtapi.VirtualMachineInstance, error) {
+	metadata := map[string]interface{}{
+		"labels": labels,
+		"annotations": map[string]interface{}{
+			HeartbeatKey:   time.Now().UTC().Format(time.RFC3339),
+			FailedStageKey: nil,
+		},
+		"resourceVersion": vm.ObjectMeta.ResourceVersion,
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.VirtualMachineInstance(vm.ObjectMeta.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+}
+
+// relabelJobSSHKey moves the ssh key secret generated for a Virtual Machine
+// instance from one id to another, since FindJobSSHKey looks it up by id.
+func relabelJobSSHKey(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, from, to string) error {
+	list, err := client.CoreV1().Secrets(jctx.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", jobLabel(jctx, "id"), from),
+	})
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				jobLabel(jctx, "id"): to,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, secret := range list.Items {
+		_, err := client.CoreV1().Secrets(jctx.Namespace).Patch(ctx, secret.ObjectMeta.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
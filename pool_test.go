@@ -0,0 +1,243 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	k8sapi "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestPoolProfile(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	base := testJobContext(t, cmd)
+	base.Image = ""
+	base.DataVolumeImage = "registry.example/os/ubuntu:22.04"
+	base.DataVolumeSize = "20Gi"
+
+	profile := func(t *testing.T, jctx *JobContext, rc *RunConfig) string {
+		t.Helper()
+		p, err := poolProfile(jctx, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	want := profile(t, base, &cmd.RunConfig)
+
+	changes := []struct {
+		name string
+		job  func(*JobContext)
+		run  func(*RunConfig)
+	}{
+		{name: "data volume image", job: func(j *JobContext) { j.DataVolumeImage = "registry.example/os/fedora:38" }},
+		{name: "data volume name", job: func(j *JobContext) { j.DataVolumeImage = ""; j.DataVolumeName = "golden" }},
+		{name: "containerdisk image", job: func(j *JobContext) { j.DataVolumeImage = ""; j.Image = "registry.example/os/ubuntu:22.04" }},
+		{name: "cloud-init user-data", job: func(j *JobContext) { j.CloudInitUserData = "#cloud-config\n" }},
+		{name: "cloud-init network-config", job: func(j *JobContext) { j.CloudInitNetworkData = "version: 2\n" }},
+		{name: "extra volume", job: func(j *JobContext) { j.ExtraVolumes = []ExtraVolume{{Name: "cache", ClaimName: "cache"}} }},
+		{name: "scratch disk", job: func(j *JobContext) { j.ScratchDisks = []ScratchDisk{{Name: "scratch"}} }},
+		{name: "secret volume", job: func(j *JobContext) { j.SecretVolumes = []SecretVolume{{Name: "creds", SecretName: "creds"}} }},
+		{name: "node selector", job: func(j *JobContext) { j.NodeSelector = map[string]string{"zone": "a"} }},
+		{name: "tolerations", job: func(j *JobContext) {
+			j.Tolerations = []k8sapi.Toleration{{Key: "ci", Operator: k8sapi.TolerationOpExists}}
+		}},
+		{name: "firmware", job: func(j *JobContext) { j.Firmware = "efi" }},
+		{name: "root cache", job: func(j *JobContext) { j.RootCache = "writeback" }},
+		{name: "network", job: func(j *JobContext) { j.NetworkName = "bridge" }},
+		{name: "guest memory", job: func(j *JobContext) { j.GuestMemory = "512Mi" }},
+		{name: "ssh user", run: func(rc *RunConfig) { rc.SSH.User = "other" }},
+		{name: "ssh password", run: func(rc *RunConfig) { rc.SSH.Password = "hunter2" }},
+		{name: "shell", run: func(rc *RunConfig) { rc.Shell = "bash" }},
+		{name: "guest os", run: func(rc *RunConfig) { rc.GuestOS = "windows" }},
+		{name: "project", job: func(j *JobContext) { j.ProjectID = "3" }},
+	}
+	for _, tt := range changes {
+		t.Run(tt.name, func(t *testing.T) {
+			jctx := *base
+			rc := cmd.RunConfig
+			if tt.job != nil {
+				tt.job(&jctx)
+			}
+			if tt.run != nil {
+				tt.run(&rc)
+			}
+			if got := profile(t, &jctx, &rc); got == want {
+				t.Errorf("profile did not change: %s", got)
+			}
+		})
+	}
+
+	// Jobs of the same project that only differ in who they are share
+	// their instances.
+	jctx := *base
+	jctx.ID = "fedcba9876543210"
+	jctx.BaseName = "runner-2-project-3-concurrent-1-"
+	jctx.PipelineID = "42"
+	jctx.JobID = "1234"
+	jctx.JobName = "test"
+	jctx.JobURL = "https://gitlab.example/p/-/jobs/1234"
+	jctx.Deadline = time.Now().Add(time.Hour)
+	jctx.JobTimeout = time.Hour
+	jctx.Pool = "default"
+	jctx.PoolProfile = "previous"
+	if got := profile(t, &jctx, &cmd.RunConfig); got != want {
+		t.Errorf("profile of another job = %s, want %s", got, want)
+	}
+}
+
+func TestPoolResetDirs(t *testing.T) {
+	tests := []struct {
+		dirs Dirs
+		want []string
+	}{
+		{Dirs{BuildsDir: "/builds/"}, []string{"/builds"}},
+		{Dirs{BuildsDir: "/builds", CacheDir: "/cache/./"}, []string{"/builds", "/cache"}},
+	}
+	for _, tt := range tests {
+		if got := poolResetDirs(tt.dirs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("poolResetDirs(%+v) = %q, want %q", tt.dirs, got, tt.want)
+		}
+	}
+}
+
+func TestPoolProfileImageDigest(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	jctx := testJobContext(t, cmd)
+
+	profiles := map[string]string{}
+	for _, image := range []string{
+		"registry.example/ci/image:1",
+		pinImage("registry.example/ci/image:1", "sha256:"+strings.Repeat("1", 64)),
+		pinImage("registry.example/ci/image:1", "sha256:"+strings.Repeat("2", 64)),
+	} {
+		j := *jctx
+		j.Image = image
+		profile, err := poolProfile(&j, &cmd.RunConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := profiles[profile]; ok {
+			t.Errorf("%s and %s share the profile %s", other, image, profile)
+		}
+		profiles[profile] = image
+	}
+}
+
+func TestClaimPoolVMRace(t *testing.T) {
+	for _, size := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%d idle", size), func(t *testing.T) {
+			cmd := testPrepareCmd(t)
+			base := testJobContext(t, cmd)
+			base.Pool = "default"
+			base.PoolProfile = "0123456789abcdef"
+
+			var (
+				mu    sync.Mutex
+				store = map[string]*kubevirtapi.VirtualMachineInstance{}
+				idle  kubevirtapi.VirtualMachineInstanceList
+			)
+			for i := 0; i < size; i++ {
+				vm := kubevirtapi.VirtualMachineInstance{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            fmt.Sprintf("runner-pool-%d", i),
+						Namespace:       "ci",
+						UID:             types.UID(fmt.Sprintf("uid-%d", i)),
+						ResourceVersion: "1",
+						Labels:          poolLabels(base, poolStateIdle),
+					},
+					Status: kubevirtapi.VirtualMachineInstanceStatus{Phase: kubevirtapi.Running},
+				}
+				vm.ObjectMeta.Labels[jobLabel(base, "id")] = idleID(&vm)
+				store[vm.ObjectMeta.Name] = vm.DeepCopy()
+				idle.Items = append(idle.Items, vm)
+			}
+
+			// Both claimers list the pool before either claims anything, so
+			// that they go for the same instances.
+			var listed sync.WaitGroup
+			listed.Add(2)
+			c := newFakeCluster(t)
+			c.VMIs.EXPECT().List(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+				func(context.Context, *metav1.ListOptions) (*kubevirtapi.VirtualMachineInstanceList, error) {
+					listed.Done()
+					listed.Wait()
+					return idle.DeepCopy(), nil
+				})
+			c.VMIs.EXPECT().Patch(gomock.Any(), gomock.Any(), types.MergePatchType, gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+				func(_ context.Context, name string, _ types.PatchType, data []byte, _ *metav1.PatchOptions, _ ...string) (*kubevirtapi.VirtualMachineInstance, error) {
+					var patch struct {
+						Metadata metav1.ObjectMeta `json:"metadata"`
+					}
+					if err := json.Unmarshal(data, &patch); err != nil {
+						t.Error(err)
+						return nil, err
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					vm := store[name]
+					if patch.Metadata.ResourceVersion != vm.ObjectMeta.ResourceVersion {
+						return nil, apierrors.NewConflict(kubevirtapi.Resource("virtualmachineinstances"), name, errors.New("object was modified"))
+					}
+					for k, v := range patch.Metadata.Labels {
+						vm.ObjectMeta.Labels[k] = v
+					}
+					vm.ObjectMeta.ResourceVersion += "1"
+					return vm.DeepCopy(), nil
+				})
+
+			claims := make([]*kubevirtapi.VirtualMachineInstance, 2)
+			var wg sync.WaitGroup
+			for i := range claims {
+				jctx := *base
+				jctx.ID = fmt.Sprintf("job%d", i)
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					claimed, err := ClaimPoolVM(context.Background(), c, &jctx)
+					if err != nil {
+						t.Error(err)
+					}
+					claims[i] = claimed
+				}(i)
+			}
+			wg.Wait()
+
+			owners := map[string]string{}
+			for _, claimed := range claims {
+				if claimed == nil {
+					continue
+				}
+				id := claimed.ObjectMeta.Labels[jobLabel(base, "id")]
+				if other, ok := owners[claimed.ObjectMeta.Name]; ok {
+					t.Errorf("%s claimed by both %s and %s", claimed.ObjectMeta.Name, other, id)
+				}
+				owners[claimed.ObjectMeta.Name] = id
+			}
+			if len(owners) != size {
+				t.Errorf("%d instances claimed, want %d", len(owners), size)
+			}
+			for name, id := range owners {
+				if got := store[name].ObjectMeta.Labels[jobLabel(base, "id")]; got != id {
+					t.Errorf("%s belongs to %s, but %s claimed it", name, got, id)
+				}
+			}
+		})
+	}
+}
@@ -7,46 +7,226 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/util/validation"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
 type PrepareCmd struct {
 	DefaultImage                   string        `name:"default-image"`
-	DefaultImagePullPolicy         string        `name:"default-image-pull-policy"`
-	DefaultImagePullSecret         string        `name:"default-image-pull-secret"`
+	DefaultImagePullPolicy         string        `name:"default-image-pull-policy" help:"pull policy of the containerdisk and service images: Always, IfNotPresent or Never; defaults to Always for the latest tag, and IfNotPresent otherwise"`
+	DefaultImagePullSecrets        []string      `name:"default-image-pull-secret" sep:"," help:"comma-separated names of existing registry secrets used to pull the containerdisk image"`
 	DefaultCPURequest              string        `name:"default-cpu-request" default:"1"`
 	DefaultCPULimit                string        `name:"default-cpu-limit" default:"1"`
 	DefaultMemoryRequest           string        `name:"default-memory-request" default:"1Gi"`
 	DefaultMemoryLimit             string        `name:"default-memory-limit" default:"1Gi"`
+	DefaultGuestMemory             string        `name:"default-guest-memory" help:"memory seen by the guest, at most the memory limit, e.g. to leave room in the limit for the overhead of the virt-launcher pod; defaults to the memory request"`
 	DefaultEphemeralStorageRequest string        `name:"default-ephemeral-storage-request"`
 	DefaultEphemeralStorageLimit   string        `name:"default-ephemeral-storage-limit"`
 	DefaultTimezone                string        `name:"default-timezone" default:"Etc/UTC" env:"CUSTOM_ENV_VM_TIMEZONE"`
-	DefaultCloudInitBase64         string        `name:"default-cloudinit-base64"`
+	DefaultCloudInit               string        `name:"default-cloudinit" xor:"cloudinit" help:"cloud-init user-data, inline or as a path to a file"`
+	DefaultCloudInitBase64         string        `name:"default-cloudinit-base64" xor:"cloudinit"`
+	DefaultCloudInitNetworkData    string        `name:"default-cloudinit-network-data" help:"cloud-init network-config, e.g. a version 2 configuration giving static addresses, inline or as a path to a file, and possibly base64-encoded"`
+	DefaultDataVolume              string        `name:"default-data-volume"`
+	DefaultDataVolumeImage         string        `name:"default-data-volume-image"`
+	DefaultDataVolumeSize          string        `name:"default-data-volume-size"`
+	DefaultRootBootOrder           uint          `name:"default-root-boot-order" help:"position of the root disk in the boot order, starting from 1; only needed when another disk has a boot order, as disks without one are not booted from then"`
+	FatalReasons                   []string      `name:"fatal-reasons" sep:"," default:"ErrImagePull,ImagePullBackOff,InvalidImageName,ErrImageNeverPull,Unschedulable" help:"Pod and Virtual Machine instance condition reasons that abort the job instead of waiting"`
 	Timeout                        time.Duration `name:"timeout" default:"1h"`
+	UseVirtualMachine              bool          `name:"use-virtual-machine" help:"create the Virtual Machine instance through a VirtualMachine, which restarts it when it fails"`
+	MaxRestarts                    int           `name:"max-restarts" default:"3" help:"how many times the VirtualMachine may restart its instance before it becomes ready, with --use-virtual-machine"`
+	CreateTimeout                  time.Duration `name:"create-timeout" help:"how long to try creating the Virtual Machine instance for, retries included; unbounded when zero"`
 	DialTimeout                    time.Duration `default:"10s"`
+	HeartbeatInterval              time.Duration `default:"1m" help:"how often to refresh the heartbeat of the Virtual Machine instance while waiting for it to be ready; disabled when zero"`
+
+	ReadinessMode         string        `name:"readiness-mode" default:"phase" enum:"phase,agent,ssh" help:"when to consider the Virtual Machine instance ready: once it reports being ready (phase), once its guest agent has connected (agent), or once it accepts ssh connections (ssh)"`
+	ReadinessTimeout      time.Duration `name:"readiness-timeout" help:"how long to wait for the Virtual Machine instance to accept ssh connections; defaults to --timeout"`
+	ReadinessPollInterval time.Duration `name:"readiness-poll-interval" default:"5s" help:"maximum time between two ssh connection attempts"`
+
+	ReadinessCommand         string        `name:"readiness-command" help:"command to run over ssh once the Virtual Machine instance is reachable, until it succeeds, e.g. 'systemctl is-active docker'"`
+	ReadinessCommandInterval time.Duration `name:"readiness-command-interval" default:"5s" help:"time between two runs of --readiness-command"`
+	ReadinessCommandTimeout  time.Duration `name:"readiness-command-timeout" help:"how long to wait for --readiness-command to succeed; defaults to --timeout"`
+
+	PreScript string `name:"pre-script" type:"existingfile" help:"local script to run on the Virtual Machine instance once it is ready, before the scripts of the job, e.g. to mount a cache or install a toolchain; its failure is a system failure"`
+
+	CaptureConsole bool   `name:"capture-console" help:"copy the serial console of the Virtual Machine instance to the job log, or to --console-log, until it is ready"`
+	ConsoleLog     string `name:"console-log" help:"file to capture the serial console to instead of the job log"`
+
+	DryRun bool `name:"dry-run" help:"validate the configuration and print the Virtual Machine instance that would be created as YAML, without creating anything"`
+
+	AllowedImages []string `name:"allowed-images" sep:"," env:"KUBEVIRT_ALLOWED_IMAGES" help:"comma-separated glob patterns of the containerdisk images that jobs may use, e.g. registry.internal/ci/*; anything goes when empty"`
+
+	CheckImage        bool          `name:"check-image" help:"query the registry for the manifest of the containerdisk image before creating the Virtual Machine instance, failing right away if it does not exist"`
+	CheckImageTimeout time.Duration `name:"check-image-timeout" default:"10s" help:"how long to wait for the registry with --check-image or --resolve-image-digest"`
+
+	ResolveImageDigest bool `name:"resolve-image-digest" help:"pin the containerdisk image to the digest that its tag points to when the job is prepared, so that the job boots the same image however long it takes; the image is used as is if the registry does not tell"`
+
+	DefaultNetworkBinding string `name:"default-network-binding" help:"binding of the primary network interface: masquerade on the pod network, or bridge on --default-network-name; defaults to the cluster default"`
+	DefaultNetworkName    string `name:"default-network-name" help:"name of the Multus network attachment definition to bridge the primary network interface to"`
+	DefaultMACAddress     string `name:"default-mac-address" help:"MAC address of the primary network interface, e.g. 02:00:00:00:00:01; assigned by KubeVirt when unset"`
+
+	DefaultDNSNameservers []string `name:"default-dns-nameservers" sep:"," help:"comma-separated IP addresses of the nameservers of the guest, replacing the cluster DNS"`
+	DefaultDNSSearches    []string `name:"default-dns-searches" sep:"," help:"comma-separated DNS search domains of the guest"`
+
+	ClusterDomain string `name:"cluster-domain" default:"cluster.local" help:"DNS domain of the cluster, under which the guest resolves the services of the job"`
+
+	DefaultExtraNetworks []string `name:"default-extra-network" sep:"none" help:"attach a secondary network interface to a Multus network attachment definition, e.g. name=lab,network=lab-net,binding=bridge,mac=02:00:00:00:00:01; can be repeated"`
+
+	Labels      map[string]string `name:"labels" mapsep:"," env:"KUBEVIRT_LABELS" help:"comma-separated key=value labels to add to the Virtual Machine instance"`
+	Annotations map[string]string `name:"annotations" mapsep:"," env:"KUBEVIRT_ANNOTATIONS" help:"comma-separated key=value annotations to add to the Virtual Machine instance"`
+
+	DefaultNodeSelector map[string]string `name:"default-node-selector" mapsep:"," env:"KUBEVIRT_NODE_SELECTOR" help:"comma-separated key=value node labels that the Virtual Machine instance must be scheduled on"`
+	DefaultTolerations  []string          `name:"default-tolerations" sep:"," env:"KUBEVIRT_TOLERATIONS" help:"comma-separated node taints to tolerate, as key[=value][:Effect], or * to tolerate everything"`
+	DefaultGPUs         []string          `name:"default-gpus" sep:"," env:"KUBEVIRT_GPUS" help:"comma-separated GPUs to attach, as name:deviceName, where deviceName is a permitted host device resource name"`
+	DefaultHostDevices  []string          `name:"default-host-devices" sep:"," env:"KUBEVIRT_HOST_DEVICES" help:"comma-separated host devices to pass through, as name:deviceName, where deviceName is a permitted host device resource name"`
+
+	DefaultAffinity   string `name:"default-affinity" help:"node and pod affinity of the Virtual Machine instance, as the YAML or JSON of a Kubernetes Affinity, inline or as a path to a file"`
+	SpreadAcrossNodes bool   `name:"spread-across-nodes" help:"prefer scheduling the Virtual Machine instance on nodes running no other instance of this runner fleet"`
+
+	// The resulting number of vCPUs (sockets × cores × threads) must match
+	// the CPU limit when one is set.
+	DefaultCPUSockets uint32 `name:"default-cpu-sockets" help:"number of CPU sockets of the guest"`
+	DefaultCPUCores   uint32 `name:"default-cpu-cores" help:"number of CPU cores per socket of the guest"`
+	DefaultCPUThreads uint32 `name:"default-cpu-threads" help:"number of CPU threads per core of the guest"`
+
+	RequestMultiplier float64 `name:"request-multiplier" default:"1" help:"multiply the CPU and memory requests of the Virtual Machine instances by this factor, between 0 and 1, leaving their limits and the memory seen by the guest alone, so that more of them fit on a node; without a CPU limit or topology, the guest gets as many vCPUs as its unscaled CPU request; ignored with dedicated CPUs"`
+	AllowOvercommit   bool    `name:"allow-overcommit" help:"only set the CPU and memory limits that jobs request explicitly, ignoring --default-cpu-limit and --default-memory-limit, so that the Virtual Machine instances may be overcommitted"`
+
+	DefaultDedicatedCPU bool `name:"default-dedicated-cpu" help:"pin the vCPUs of the guest to dedicated host CPUs; requires CPU and memory requests to equal their limits"`
+	DefaultGuestNUMA    bool `name:"default-guest-numa" help:"give the guest a NUMA topology matching the one of its dedicated host CPUs; requires --default-dedicated-cpu and hugepages"`
+
+	DefaultArch         string   `name:"default-arch" help:"CPU architecture of the guest: amd64 or arm64; defaults to amd64"`
+	DefaultMachineType  string   `name:"default-machine-type" help:"machine type of the guest; defaults to q35 on amd64, and virt on arm64"`
+	AllowedMachineTypes []string `name:"allowed-machine-types" sep:"," default:"amd64:q35,amd64:pc-q35-*,arm64:virt,arm64:virt-*" help:"comma-separated arch:pattern glob patterns of the machine types that guests may use, per architecture; anything goes when empty"`
+
+	DefaultEvictionStrategy       string        `name:"default-eviction-strategy" help:"what to do with the Virtual Machine instance when its node gets drained: None, LiveMigrate or External; defaults to the cluster default"`
+	DefaultPriorityClass          string        `name:"default-priority-class" help:"name of the PriorityClass of the Virtual Machine instance, e.g. to make it preemptible; defaults to the cluster default"`
+	DefaultSchedulerName          string        `name:"default-scheduler-name" help:"name of the scheduler placing the Virtual Machine instance; defaults to the default scheduler"`
+	DefaultHostname               string        `name:"default-hostname" help:"hostname of the guest; defaults to the name of the Virtual Machine instance"`
+	DefaultSubdomain              string        `name:"default-subdomain" help:"subdomain of the guest, which then resolves as <hostname>.<subdomain>.<namespace>.svc through a headless Service of that name selecting it"`
+	DefaultTerminationGracePeriod time.Duration `name:"default-termination-grace-period" default:"-1s" help:"time given to the guest to shut down when the Virtual Machine instance is deleted, unless cleanup overrides it; negative values use the KubeVirt default"`
+
+	DefaultFirmware          string `name:"default-firmware" help:"firmware of the guest: bios or efi; defaults to efi on arm64, and to the KubeVirt default (bios) otherwise"`
+	DefaultSecureBoot        bool   `name:"default-secure-boot" help:"enable Secure Boot; requires EFI firmware"`
+	DefaultSMBIOS            SMBIOS `embed:"" prefix:"default-smbios-"`
+	DefaultTPM               bool   `name:"default-tpm" help:"attach an emulated TPM device to the guest"`
+	DefaultRNG               bool   `name:"default-rng" default:"true" negatable:"" help:"attach a virtio RNG device feeding the entropy of the host to the guest, which otherwise may take long to gather enough of it after booting"`
+	DefaultMemBalloon        bool   `name:"default-memory-balloon" help:"attach a virtio memory balloon device to the guest, through which the host can reclaim the memory it does not use; defaults to the choice of KubeVirt, which attaches one unless configured otherwise"`
+	DefaultFreePageReporting bool   `name:"default-free-page-reporting" help:"have the guest report its free memory to the host through the balloon device, so that the host reclaims it right away; requires --default-memory-balloon, and a KubeVirt version supporting it"`
+	DefaultWatchdog          string `name:"default-watchdog" help:"attach an i6300esb watchdog device, taking this action when the guest stops petting it: poweroff, reset or shutdown; requires a watchdog daemon in the guest"`
+
+	DefaultIOThreadsPolicy     string `name:"default-io-threads-policy" help:"run the disk I/O of the guest on I/O threads rather than the main thread: shared, for a single one, or auto, for a pool; defaults to shared when a disk has a dedicated I/O thread"`
+	DefaultRootDedicatedThread bool   `name:"default-root-dedicated-io-thread" help:"give the root disk an I/O thread of its own, so that heavy I/O on it does not hold up the guest"`
+	DefaultRootBus             string `name:"default-root-bus" default:"virtio" help:"bus of the root disk: virtio, sata, scsi or usb; sata suits images without virtio drivers"`
+	DefaultRootCache           string `name:"default-root-cache" help:"cache mode of the root disk: none, writethrough or writeback, which is fastest but loses writes if the host crashes; defaults to the choice of KubeVirt"`
+
+	DefaultHugepagesPageSize string `name:"default-hugepages-page-size" help:"back the guest memory with hugepages of this size (e.g. 2Mi or 1Gi)"`
+
+	DefaultExtraVolumes     []string `name:"default-extra-volume" sep:"none" help:"attach a PersistentVolumeClaim as an extra disk, e.g. name=cache,claim=shared-cache,bus=virtio,mode=block,boot=2,iothread,cache=writeback,readonly, where mode, if set, is the volume mode that the claim must have, boot the position of the disk in the boot order, iothread gives the disk an I/O thread of its own, and cache sets its cache mode; can be repeated"`
+	DefaultScratchDisks     []string `name:"default-scratch-disk" sep:"none" help:"attach an empty disk for scratch space, which goes away with the Virtual Machine instance, e.g. name=scratch,size=10Gi,bus=virtio,fs=ext4,mount=/scratch, where fs, if set, is the filesystem that cloud-init formats it with, and mount where it mounts it; can be repeated"`
+	DefaultSecretVolumes    []string `name:"default-secret-volume" sep:"none" help:"attach a Secret as a disk, e.g. name=creds,secret=registry-credentials; can be repeated"`
+	DefaultConfigMapVolumes []string `name:"default-configmap-volume" sep:"none" help:"attach a ConfigMap as a read-only disk, e.g. name=config,configmap=job-config,optional; can be repeated"`
+	DefaultFilesystems      []string `name:"default-filesystem" sep:"none" help:"share a PersistentVolumeClaim with the guest as a virtiofs filesystem, e.g. name=cache,claim=shared-cache,readonly; can be repeated"`
+
+	Pool PoolConfig `embed:"" prefix:"pool-" group:"Pool options:"`
 
 	RunConfig `embed`
 }
 
-func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+// applyDefaults fills in the settings of the job that it did not override
+// with the --default-* flags and other settings of the prepare stage.
+func (cmd *PrepareCmd) applyDefaults(jctx *JobContext) error {
+	if jctx.NetworkBinding == "" {
+		jctx.NetworkBinding = cmd.DefaultNetworkBinding
+	}
+	if jctx.NetworkName == "" {
+		jctx.NetworkName = cmd.DefaultNetworkName
+	}
+	if jctx.MACAddress == "" {
+		jctx.MACAddress = cmd.DefaultMACAddress
+	}
+	if jctx.DNSNameservers == nil {
+		jctx.DNSNameservers = cmd.DefaultDNSNameservers
+	}
+	if jctx.DNSSearches == nil {
+		jctx.DNSSearches = cmd.DefaultDNSSearches
+	}
+	if jctx.ExtraNetworks == nil {
+		for _, spec := range cmd.DefaultExtraNetworks {
+			network, err := ParseExtraNetwork(spec)
+			if err != nil {
+				return err
+			}
+			jctx.ExtraNetworks = append(jctx.ExtraNetworks, network)
+		}
+	}
+	if jctx.EvictionStrategy == "" {
+		jctx.EvictionStrategy = cmd.DefaultEvictionStrategy
+	}
+	if jctx.PriorityClassName == "" {
+		jctx.PriorityClassName = cmd.DefaultPriorityClass
+	}
+	if jctx.Hostname == "" {
+		jctx.Hostname = cmd.DefaultHostname
+	}
+	if jctx.Subdomain == "" {
+		jctx.Subdomain = cmd.DefaultSubdomain
+	}
+	if jctx.SchedulerName == "" {
+		jctx.SchedulerName = cmd.DefaultSchedulerName
+	}
+	if jctx.TerminationGracePeriodSeconds == nil && cmd.DefaultTerminationGracePeriod >= 0 {
+		seconds := int64(cmd.DefaultTerminationGracePeriod / time.Second)
+		jctx.TerminationGracePeriodSeconds = &seconds
+	}
+	if jctx.Firmware == "" {
+		jctx.Firmware = cmd.DefaultFirmware
+	}
+	if !jctx.SecureBoot {
+		jctx.SecureBoot = cmd.DefaultSecureBoot
+	}
+	if jctx.SMBIOS == (SMBIOS{}) {
+		jctx.SMBIOS = cmd.DefaultSMBIOS
+	}
+	if !jctx.EnableTPM {
+		jctx.EnableTPM = cmd.DefaultTPM
+	}
+	jctx.EnableRNG = cmd.DefaultRNG
+	jctx.EnableMemBalloon = cmd.DefaultMemBalloon
+	jctx.EnableFreePageReporting = cmd.DefaultFreePageReporting
+	if jctx.Watchdog == "" {
+		jctx.Watchdog = cmd.DefaultWatchdog
+	}
+	if jctx.Architecture == "" {
+		jctx.Architecture = cmd.DefaultArch
+	}
+	if jctx.MachineType == "" {
+		jctx.MachineType = cmd.DefaultMachineType
+	}
+	jctx.AllowedMachineTypes = cmd.AllowedMachineTypes
 	if jctx.CPURequest == "" {
 		jctx.CPURequest = cmd.DefaultCPURequest
 	}
-	if jctx.CPULimit == "" {
+	jctx.AllowOvercommit = cmd.AllowOvercommit
+	jctx.RequestMultiplier = cmd.RequestMultiplier
+	if jctx.CPULimit == "" && !jctx.AllowOvercommit {
 		jctx.CPULimit = cmd.DefaultCPULimit
 	}
 	if jctx.MemoryRequest == "" {
 		jctx.MemoryRequest = cmd.DefaultMemoryRequest
 	}
-	if jctx.MemoryLimit == "" {
+	if jctx.MemoryLimit == "" && !jctx.AllowOvercommit {
 		jctx.MemoryLimit = cmd.DefaultMemoryLimit
 	}
+	if jctx.GuestMemory == "" {
+		jctx.GuestMemory = cmd.DefaultGuestMemory
+	}
 	if jctx.EphemeralStorageRequest == "" {
 		jctx.EphemeralStorageRequest = cmd.DefaultEphemeralStorageRequest
 	}
@@ -56,8 +236,8 @@ func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 	if jctx.ImagePullPolicy == "" {
 		jctx.ImagePullPolicy = cmd.DefaultImagePullPolicy
 	}
-	if jctx.ImagePullSecret == "" {
-		jctx.ImagePullSecret = cmd.DefaultImagePullSecret
+	if jctx.ImagePullSecrets == nil {
+		jctx.ImagePullSecrets = cmd.DefaultImagePullSecrets
 	}
 	if jctx.Image == "" {
 		jctx.Image = cmd.DefaultImage
@@ -65,57 +245,410 @@ func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 	if jctx.Timezone == "" {
 		jctx.Timezone = cmd.DefaultTimezone
 	}
-	if jctx.CloudInitBase64 == "" {
-		jctx.CloudInitBase64 = cmd.DefaultCloudInitBase64
+	if jctx.CloudInitUserData == "" {
+		var err error
+		switch {
+		case cmd.DefaultCloudInit != "":
+			jctx.CloudInitUserData, err = LoadCloudInit(cmd.DefaultCloudInit)
+		case cmd.DefaultCloudInitBase64 != "":
+			var userData []byte
+			userData, err = base64.StdEncoding.DecodeString(cmd.DefaultCloudInitBase64)
+			jctx.CloudInitUserData = string(userData)
+		}
+		if err != nil {
+			return fmt.Errorf("loading cloud-init user-data: %w", err)
+		}
+	}
+	if jctx.CloudInitNetworkData == "" {
+		var err error
+		if jctx.CloudInitNetworkData, err = LoadCloudInitNetworkData(cmd.DefaultCloudInitNetworkData); err != nil {
+			return fmt.Errorf("loading cloud-init network-config: %w", err)
+		}
+	}
+	if jctx.DataVolumeName == "" {
+		jctx.DataVolumeName = cmd.DefaultDataVolume
+	}
+	if jctx.DataVolumeImage == "" {
+		jctx.DataVolumeImage = cmd.DefaultDataVolumeImage
+	}
+	if jctx.DataVolumeSize == "" {
+		jctx.DataVolumeSize = cmd.DefaultDataVolumeSize
+	}
+	if jctx.RootBootOrder == 0 {
+		jctx.RootBootOrder = cmd.DefaultRootBootOrder
+	}
+	if jctx.RootBus == "" {
+		jctx.RootBus = cmd.DefaultRootBus
+	}
+	if jctx.RootCache == "" {
+		jctx.RootCache = cmd.DefaultRootCache
+	}
+	jctx.Labels = cmd.Labels
+	jctx.Annotations = cmd.Annotations
+	if jctx.NodeSelector == nil {
+		jctx.NodeSelector = cmd.DefaultNodeSelector
+	}
+	if jctx.Tolerations == nil {
+		for _, spec := range cmd.DefaultTolerations {
+			toleration, err := ParseToleration(spec)
+			if err != nil {
+				return err
+			}
+			jctx.Tolerations = append(jctx.Tolerations, toleration)
+		}
+	}
+	if jctx.Affinity == nil {
+		affinity, err := ParseAffinity(cmd.DefaultAffinity)
+		if err != nil {
+			return err
+		}
+		jctx.Affinity = affinity
+	}
+	jctx.SpreadAcrossNodes = cmd.SpreadAcrossNodes
+	if jctx.CPUSockets == 0 {
+		jctx.CPUSockets = cmd.DefaultCPUSockets
+	}
+	if jctx.CPUCores == 0 {
+		jctx.CPUCores = cmd.DefaultCPUCores
+	}
+	if jctx.CPUThreads == 0 {
+		jctx.CPUThreads = cmd.DefaultCPUThreads
+	}
+	if !jctx.DedicatedCPU {
+		jctx.DedicatedCPU = cmd.DefaultDedicatedCPU
+	}
+	if !jctx.GuestNUMA {
+		jctx.GuestNUMA = cmd.DefaultGuestNUMA
+	}
+	if jctx.IOThrottle == (IOThrottle{}) {
+		jctx.IOThrottle = IOThrottle{
+			ThreadsPolicy:       cmd.DefaultIOThreadsPolicy,
+			DedicatedRootThread: cmd.DefaultRootDedicatedThread,
+		}
+	}
+	if jctx.HugepagesPageSize == "" {
+		jctx.HugepagesPageSize = cmd.DefaultHugepagesPageSize
+	}
+	if jctx.ExtraVolumes == nil {
+		for _, spec := range cmd.DefaultExtraVolumes {
+			vol, err := ParseExtraVolume(spec)
+			if err != nil {
+				return err
+			}
+			jctx.ExtraVolumes = append(jctx.ExtraVolumes, vol)
+		}
+	}
+	if jctx.ScratchDisks == nil {
+		for _, spec := range cmd.DefaultScratchDisks {
+			disk, err := ParseScratchDisk(spec)
+			if err != nil {
+				return err
+			}
+			jctx.ScratchDisks = append(jctx.ScratchDisks, disk)
+		}
+	}
+	if jctx.SecretVolumes == nil {
+		for _, spec := range cmd.DefaultSecretVolumes {
+			vol, err := ParseSecretVolume(spec)
+			if err != nil {
+				return err
+			}
+			jctx.SecretVolumes = append(jctx.SecretVolumes, vol)
+		}
+	}
+	if jctx.ConfigMapVolumes == nil {
+		for _, spec := range cmd.DefaultConfigMapVolumes {
+			vol, err := ParseConfigMapVolume(spec)
+			if err != nil {
+				return err
+			}
+			jctx.ConfigMapVolumes = append(jctx.ConfigMapVolumes, vol)
+		}
+	}
+	if jctx.Filesystems == nil {
+		for _, spec := range cmd.DefaultFilesystems {
+			fs, err := ParseFilesystem(spec)
+			if err != nil {
+				return err
+			}
+			jctx.Filesystems = append(jctx.Filesystems, fs)
+		}
+	}
+	if jctx.GPUs == nil {
+		devices, err := ParseDevices("GPU", cmd.DefaultGPUs)
+		if err != nil {
+			return err
+		}
+		for _, dev := range devices {
+			jctx.GPUs = append(jctx.GPUs, kubevirtapi.GPU{Name: dev.Name, DeviceName: dev.DeviceName})
+		}
+	}
+	if jctx.HostDevices == nil {
+		devices, err := ParseDevices("host device", cmd.DefaultHostDevices)
+		if err != nil {
+			return err
+		}
+		for _, dev := range devices {
+			jctx.HostDevices = append(jctx.HostDevices, kubevirtapi.HostDevice{Name: dev.Name, DeviceName: dev.DeviceName})
+		}
 	}
 
-	rc := cmd.RunConfig
-
-	fmt.Fprintf(os.Stderr, "Creating Virtual Machine instance\n")
+	jctx.FatalReasons = cmd.FatalReasons
+	if !jctx.CaptureConsole {
+		jctx.CaptureConsole = cmd.CaptureConsole
+	}
+	if jctx.ConsoleLog == "" {
+		jctx.ConsoleLog = cmd.ConsoleLog
+	}
+	if jctx.ReadinessMode == "" {
+		jctx.ReadinessMode = cmd.ReadinessMode
+	}
+	if jctx.ReadinessCommand == "" {
+		jctx.ReadinessCommand = cmd.ReadinessCommand
+	}
+	jctx.PreScript = cmd.PreScript
+	jctx.AllowedImages = cmd.AllowedImages
+	jctx.CheckImage = cmd.CheckImage
+	jctx.CheckImageTimeout = cmd.CheckImageTimeout
+	jctx.ResolveImageDigest = cmd.ResolveImageDigest
+	jctx.DryRun = cmd.DryRun
+	jctx.CreateTimeout = cmd.CreateTimeout
+	jctx.UseVirtualMachine = cmd.UseVirtualMachine
+	jctx.MaxRestarts = cmd.MaxRestarts
+	jctx.Services = selectServices(jctx.Services)
+	jctx.ClusterDomain = cmd.ClusterDomain
+	return nil
+}
 
-	vm, err := CreateJobVM(ctx, client, jctx, &rc)
-	if err != nil {
+func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	if err := cmd.applyDefaults(jctx); err != nil {
 		return err
 	}
+	if err := CheckJobImage(ctx, client, jctx); err != nil {
+		return err
+	}
+	if cmd.Pool.Name != "" {
+		switch {
+		case jctx.UseVirtualMachine:
+			return fmt.Errorf("pools do not support --use-virtual-machine")
+		case len(jctx.Services) > 0:
+			// The instance is set up for reaching the services of the job
+			// that created it, and no other.
+			logger.Info("not using the pool, the job has services", "pool", cmd.Pool.Name)
+		default:
+			for _, msg := range validation.IsValidLabelValue(cmd.Pool.Name) {
+				return fmt.Errorf("invalid pool name %q: %s", cmd.Pool.Name, msg)
+			}
+			profile, err := poolProfile(jctx, &cmd.RunConfig)
+			if err != nil {
+				return fmt.Errorf("computing pool profile: %w", err)
+			}
+			jctx.Pool = cmd.Pool.Name
+			jctx.PoolProfile = profile
+		}
+	}
 
-	fmt.Fprintf(os.Stderr, "Waiting for Virtual Machine instance %s to be ready...\n", vm.ObjectMeta.Name)
+	rc := cmd.RunConfig
 
-	// Wait for new VM to get an IP
+	if jctx.ReadinessMode == "ssh" && rc.Method != "ssh" {
+		return fmt.Errorf("the ssh readiness mode requires the ssh method")
+	}
+	if jctx.ReadinessCommand != "" && cmd.ReadinessCommandInterval <= 0 {
+		return fmt.Errorf("the readiness command interval must be positive")
+	}
+	if rc.GuestOS == "windows" && rc.Shell != "pwsh" {
+		return fmt.Errorf("windows guests require the pwsh shell")
+	}
+	if len(rc.SSH.JumpHosts) > 0 && rc.SSH.JumpKnownHosts == "" && !rc.SSH.JumpInsecureIgnoreHostKey {
+		return ErrJumpHostKeyUnverified
+	}
+	if rc.GuestOS == "windows" && rc.Method == "ssh" && rc.SSH.StrictHostKey {
+		return fmt.Errorf("the ssh host key of windows guests cannot be provisioned; pass --no-ssh-strict-host-key")
+	}
 
-	timeout, stop := context.WithTimeout(ctx, cmd.Timeout)
-	defer stop()
+	if jctx.JobTimeout > 0 {
+		jctx.Deadline = time.Now().Add(jctx.JobTimeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, jctx.Deadline)
+		defer cancel()
+	}
 
-	err = WatchJobVM(timeout, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
-		if et == watch.Error {
-			// Retry on watch failure
-			return nil
+	var vm *kubevirtapi.VirtualMachineInstance
+	var err error
+	if jctx.Pool != "" && !jctx.DryRun {
+		if vm, err = ClaimPoolVM(ctx, client, jctx); err != nil {
+			return err
 		}
-		vm = val
-		if len(vm.Status.Interfaces) == 0 || vm.Status.Interfaces[0].IP == "" {
-			return nil
+	}
+
+	claimed := vm != nil
+	if claimed {
+		fmt.Fprintf(os.Stderr, "Claimed Virtual Machine instance %s from pool %s\n", vm.ObjectMeta.Name, jctx.Pool)
+
+		// The instance was set up by the job that created it.
+		rc = RunConfig{}
+		if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err != nil {
+			return err
 		}
-		for _, cond := range vm.Status.Conditions {
-			if cond.Type == "Ready" && cond.Status == "True" {
-				return ErrWatchDone
-			}
+		// Whichever deadline the previous job had goes away.
+		if err := SetJobDeadline(ctx, client, jctx, vm, jctx.Deadline); err != nil {
+			return fmt.Errorf("setting job deadline: %w", err)
+		}
+	} else {
+		vm, err = cmd.create(ctx, client, jctx, &rc)
+		if err != nil || jctx.DryRun {
+			return err
 		}
-		return nil
-	})
+	}
+
+	// Booting may take up to --timeout, which the reaper must not mistake
+	// for the instance being orphaned.
+	keepAlive, stopKeepAlive := context.WithCancel(ctx)
+	defer stopKeepAlive()
+	go KeepAlive(keepAlive, client, jctx, vm, cmd.HeartbeatInterval)
+
+	if jctx.CaptureConsole {
+		out, err := openConsoleLog(jctx.ConsoleLog)
+		if err != nil {
+			return fmt.Errorf("opening console log: %w", err)
+		}
+		defer out.Close()
+
+		consoleCtx, stopConsole := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			CaptureConsole(consoleCtx, client, jctx, vm, out)
+		}()
+		defer func() {
+			stopConsole()
+			<-done
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "Waiting for Virtual Machine instance %s to be ready...\n", vm.ObjectMeta.Name)
+
+	vm, err = WaitForJobVM(ctx, client, jctx, vm, cmd.Timeout)
 	if err != nil {
 		return err
 	}
+	if len(jctx.Services) > 0 {
+		fmt.Fprintln(os.Stderr, "Waiting for services to be running...")
+		if err := WaitForJobServices(ctx, client, jctx, cmd.Timeout); err != nil {
+			return err
+		}
+	}
 
 	fmt.Fprintln(os.Stderr, "Virtual Machine instance is ready.")
 	fmt.Fprintln(os.Stderr, "Name:", vm.ObjectMeta.Name)
 	fmt.Fprintln(os.Stderr, "Image:", jctx.Image)
 	fmt.Fprintln(os.Stderr, "Node:", vm.Status.NodeName)
-	fmt.Fprintln(os.Stderr, "IP:", vm.Status.Interfaces[0].IP)
-	fmt.Fprintln(os.Stderr, "Waiting for virtual machine to become reachable via ssh...")
+	if addr, err := JobVMAddress(vm, rc.Address); err == nil {
+		fmt.Fprintln(os.Stderr, "IP:", addr)
+	}
+	fmt.Fprintf(os.Stderr, "Waiting for virtual machine to become reachable via %s...\n", rc.Method)
 
-	ssh, err := DialSSH(timeout, vm.Status.Interfaces[0].IP, rc.SSH, cmd.DialTimeout)
+	opts := DialOptions{
+		Timeout:      cmd.DialTimeout,
+		RetryTimeout: cmd.Timeout,
+		PollInterval: cmd.ReadinessPollInterval,
+	}
+	if jctx.ReadinessMode == "ssh" {
+		opts.RetryHandshake = true
+		if cmd.ReadinessTimeout > 0 {
+			opts.RetryTimeout = cmd.ReadinessTimeout
+		}
+	}
+	conn, err := Connect(ctx, client, jctx, vm, &rc, opts)
 	if err != nil {
-		return err
+		metricVMFailed.Inc(append(metricLabels(jctx), failureUnreachable)...)
+		return fmt.Errorf("Virtual Machine instance %s never became reachable via %s: %w", vm.ObjectMeta.Name, rc.Method, err)
+	}
+	defer conn.Close()
+
+	if err := cmd.provision(ctx, conn, jctx, &rc); err != nil {
+		metricVMFailed.Inc(append(metricLabels(jctx), failureNotReady)...)
+		return fmt.Errorf("Virtual Machine instance %s never became ready: %w", vm.ObjectMeta.Name, err)
+	}
+	if err := RecordPreparedInstance(ctx, client, jctx, vm); err != nil {
+		return fmt.Errorf("recording the prepared Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
+	}
+	if !claimed {
+		metricVMReady.Observe(time.Since(vm.ObjectMeta.CreationTimestamp.Time), metricLabels(jctx)...)
+	}
+	return nil
+}
+
+// provision waits for the readiness command of the job to succeed on the
+// Virtual Machine instance, if there is one, and then runs the pre-script,
+// if any, so that it only ever runs on a ready instance.
+func (cmd *PrepareCmd) provision(ctx context.Context, conn Transport, jctx *JobContext, rc *RunConfig) error {
+	if jctx.ReadinessCommand != "" {
+		fmt.Fprintf(os.Stderr, "Waiting for readiness command %q to succeed...\n", jctx.ReadinessCommand)
+		timeout := cmd.Timeout
+		if cmd.ReadinessCommandTimeout > 0 {
+			timeout = cmd.ReadinessCommandTimeout
+		}
+		if err := WaitForReadinessCommand(ctx, conn, jctx.ReadinessCommand, cmd.ReadinessCommandInterval, timeout); err != nil {
+			return err
+		}
+	}
+	if jctx.PreScript != "" {
+		fmt.Fprintf(os.Stderr, "Running pre-script %s...\n", jctx.PreScript)
+		if err := RunRunnerScript(ctx, conn, rc.Shell, jctx.PreScript, "kubevirt_pre_script"); err != nil {
+			return err
+		}
 	}
-	_ = ssh.Close()
 	return nil
 }
+
+// create creates the Virtual Machine instance of the job, generating its
+// ssh key if needed, and starts its services.
+func (cmd *PrepareCmd) create(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, rc *RunConfig) (*kubevirtapi.VirtualMachineInstance, error) {
+	if rc.Method == "ssh" && rc.SSH.UseGeneratedKey() {
+		priv, pub, err := GenerateSSHKey()
+		if err != nil {
+			return nil, fmt.Errorf("generating ssh key: %w", err)
+		}
+		if jctx.CloudInitUserData, err = InjectSSHKey(jctx.CloudInitUserData, rc.SSH.User, pub); err != nil {
+			return nil, err
+		}
+		rc.SSH.privateKey = priv
+	}
+	if rc.Method == "ssh" && rc.SSH.StrictHostKey {
+		priv, pub, err := GenerateHostKey()
+		if err != nil {
+			return nil, fmt.Errorf("generating ssh host key: %w", err)
+		}
+		if jctx.CloudInitUserData, err = InjectHostKey(jctx.CloudInitUserData, string(priv), pub); err != nil {
+			return nil, err
+		}
+		rc.SSH.HostKey = pub
+	}
+	var err error
+	if jctx.CloudInitUserData, err = InjectScratchDisks(jctx.CloudInitUserData, jctx.ScratchDisks); err != nil {
+		return nil, err
+	}
+
+	if !jctx.DryRun {
+		fmt.Fprintf(os.Stderr, "Creating Virtual Machine instance\n")
+	}
+
+	vm, err := CreateJobVM(ctx, client, jctx, rc)
+	if err != nil {
+		return nil, err
+	}
+	if jctx.DryRun {
+		return nil, nil
+	}
+
+	if rc.SSH.privateKey != nil {
+		if err := CreateJobSSHKeySecret(ctx, client, jctx, vm, rc.SSH.privateKey); err != nil {
+			return nil, fmt.Errorf("storing ssh key: %w", err)
+		}
+	}
+	if err := CreateJobServices(ctx, client, jctx, vm, JobEnv(os.Environ())); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
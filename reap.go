@@ -0,0 +1,142 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// HeartbeatKey is the annotation that the run stage periodically refreshes
+// with the current time, so that the reaper can tell apart the instances of
+// jobs that are still running from those left behind by a dead runner.
+const HeartbeatKey = labelPrefix + "/heartbeat"
+
+type ReapCmd struct {
+	MaxAge time.Duration `name:"max-age" default:"3h" help:"delete Virtual Machine instances that haven't shown signs of life for this long"`
+}
+
+func (cmd *ReapCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	return ReapOrphans(ctx, client, jctx.Namespace, jctx.LabelPrefix, cmd.MaxAge)
+}
+
+// ReapOrphans deletes the Virtual Machine instances created by this executor
+// in namespace, with labels in the prefix domain, whose last heartbeat, or
+// creation if they never had any, is older than maxAge. Instances kept
+// with --keep-on-failure are deleted once their time to live has passed
+// instead. Instances that changed since they were listed are left alone,
+// since they might not be orphans anymore.
+func ReapOrphans(ctx context.Context, client kubevirt.KubevirtClient, namespace, prefix string, maxAge time.Duration) error {
+	list, err := client.VirtualMachineInstance(namespace).List(ctx, &metav1.ListOptions{
+		LabelSelector: prefix + "/id",
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	failed := 0
+	for _, vm := range list.Items {
+		lastSeen := vm.ObjectMeta.CreationTimestamp.Time
+		if hb, err := time.Parse(time.RFC3339, vm.ObjectMeta.Annotations[HeartbeatKey]); err == nil && hb.After(lastSeen) {
+			lastSeen = hb
+		}
+		if until, ok := keptUntil(&vm); ok {
+			if now.Before(until) {
+				continue
+			}
+		} else if now.Sub(lastSeen) < maxAge {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Deleting orphaned Virtual Machine instance %v (last seen %v ago)\n", vm.ObjectMeta.Name, now.Sub(lastSeen).Round(time.Second))
+		err := reapInstance(ctx, client, namespace, &vm)
+		if apierrors.IsConflict(err) {
+			fmt.Fprintf(os.Stderr, "Not deleting Virtual Machine instance %v, which changed since it was listed\n", vm.ObjectMeta.Name)
+			continue
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "Couldn't delete Virtual Machine instance %v: %v\n", vm.ObjectMeta.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d orphaned Virtual Machine instances", failed)
+	}
+	return nil
+}
+
+// reapInstance deletes the Virtual Machine instance, unless it changed since
+// it was listed, e.g. because a job claimed it from its pool or refreshed
+// its heartbeat in the meantime, in which case it fails with a conflict.
+func reapInstance(ctx context.Context, client kubevirt.KubevirtClient, namespace string, vm *kubevirtapi.VirtualMachineInstance) error {
+	if controllingVM(vm) == nil {
+		resourceVersion := vm.ObjectMeta.ResourceVersion
+		return deleteInstance(ctx, client, namespace, vm, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+		})
+	}
+
+	// Deleting the VirtualMachine would check the precondition against it
+	// rather than its instance, which is what jobs update, so check by hand.
+	latest, err := client.VirtualMachineInstance(namespace).Get(ctx, vm.ObjectMeta.Name, &metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if latest.ObjectMeta.ResourceVersion != vm.ObjectMeta.ResourceVersion {
+		return apierrors.NewConflict(kubevirtapi.Resource("virtualmachineinstances"), vm.ObjectMeta.Name,
+			fmt.Errorf("resourceVersion changed from %s to %s", vm.ObjectMeta.ResourceVersion, latest.ObjectMeta.ResourceVersion))
+	}
+	return deleteInstance(ctx, client, namespace, latest, &metav1.DeleteOptions{})
+}
+
+// Heartbeat stamps the Virtual Machine instance with the current time. It
+// merges the annotation alone into the instance, so it never undoes what
+// concurrent writers change, and needs no resourceVersion.
+func Heartbeat(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				HeartbeatKey: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.VirtualMachineInstance(jctx.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	return err
+}
+
+// KeepAlive refreshes the heartbeat of the Virtual Machine instance every
+// interval until ctx is done. Failures are not fatal to the job. A
+// non-positive interval disables heartbeats.
+func KeepAlive(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := Heartbeat(ctx, client, jctx, vm); err != nil && ctx.Err() == nil {
+			logger.Warn("refreshing heartbeat", "vmi", vm.ObjectMeta.Name, "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
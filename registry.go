@@ -0,0 +1,359 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// The containerdisk image can be checked before creating the Virtual
+// Machine instance, by querying its manifest from the registry, so that a
+// typo fails the job right away rather than after the image pull backs
+// off. Only the registry saying that the image does not exist fails the
+// job; anything else, like a registry refusing manifest queries, is merely
+// warned about.
+//
+// The tag of the image can likewise be resolved to the digest it points to,
+// so that retrying the job boots the very same image even if the tag moved
+// in the meantime.
+
+// ErrImageNotFound is returned by CheckImageExists when the registry
+// reports that the image does not exist.
+var ErrImageNotFound = errors.New("image not found")
+
+// manifestMediaTypes are the manifest types accepted from registries.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// imageRef is a parsed image reference.
+type imageRef struct {
+	Registry   string // e.g. registry-1.docker.io
+	Repository string // e.g. library/ubuntu
+	Reference  string // tag or digest
+}
+
+// parseImageRef parses an image reference the way container runtimes do,
+// defaulting to Docker Hub and the latest tag.
+func parseImageRef(image string) (imageRef, error) {
+	var ref imageRef
+	name := image
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		name, ref.Reference = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		if ref.Reference == "" {
+			ref.Reference = name[i+1:]
+		}
+		name = name[:i]
+	}
+	if ref.Reference == "" {
+		ref.Reference = "latest"
+	}
+
+	ref.Registry = "registry-1.docker.io"
+	if i := strings.IndexByte(name, '/'); i != -1 {
+		if domain := name[:i]; strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			ref.Registry, name = domain, name[i+1:]
+		}
+	}
+	switch ref.Registry {
+	case "docker.io", "index.docker.io":
+		ref.Registry = "registry-1.docker.io"
+	}
+	if ref.Registry == "registry-1.docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return ref, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// registryCredentials are the username and password for a registry.
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// loadRegistryCredentials reads the credentials for registry from the
+// given pull secrets, in the namespace of the job.
+func loadRegistryCredentials(ctx context.Context, client kubevirt.KubevirtClient, namespace, registry string, secrets []string) (*registryCredentials, error) {
+	for _, name := range secrets {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("reading pull secret %s: %w", name, err)
+		}
+
+		var auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		}
+		switch secret.Type {
+		case k8sapi.SecretTypeDockerConfigJson:
+			var config struct {
+				Auths json.RawMessage `json:"auths"`
+			}
+			err = json.Unmarshal(secret.Data[k8sapi.DockerConfigJsonKey], &config)
+			if err == nil && config.Auths != nil {
+				err = json.Unmarshal(config.Auths, &auths)
+			}
+		case k8sapi.SecretTypeDockercfg:
+			err = json.Unmarshal(secret.Data[k8sapi.DockerConfigKey], &auths)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing pull secret %s: %w", name, err)
+		}
+
+		for server, auth := range auths {
+			if registryHost(server) != registry {
+				continue
+			}
+			creds := &registryCredentials{Username: auth.Username, Password: auth.Password}
+			if auth.Auth != "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return nil, fmt.Errorf("parsing pull secret %s: invalid auth for %s: %w", name, server, err)
+				}
+				kv := strings.SplitN(string(decoded), ":", 2)
+				if len(kv) == 2 {
+					creds.Username, creds.Password = kv[0], kv[1]
+				}
+			}
+			return creds, nil
+		}
+	}
+	return nil, nil
+}
+
+// registryHost returns the host of a server of a docker config, which may
+// be a URL, e.g. https://index.docker.io/v1/.
+func registryHost(server string) string {
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "docker.io", "index.docker.io":
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// CheckImageExists queries the manifest of image from its registry,
+// authenticating with the given pull secrets if needed. It returns
+// ErrImageNotFound if the registry does not know the image.
+func CheckImageExists(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, image string, timeout time.Duration) error {
+	_, err := queryManifest(ctx, client, jctx, image, timeout)
+	return err
+}
+
+// ResolveImageDigest returns the digest of the manifest that the tag of
+// image currently points to, as reported by its registry.
+func ResolveImageDigest(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, image string, timeout time.Duration) (string, error) {
+	resp, err := queryManifest(ctx, client, jctx, image, timeout)
+	if err != nil {
+		return "", err
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("registry did not report the digest of %s", image)
+	}
+	return digest, nil
+}
+
+// imageDigest returns the digest that image is pinned to, if any.
+func imageDigest(image string) (string, bool) {
+	if i := strings.IndexByte(image, '@'); i != -1 {
+		return image[i+1:], true
+	}
+	return "", false
+}
+
+// pinImage returns image pinned to digest, without its tag.
+func pinImage(image, digest string) string {
+	if i := strings.IndexByte(image, '@'); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndexByte(image, ':'); i > strings.LastIndexByte(image, '/') {
+		image = image[:i]
+	}
+	return image + "@" + digest
+}
+
+// queryManifest queries the manifest of image from its registry,
+// authenticating with the given pull secrets if needed. It returns
+// ErrImageNotFound if the registry does not know the image.
+func queryManifest(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, image string, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := loadRegistryCredentials(ctx, client, jctx.Namespace, ref.Registry, jctx.ImagePullSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, ref.Reference)
+	resp, err := headManifest(ctx, manifestURL, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := registryAuthorization(ctx, resp.Header.Get("WWW-Authenticate"), creds)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = headManifest(ctx, manifestURL, authorization); err != nil {
+			return nil, err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, image)
+	default:
+		return nil, fmt.Errorf("querying manifest of %s: %s", image, resp.Status)
+	}
+}
+
+func headManifest(ctx context.Context, manifestURL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// registryAuthorization answers the authentication challenge of a
+// registry, returning the value of the Authorization header to retry with.
+func registryAuthorization(ctx context.Context, challenge string, creds *registryCredentials) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds == nil {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry authentication %q", scheme)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid registry authentication realm %q", params["realm"])
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if creds != nil {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("getting registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i == -1 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
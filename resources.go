@@ -0,0 +1,160 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+// QuantityError is a resource quantity of the job that is malformed, or
+// inconsistent with another one.
+type QuantityError struct {
+	Field string // e.g. memory.limit
+	Err   error
+}
+
+func (e *QuantityError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *QuantityError) Unwrap() error {
+	return e.Err
+}
+
+// QuantityErrors are all of the quantity errors of a job. It unwraps to the
+// first of them.
+type QuantityErrors []*QuantityError
+
+func (errs QuantityErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs QuantityErrors) Unwrap() error {
+	return errs[0]
+}
+
+// JobResources parses the resource requests and limits of the job,
+// reporting every malformed quantity, and every request exceeding its
+// limit, in a single QuantityErrors.
+//
+// Omitted CPU and memory limits default to the corresponding requests,
+// unless jctx.AllowOvercommit is set, in which case they are left out.
+func JobResources(jctx *JobContext) (kubevirtapi.ResourceRequirements, error) {
+	resources := kubevirtapi.ResourceRequirements{
+		Requests: k8sapi.ResourceList{},
+		Limits:   k8sapi.ResourceList{},
+	}
+
+	quantities := []struct {
+		Name           k8sapi.ResourceName
+		Request, Limit string
+		LimitDefaults  bool
+	}{
+		{k8sapi.ResourceCPU, jctx.CPURequest, jctx.CPULimit, true},
+		{k8sapi.ResourceMemory, jctx.MemoryRequest, jctx.MemoryLimit, true},
+		{k8sapi.ResourceEphemeralStorage, jctx.EphemeralStorageRequest, jctx.EphemeralStorageLimit, false},
+	}
+
+	var errs QuantityErrors
+	parse := func(name k8sapi.ResourceName, kind, value, note string) (resource.Quantity, bool) {
+		if value == "" {
+			return resource.Quantity{}, false
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			errs = append(errs, &QuantityError{
+				Field: fmt.Sprintf("%s.%s", name, kind),
+				Err:   fmt.Errorf("invalid quantity '%s'%s: %w", value, note, err),
+			})
+			return q, false
+		}
+		return q, true
+	}
+
+	for _, q := range quantities {
+		defaulted := q.LimitDefaults && q.Limit == "" && !jctx.AllowOvercommit
+		note := ""
+		if defaulted {
+			note = " (also used as the omitted limit)"
+		}
+		request, hasRequest := parse(q.Name, "request", q.Request, note)
+		if hasRequest {
+			resources.Requests[q.Name] = request
+			if defaulted {
+				resources.Limits[q.Name] = request.DeepCopy()
+			}
+		}
+		limit, hasLimit := parse(q.Name, "limit", q.Limit, "")
+		if hasLimit {
+			resources.Limits[q.Name] = limit
+		}
+		if !hasRequest || !hasLimit {
+			continue
+		}
+		if request.Cmp(limit) > 0 {
+			errs = append(errs, &QuantityError{
+				Field: fmt.Sprintf("%s.request", q.Name),
+				Err:   fmt.Errorf("request %s exceeds the limit %s", request.String(), limit.String()),
+			})
+		}
+	}
+
+	if len(resources.Limits) == 0 {
+		resources.Limits = nil
+	}
+	if len(errs) > 0 {
+		return resources, errs
+	}
+	return resources, nil
+}
+
+// ScaleRequests multiplies the requests of the named resources by
+// multiplier, which must lie in (0, 1], rounding up, and leaves their limits
+// alone.
+func ScaleRequests(resources kubevirtapi.ResourceRequirements, multiplier float64, names ...k8sapi.ResourceName) error {
+	if multiplier <= 0 || multiplier > 1 {
+		return fmt.Errorf("request multiplier %v must be greater than 0, and at most 1", multiplier)
+	}
+	if multiplier == 1 {
+		return nil
+	}
+	var errs QuantityErrors
+	for _, name := range names {
+		request, ok := resources.Requests[name]
+		if !ok {
+			continue
+		}
+		var scaled *resource.Quantity
+		switch name {
+		case k8sapi.ResourceCPU:
+			scaled = resource.NewMilliQuantity(int64(math.Ceil(float64(request.MilliValue())*multiplier)), request.Format)
+		default:
+			scaled = resource.NewQuantity(int64(math.Ceil(float64(request.Value())*multiplier)), request.Format)
+		}
+		if scaled.Sign() <= 0 {
+			errs = append(errs, &QuantityError{
+				Field: fmt.Sprintf("%s.request", name),
+				Err:   fmt.Errorf("request %s scaled by %v is not positive", request.String(), multiplier),
+			})
+			continue
+		}
+		resources.Requests[name] = *scaled
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
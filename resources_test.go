@@ -0,0 +1,154 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestJobResourcesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		jctx JobContext
+		want []string
+	}{
+		{name: "valid", jctx: JobContext{CPURequest: "500m", CPULimit: "1", MemoryRequest: "1Gi"}},
+		{
+			name: "malformed",
+			jctx: JobContext{CPURequest: "lots", MemoryRequest: "1Gi", MemoryLimit: "1 GB"},
+			want: []string{"cpu.request", "memory.limit"},
+		},
+		{
+			name: "request over limit",
+			jctx: JobContext{CPURequest: "2", CPULimit: "1", MemoryRequest: "2Gi", MemoryLimit: "1Gi"},
+			want: []string{"cpu.request", "memory.request"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := JobResources(&tt.jctx)
+			var got []string
+			var errs QuantityErrors
+			if errors.As(err, &errs) {
+				for _, err := range errs {
+					got = append(got, err.Field)
+				}
+			} else if err != nil {
+				t.Fatalf("err = %v, want QuantityErrors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields in error = %v, want %v (err: %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestJobResourcesLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		jctx           JobContext
+		requests, want map[k8sapi.ResourceName]string
+	}{
+		{
+			name:     "request only",
+			jctx:     JobContext{CPURequest: "500m", MemoryRequest: "1Gi"},
+			requests: map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "500m", k8sapi.ResourceMemory: "1Gi"},
+			want:     map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "500m", k8sapi.ResourceMemory: "1Gi"},
+		},
+		{
+			name: "limit only",
+			jctx: JobContext{CPULimit: "2", MemoryLimit: "4Gi"},
+			want: map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "2", k8sapi.ResourceMemory: "4Gi"},
+		},
+		{
+			name:     "both set",
+			jctx:     JobContext{CPURequest: "500m", CPULimit: "2", MemoryRequest: "1Gi", MemoryLimit: "4Gi"},
+			requests: map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "500m", k8sapi.ResourceMemory: "1Gi"},
+			want:     map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "2", k8sapi.ResourceMemory: "4Gi"},
+		},
+		{
+			name:     "mixed",
+			jctx:     JobContext{CPURequest: "500m", MemoryRequest: "1Gi", MemoryLimit: "4Gi"},
+			requests: map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "500m", k8sapi.ResourceMemory: "1Gi"},
+			want:     map[k8sapi.ResourceName]string{k8sapi.ResourceCPU: "500m", k8sapi.ResourceMemory: "4Gi"},
+		},
+		{
+			name:     "ephemeral storage request only",
+			jctx:     JobContext{EphemeralStorageRequest: "10Gi"},
+			requests: map[k8sapi.ResourceName]string{k8sapi.ResourceEphemeralStorage: "10Gi"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, err := JobResources(&tt.jctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkQuantities(t, "requests", resources.Requests, tt.requests)
+			checkQuantities(t, "limits", resources.Limits, tt.want)
+		})
+	}
+}
+
+// checkQuantities checks that list holds exactly the quantities of want.
+func checkQuantities(t *testing.T, what string, list k8sapi.ResourceList, want map[k8sapi.ResourceName]string) {
+	t.Helper()
+	if len(list) != len(want) {
+		t.Errorf("%s = %v, want %v", what, list, want)
+	}
+	for name, value := range want {
+		got, ok := list[name]
+		if !ok || got.Cmp(resource.MustParse(value)) != 0 {
+			t.Errorf("%s[%s] = %s, want %s", what, name, got.String(), value)
+		}
+	}
+}
+
+func TestJobResourcesOvercommit(t *testing.T) {
+	tests := []struct {
+		name string
+		jctx JobContext
+		want map[k8sapi.ResourceName]string
+	}{
+		{name: "requests only", jctx: JobContext{CPURequest: "500m", MemoryRequest: "1Gi", AllowOvercommit: true}},
+		{
+			name: "explicit limit",
+			jctx: JobContext{CPURequest: "500m", MemoryRequest: "1Gi", MemoryLimit: "4Gi", AllowOvercommit: true},
+			want: map[k8sapi.ResourceName]string{k8sapi.ResourceMemory: "4Gi"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, err := JobResources(&tt.jctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil && resources.Limits != nil {
+				t.Errorf("limits = %v, want nil", resources.Limits)
+			}
+			checkQuantities(t, "limits", resources.Limits, tt.want)
+		})
+	}
+
+	// The defaults of the runner are ignored as well, and the spec then has
+	// no limits at all.
+	cmd := testPrepareCmd(t, "--allow-overcommit")
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	rc := cmd.RunConfig
+	vm := createTestVM(t, c, jctx, &rc)
+	if limits := vm.Spec.Domain.Resources.Limits; len(limits) != 0 {
+		t.Errorf("limits in the spec = %v, want none", limits)
+	}
+	if requests := vm.Spec.Domain.Resources.Requests; len(requests) == 0 {
+		t.Errorf("no requests in the spec")
+	}
+}
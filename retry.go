@@ -0,0 +1,114 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// isTransientAPIError returns whether err is likely to go away by itself,
+// like rate limiting, or connection resets while the apiserver rolls out.
+func isTransientAPIError(err error) bool {
+	return apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err) ||
+		utilnet.IsTimeout(err)
+}
+
+// maxNameCollisions is how many times in a row an object created with a
+// generated name may collide with an existing one before giving up.
+const maxNameCollisions = 5
+
+// isNameCollision returns whether creating an object failed because its
+// generated name was taken, which the apiserver reports as AlreadyExists,
+// or as a conflict while under contention.
+func isNameCollision(err error) bool {
+	return apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)
+}
+
+// retryNameCollisions calls create, which creates an object with a
+// generated name, until its name no longer collides with that of another
+// object, up to maxNameCollisions times. The apiserver generates a new name
+// on each attempt, so there is no point in waiting. This is independent of
+// retryAPI, whose budget is left to transient errors.
+func retryNameCollisions(what string, create func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := create()
+		if !isNameCollision(err) {
+			return err
+		}
+		if attempt == maxNameCollisions {
+			return fmt.Errorf("%s: giving up after %d name collisions: %w", what, attempt, err)
+		}
+		logger.Warn("generated name collided, retrying", "call", what, "attempt", attempt, "err", err)
+	}
+}
+
+// maxConflicts is how many times in a row an update of an object may
+// conflict with that of another writer before giving up.
+const maxConflicts = 5
+
+// retryConflicts calls update, which reads an object and writes it back
+// conditionally on its resourceVersion, until it no longer conflicts with a
+// concurrent writer, up to maxConflicts times. update must read the object
+// anew on each call, and is expected to bail out by itself if what it reads
+// means it should not write anymore.
+func retryConflicts(what string, update func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := update()
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+		if attempt == maxConflicts {
+			return fmt.Errorf("%s: giving up after %d conflicts: %w", what, attempt, err)
+		}
+		logger.Debug("update conflicted, retrying", "call", what, "attempt", attempt, "err", err)
+	}
+}
+
+// retryAPI calls fn until it succeeds, fails with an error that retryable
+// rejects, or the retry budget of the job runs out, backing off
+// exponentially between attempts. The last error of fn is returned.
+func retryAPI(ctx context.Context, jctx *JobContext, what string, retryable func(error) bool, fn func() error) error {
+	back := backoff.NewExponentialBackOff()
+	back.MaxInterval = jctx.APIRetryMaxInterval
+	if back.InitialInterval > back.MaxInterval {
+		back.InitialInterval = back.MaxInterval
+	}
+	back.MaxElapsedTime = 0
+	back.Reset()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt > jctx.APIRetries {
+			return err
+		}
+
+		delay := back.NextBackOff()
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+			if suggested := time.Duration(seconds) * time.Second; suggested > delay && suggested <= jctx.APIRetryMaxInterval {
+				delay = suggested
+			}
+		}
+		logger.Warn("retrying Kubernetes API call", "call", what, "attempt", attempt, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	k8sapi "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestRetryAPI(t *testing.T) {
+	jctx := &JobContext{APIRetries: 2, APIRetryMaxInterval: time.Millisecond}
+	transient := apierrors.NewTooManyRequests("slow down", 0)
+	permanent := apierrors.NewForbidden(schema.GroupResource{Resource: "virtualmachineinstances"}, "x", errors.New("denied"))
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient, then success", errs: []error{transient, transient}, wantCalls: 3},
+		{name: "transient beyond the budget", errs: []error{transient, transient, transient, transient}, wantCalls: 3, wantErr: transient},
+		{name: "permanent", errs: []error{permanent}, wantCalls: 1, wantErr: permanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryAPI(context.Background(), jctx, "test", isTransientAPIError, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMRetriesTransientErrors(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	jctx.APIRetries = 3
+	jctx.APIRetryMaxInterval = time.Millisecond
+	rc := cmd.RunConfig
+
+	// The failed request may have created the instance anyway, which the
+	// retry looks for before creating it again.
+	gomock.InOrder(
+		c.VMIs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(nil, apierrors.NewServerTimeout(kubevirtapi.Resource("virtualmachineinstances"), "create", 0)),
+		c.VMIs.EXPECT().List(gomock.Any(), gomock.Any()).Return(&kubevirtapi.VirtualMachineInstanceList{}, nil),
+	)
+	c.VMs.EXPECT().List(gomock.Any()).Return(&kubevirtapi.VirtualMachineList{}, nil)
+	created := c.expectCreate()
+
+	vm, err := CreateJobVM(context.Background(), c, jctx, &rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ObjectMeta.Name != created.ObjectMeta.Name {
+		t.Errorf("created %s, want %s", vm.ObjectMeta.Name, created.ObjectMeta.Name)
+	}
+}
+
+func TestRetryNameCollisions(t *testing.T) {
+	collision := apierrors.NewAlreadyExists(kubevirtapi.Resource("virtualmachineinstances"), "runner-1-x7k2p")
+	conflict := apierrors.NewConflict(kubevirtapi.Resource("virtualmachineinstances"), "runner-1-x7k2p", errors.New("contention"))
+	other := errors.New("denied")
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "collision, then success", errs: []error{collision}, wantCalls: 2},
+		{name: "conflict, then success", errs: []error{conflict, collision}, wantCalls: 3},
+		{name: "too many collisions", errs: []error{collision, collision, collision, collision, collision, collision}, wantCalls: maxNameCollisions, wantErr: true},
+		{name: "other error", errs: []error{other}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryNameCollisions("test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCreateJobVMNameCollisions(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	c := newFakeCluster(t)
+	jctx := testJobContext(t, cmd)
+	jctx.CloudInitUserData = "#cloud-config\n"
+	rc := cmd.RunConfig
+
+	// The first generated names of both the cloud-init secret and the
+	// instance are taken.
+	secrets := 0
+	c.Core.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if secrets++; secrets == 1 {
+			return true, nil, apierrors.NewAlreadyExists(k8sapi.Resource("secrets"), "taken")
+		}
+		return false, nil, nil
+	})
+	c.VMIs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(nil, apierrors.NewAlreadyExists(kubevirtapi.Resource("virtualmachineinstances"), "taken"))
+	vm := createTestVM(t, c, jctx, &rc)
+
+	if secrets != 2 {
+		t.Errorf("%d attempts at creating the cloud-init secret, want 2", secrets)
+	}
+	list, err := c.Core.CoreV1().Secrets("ci").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("%d secrets created, want 1", len(list.Items))
+	}
+	secret := list.Items[0]
+	if got := secret.StringData[cloudInitUserDataKey]; got != jctx.CloudInitUserData {
+		t.Errorf("secret user-data = %q, want %q", got, jctx.CloudInitUserData)
+	}
+	source := volumeSource(vm, cloudInitDiskName)
+	if source == nil || source.CloudInitNoCloud == nil || source.CloudInitNoCloud.UserDataSecretRef == nil ||
+		source.CloudInitNoCloud.UserDataSecretRef.Name != secret.ObjectMeta.Name {
+		t.Errorf("cloud-init volume %+v does not reference the secret %s", source, secret.ObjectMeta.Name)
+	}
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -14,6 +15,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,21 +23,61 @@ import (
 	"github.com/cenkalti/backoff/v4"
 	"github.com/helloyi/go-sshclient"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/text/encoding/unicode"
+	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
 type SSHConfig struct {
 	Port     string `name:"port" default:"22" help:"Port to ssh to"`
-	User     string `name:"user" help:"ssh username"`
+	User     string `name:"user" default:"runner" help:"ssh username"`
 	Password string `name:"password" xor:"auth" help:"ssh password"`
 	PrivKey  string `name:"private-key-file" xor:"auth" help:"ssh private key"`
+
+	KeySecret    string `name:"private-key-secret" xor:"auth" help:"name of a Secret of the namespace of the job holding the ssh private key, e.g. one matching a public key baked into the image; requires the permission to read it"`
+	KeySecretKey string `name:"private-key-secret-key" default:"ssh-privatekey" help:"key of the ssh private key in --ssh-private-key-secret"`
+
+	JumpHosts      []string `name:"jump-hosts" sep:"," help:"comma-separated [user@]host[:port] ssh jump hosts to reach the virtual machine through, in order, like ProxyJump"`
+	JumpPassword   string   `name:"jump-password" help:"ssh password for the jump hosts; defaults to the credentials of the virtual machine"`
+	JumpPrivKey    string   `name:"jump-private-key-file" help:"ssh private key for the jump hosts; defaults to the credentials of the virtual machine"`
+	JumpKnownHosts string   `name:"jump-known-hosts" xor:"jump-host-key" help:"known_hosts file to verify the host keys of the jump hosts against; required with --ssh-jump-hosts, unless --ssh-jump-insecure-ignore-host-key is set"`
+
+	JumpInsecureIgnoreHostKey bool `name:"jump-insecure-ignore-host-key" xor:"jump-host-key" help:"accept any host key from the jump hosts instead of verifying them against --ssh-jump-known-hosts, at the risk of connecting through an impostor"`
+
+	KeepaliveInterval time.Duration `name:"keepalive-interval" default:"15s" help:"how often to check that the ssh connection is still alive while idle, which also keeps NATs and firewalls along the way from dropping it; disabled when zero"`
+	KeepaliveCountMax int           `name:"keepalive-count-max" default:"3" help:"number of keepalives in a row that may go unanswered before the ssh connection is deemed dead and closed; never when zero"`
+
+	StrictHostKey bool `name:"strict-host-key" default:"true" negatable:"" help:"provision the ssh host key of the virtual machine through cloud-init, and only accept that one when connecting; with --no-ssh-strict-host-key, any host key is accepted"`
+
+	// HostKey is the public ssh host key provisioned for the virtual
+	// machine with StrictHostKey, in authorized_keys format.
+	HostKey string `kong:"-"`
+
+	// privateKey is the ephemeral key generated for the job when no
+	// credentials were configured, or the one read from KeySecret. It is
+	// never serialized.
+	privateKey []byte
+}
+
+// UseGeneratedKey returns whether the job authenticates with a keypair
+// generated during the prepare stage rather than configured credentials.
+func (config *SSHConfig) UseGeneratedKey() bool {
+	return config.Password == "" && config.PrivKey == "" && config.KeySecret == ""
+}
+
+type AddressConfig struct {
+	Strategy   string `name:"strategy" default:"first" enum:"first,interface,guest-agent" help:"how to pick the address of the virtual machine: the first interface, a named interface, or the one reported by the guest agent"`
+	Interface  string `name:"interface" help:"network name of the interface to use with the interface strategy"`
+	PreferIPv6 bool   `name:"prefer-ipv6" help:"prefer IPv6 addresses over IPv4 ones"`
 }
 
 type RunConfig struct {
-	Shell  string    `name:"shell" required enum:"bash,pwsh" help:"shell to use when executing script"`
-	Method string    `name:"method" default:"ssh" enum:"ssh" help:"method to execute script"`
-	SSH    SSHConfig `embed prefix:"ssh-" group:"SSH method options:"`
+	Shell   string        `name:"shell" default:"sh" enum:"sh,bash,pwsh" help:"shell to use when executing script"`
+	Method  string        `name:"method" default:"ssh" enum:"ssh" help:"method to execute script"`
+	GuestOS string        `name:"guest-os" default:"linux" enum:"linux,windows" help:"operating system of the guest"`
+	SSH     SSHConfig     `embed prefix:"ssh-" group:"SSH method options:"`
+	Address AddressConfig `embed:"" prefix:"address-" group:"Address options:"`
 }
 
 const RunConfigKey = labelPrefix + "/runconfig"
@@ -44,94 +86,321 @@ type RunCmd struct {
 	Script string `arg`
 	Stage  string `arg`
 
-	RetryTimeout time.Duration `default:"5m"`
-	DialTimeout  time.Duration `default:"10s"`
+	RetryTimeout      time.Duration `default:"5m"`
+	DialTimeout       time.Duration `default:"10s"`
+	HeartbeatInterval time.Duration `default:"1m"`
+	LivenessInterval  time.Duration `name:"liveness-interval" default:"10s" help:"how often to check that the Virtual Machine instance is still running while the script runs, aborting the script otherwise; disabled when zero"`
+
+	GuestAgentPingInterval  time.Duration `name:"guest-agent-ping-interval" help:"how often to ping the guest agent while the script runs, aborting the script once it stops answering for --guest-agent-ping-threshold; requires the QEMU guest agent in the guest; disabled when zero"`
+	GuestAgentPingThreshold time.Duration `name:"guest-agent-ping-threshold" default:"1m" help:"how long the guest agent may stay silent before the guest is deemed unresponsive"`
+
+	ScriptTimeout time.Duration `name:"script-timeout" help:"time after which the script of a stage is aborted, independently of --job-timeout; disabled when zero"`
+
+	ForwardEnv bool `name:"forward-env" help:"export the CI variables of the job (CUSTOM_ENV_*) to the script; scripts generated by GitLab Runner usually already set them"`
+
+	CopyOutDir    string   `name:"copy-out-dir" help:"local directory to copy the builds and cache directories of the Virtual Machine instance to, after the scripts of --copy-out-stages; disabled when empty"`
+	CopyOutStages []string `name:"copy-out-stages" sep:"," default:"step_script,after_script" help:"comma-separated stages after which to copy files out with --copy-out-dir"`
+	Dirs          `embed:""`
 }
 
 func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	if cmd.CopyOutDir != "" && cmd.BuildsDir == "" {
+		return fmt.Errorf("--copy-out-dir requires --builds-dir")
+	}
 
 	vm, err := FindJobVM(ctx, client, jctx)
 	if err != nil {
 		return err
 	}
+	if err := CheckPreparedInstance(client, jctx, vm); err != nil {
+		return err
+	}
 
 	var rc RunConfig
 	if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err != nil {
 		return err
 	}
 
+	parent := ctx
+	ctx, cancel := withJobDeadline(ctx, vm)
+	defer cancel()
+
 	if vm.Status.Phase != "Running" {
 		return fmt.Errorf("Virtual Machine instance %s is not running (phase: %v)", vm.ObjectMeta.Name, vm.Status.Phase)
 	}
-	if len(vm.Status.Interfaces) == 0 || vm.Status.Interfaces[0].IP == "" {
-		return fmt.Errorf("Virtual Machine instance %s has no IP; is it running?", vm.ObjectMeta.Name)
+
+	keepAlive, stopKeepAlive := context.WithCancel(ctx)
+	defer stopKeepAlive()
+	go KeepAlive(keepAlive, client, jctx, vm, cmd.HeartbeatInterval)
+
+	conn, err := Connect(ctx, client, jctx, vm, &rc, DialOptions{
+		Timeout:      cmd.DialTimeout,
+		RetryTimeout: cmd.RetryTimeout,
+		PollInterval: 5 * time.Second,
+	})
+	if jobTimedOut(parent, ctx) {
+		return jobTimeoutError(parent, client, jctx, vm)
 	}
-	ip := vm.Status.Interfaces[0].IP
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	timeout, stop := context.WithTimeout(ctx, cmd.RetryTimeout)
-	defer stop()
+	var env []string
+	if cmd.ForwardEnv {
+		env = JobEnv(os.Environ())
+	}
+	scriptCtx, abortScript := context.WithCancel(ctx)
+	if cmd.ScriptTimeout > 0 {
+		scriptCtx, abortScript = context.WithTimeout(ctx, cmd.ScriptTimeout)
+	}
+	defer abortScript()
+	lost := make(chan error, 1)
+	abort := func(err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+		abortScript()
+	}
+	go MonitorJobVM(scriptCtx, client, jctx, vm, cmd.LivenessInterval, abort)
+	go PingGuestAgent(scriptCtx, client, jctx, vm, cmd.GuestAgentPingInterval, cmd.GuestAgentPingThreshold, abort)
 
-	switch rc.Method {
-	case "ssh":
-		client, err := DialSSH(timeout, ip, rc.SSH, cmd.DialTimeout)
-		if err != nil {
-			return err
+	err = conn.RunScript(scriptCtx, rc.Shell, cmd.Script, cmd.Stage, env)
+	select {
+	case err := <-lost:
+		return err
+	default:
+	}
+
+	// Failed after_scripts don't fail the job.
+	var scripterr *ScriptError
+	if errors.As(err, &scripterr) && cmd.Stage != "after_script" {
+		if merr := MarkJobFailed(ctx, client, jctx, vm, cmd.Stage); merr != nil {
+			logger.Warn("recording failed stage", "vmi", vm.ObjectMeta.Name, "err", merr)
 		}
-		defer client.Close()
+	}
+	if jobTimedOut(parent, ctx) {
+		return jobTimeoutError(parent, client, jctx, vm)
+	}
+	if jobTimedOut(ctx, scriptCtx) {
+		return fmt.Errorf("script of stage %s did not finish within %v, see --script-timeout", cmd.Stage, cmd.ScriptTimeout)
+	}
+	if cmd.CopyOutDir == "" || !cmd.copiesOut(cmd.Stage) {
+		return err
+	}
 
-		ext := rc.Shell
-		switch rc.Shell {
-		case "pwsh":
-			ext = "ps1"
+	// The files are copied even when the script failed, for after_script
+	// and the artifacts uploaded on failure; not being able to copy them is
+	// a system failure, regardless of how the script went.
+	if err != nil && !errors.As(err, &scripterr) {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copying files out of Virtual Machine instance %s to %s\n", vm.ObjectMeta.Name, cmd.CopyOutDir)
+	if cerr := CopyOutDirs(ctx, conn, cmd.Dirs, cmd.CopyOutDir); cerr != nil {
+		return fmt.Errorf("copying files out of Virtual Machine instance %s: %w", vm.ObjectMeta.Name, cerr)
+	}
+	return err
+}
+
+func (cmd *RunCmd) copiesOut(stage string) bool {
+	for _, s := range cmd.CopyOutStages {
+		if s == stage {
+			return true
 		}
+	}
+	return false
+}
 
-		scriptPath := path.Join(cmd.Stage + "." + ext)
+// ScriptError is returned by RunScript when the script could be executed,
+// but did not succeed.
+type ScriptError struct {
+	ExitStatus int
+	Signal     string
+	Msg        string
+}
 
-		fmt.Fprintf(Debug, "uploading script %v\n", cmd.Script)
-		if err := client.Sftp().Upload(cmd.Script, scriptPath); err != nil {
-			return err
+func (e *ScriptError) Error() string {
+	switch {
+	case e.Signal != "":
+		return fmt.Sprintf("Command crashed with signal %v", e.Signal)
+	case e.ExitStatus != 0:
+		return fmt.Sprintf("Command exited with status %v", e.ExitStatus)
+	default:
+		return fmt.Sprintf("Command exited with message %q", e.Msg)
+	}
+}
+
+// RunScript uploads the script for the given stage to the virtual machine,
+// and executes it with shell, streaming its output to stdout and stderr.
+// The KEY=VALUE pairs of env are exported to the script.
+// A script that ran but failed results in a *ScriptError; any other error
+// means that the script could not be run at all. The connection is closed
+// if ctx gets cancelled while the script is running.
+func RunScript(ctx context.Context, conn *sshclient.Client, shell, script, stage string, env []string) error {
+	ext := shell
+	switch shell {
+	case "pwsh":
+		ext = "ps1"
+	}
+
+	scriptPath := path.Join(stage + "." + ext)
+
+	logger.Debug("uploading script", "script", script, "path", scriptPath)
+	if err := conn.Sftp().Upload(script, scriptPath); err != nil {
+		return err
+	}
+
+	if logger.Enabled(LevelDebug) {
+		if contents, err := os.ReadFile(script); err == nil {
+			logger.Debug("script contents", "script", script, "contents", string(contents))
+		} else {
+			logger.Debug("reading script contents", "script", script, "err", err)
 		}
+	}
 
-		if cli.Debug {
-			contents, err := os.ReadFile(cmd.Script)
-			fmt.Fprintf(Debug, "contents of %v:\n", cmd.Script)
-			if err == nil {
-				Debug.Write(contents)
-			} else {
-				fmt.Fprintf(Debug, "<ERROR: %v>", err)
-			}
-			fmt.Fprintf(Debug, "---\n", cmd.Script)
-		}
-
-		argv := generateShellArgv(rc.Shell, scriptPath)
-
-		fmt.Fprintf(Debug, "executing %v\n", argv)
-		if err := client.Cmd(shutil.Quote(argv)).SetStdio(os.Stdout, os.Stderr).Run(); err != nil {
-			var exiterr *ssh.ExitError
-			if errors.As(err, &exiterr) {
-				switch {
-				case exiterr.Signal() != "":
-					fmt.Fprintf(os.Stderr, "Command crashed with signal %v\n", exiterr.Signal())
-				case exiterr.ExitStatus() != 0:
-					fmt.Fprintf(os.Stderr, "Command exited with status %v\n", exiterr.ExitStatus())
-				default:
-					fmt.Fprintf(os.Stderr, "Command exited with message %q\n", exiterr.Msg())
-				}
-				buildFailureExit()
-			}
+	var envPath string
+	if len(env) > 0 {
+		envPath = path.Join(stage + ".env." + ext)
+		logger.Debug("uploading environment variables", "count", len(env), "path", envPath)
+		if err := writeSecretFile(conn, envPath, []byte(generateEnvScript(shell, env))); err != nil {
 			return err
 		}
-	default:
-		panic("unknown run method")
+		defer conn.Sftp().Remove(envPath)
+	}
+
+	argv := generateShellArgv(shell, scriptPath, envPath)
+
+	logger.Debug("executing script", "argv", strings.Join(argv, " "))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Cmd(shutil.Quote(argv)).SetStdio(os.Stdout, os.Stderr).Run()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = conn.Close()
+		<-done
+		return ctx.Err()
+	}
+
+	return scriptError(err)
+}
+
+// RunCommand executes command on the virtual machine, and returns its
+// output, standard error included. A command that ran but failed results in
+// a *ScriptError. The connection is closed if ctx gets cancelled while the
+// command is running.
+func RunCommand(ctx context.Context, conn *sshclient.Client, command string) ([]byte, error) {
+	logger.Debug("executing command", "command", command)
+
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Cmd(command).SetStdio(&out, &out).Run()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), scriptError(err)
+	case <-ctx.Done():
+		_ = conn.Close()
+		<-done
+		return out.Bytes(), ctx.Err()
+	}
+}
+
+// scriptError turns the exit error of a remote command into a *ScriptError.
+func scriptError(err error) error {
+	var exiterr *ssh.ExitError
+	if errors.As(err, &exiterr) {
+		return &ScriptError{
+			ExitStatus: exiterr.ExitStatus(),
+			Signal:     exiterr.Signal(),
+			Msg:        exiterr.Msg(),
+		}
+	}
+	return err
+}
+
+// writeSecretFile writes data to a remote file that only the user can read.
+// The permissions are changed before writing, since the sftp session does
+// not let us pick them at creation.
+func writeSecretFile(conn *sshclient.Client, name string, data []byte) error {
+	f, err := conn.Sftp().OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err = f.Chmod(0600); err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// JobEnv returns the CI variables of the job from environ, which GitLab
+// Runner passes with a CUSTOM_ENV_ prefix, as sorted KEY=VALUE pairs.
+// Variables whose name isn't a valid shell identifier are skipped.
+func JobEnv(environ []string) []string {
+	const prefix = "CUSTOM_ENV_"
+
+	var env []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		kv = kv[len(prefix):]
+		i := strings.IndexByte(kv, '=')
+		if i == -1 || !isShellIdentifier(kv[:i]) {
+			continue
+		}
+		env = append(env, kv)
 	}
+	sort.Strings(env)
+	return env
+}
 
-	return nil
+func isShellIdentifier(name string) bool {
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// generateEnvScript returns a script for shell that exports the KEY=VALUE
+// pairs of env when sourced. Values are quoted so that they are taken
+// literally, newlines and quotes included.
+func generateEnvScript(shell string, env []string) string {
+	var sb strings.Builder
+	for _, kv := range env {
+		kv := strings.SplitN(kv, "=", 2)
+		switch shell {
+		case "pwsh":
+			fmt.Fprintf(&sb, "$env:%s = '%s'\r\n", kv[0], strings.ReplaceAll(kv[1], "'", "''"))
+		default:
+			fmt.Fprintf(&sb, "export %s=%s\n", kv[0], shutil.Quote([]string{kv[1]}))
+		}
+	}
+	return sb.String()
 }
 
-func generateShellArgv(shell, script string) []string {
+func generateShellArgv(shell, script, envScript string) []string {
 	switch shell {
-	case "bash":
-		return []string{"bash", script}
+	case "sh", "bash":
+		if envScript != "" {
+			return []string{shell, "-c", ". ./" + envScript + " && exec " + shell + " " + shutil.Quote([]string{script})}
+		}
+		return []string{shell, script}
 	case "pwsh":
 		// See https://gitlab.com/gitlab-org/gitlab-runner/-/blob/d5e1f7b0adb2b54d136155e3bc3ef3e5ff74d217/shells/powershell.go#L89-126
 		// for an explanation of why the base64+utf16 encoding is necessary.
@@ -140,6 +409,9 @@ func generateShellArgv(shell, script string) []string {
 
 		var sb strings.Builder
 		sb.WriteString("$OutputEncoding = [console]::InputEncoding = [console]::OutputEncoding = New-Object System.Text.UTF8Encoding\r\n")
+		if envScript != "" {
+			sb.WriteString(". ./" + envScript + "\r\n")
+		}
 		sb.WriteString(shell + " " + script + "\r\n")
 		sb.WriteString("exit $LASTEXITCODE\r\n")
 		encoded, _ := encoder.String(sb.String())
@@ -163,47 +435,136 @@ func generateShellArgv(shell, script string) []string {
 	}
 }
 
-func DialSSH(ctx context.Context, ip string, config SSHConfig, dialTimeout time.Duration) (client *sshclient.Client, err error) {
+// DialOptions controls how DialVM and DialSSH connect to the Virtual Machine
+// instance.
+type DialOptions struct {
+	// Timeout bounds each connection attempt.
+	Timeout time.Duration
+	// RetryTimeout bounds the time spent retrying.
+	RetryTimeout time.Duration
+	// PollInterval is the maximum time between two attempts.
+	PollInterval time.Duration
+	// RetryHandshake also retries connections that fail after reaching the
+	// guest, e.g. because the authorized keys aren't set up yet.
+	RetryHandshake bool
+}
 
+func (opts DialOptions) backoff() *backoff.ExponentialBackOff {
 	back := backoff.NewExponentialBackOff()
-	back.MaxInterval = 5 * time.Second
+	back.MaxInterval = opts.PollInterval
+	if back.InitialInterval > back.MaxInterval {
+		back.InitialInterval = back.MaxInterval
+	}
+	back.MaxElapsedTime = 0
+	back.Reset()
+	return back
+}
+
+// DialVM connects to the Virtual Machine instance over ssh, retrying until
+// the connection succeeds or opts.RetryTimeout elapses, since sshd usually
+// takes a few seconds to come up after the instance reports as ready. The
+// instance is polled until it reports an address matching rc.Address.
+func DialVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	rc *RunConfig,
+	opts DialOptions,
+) (*sshclient.Client, error) {
+	timeoutCtx, stop := context.WithTimeout(ctx, opts.RetryTimeout)
+	defer stop()
+
+	back := opts.backoff()
 
 	for {
-		fmt.Fprintf(Debug, "attempting to connect to %s:%s...\n", ip, config.Port)
+		addr, err := JobVMAddress(vm, rc.Address)
+		if err == nil {
+			return DialSSH(timeoutCtx, addr, rc.SSH, opts)
+		}
+		if !errors.Is(err, ErrNoAddress) {
+			return nil, err
+		}
+		logger.Debug("waiting for an address", "vmi", vm.ObjectMeta.Name, "err", err)
+
 		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
+		case <-time.After(back.NextBackOff()):
+		case <-timeoutCtx.Done():
+			return nil, fmt.Errorf("Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
 		}
 
-		sshconfig := ssh.ClientConfig{
-			User:            config.User,
-			Timeout:         dialTimeout,
-			HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
+		if vm, err = FindJobVM(timeoutCtx, client, jctx); err != nil {
+			return nil, err
 		}
+	}
+}
 
-		if config.PrivKey != "" {
-			key, err := os.ReadFile(config.PrivKey)
-			if err != nil {
-				return nil, err
+// DialSSH connects to ip over ssh, retrying with exponential backoff for as
+// long as the address is unreachable, or the ssh handshake fails when
+// opts.RetryHandshake is set. When ctx is done before a connection could be
+// established, the last error is returned.
+func DialSSH(ctx context.Context, ip string, config SSHConfig, opts DialOptions) (client *sshclient.Client, err error) {
+
+	back := opts.backoff()
+
+	var lastErr error
+	for {
+		logger.Debug("connecting over ssh", "addr", net.JoinHostPort(ip, config.Port))
+		if err := ctx.Err(); err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("giving up connecting to %s:%s: %w", ip, config.Port, lastErr)
 			}
+			return nil, err
+		}
 
-			signer, err := ssh.ParsePrivateKey(key)
+		key := config.privateKey
+		if config.PrivKey != "" {
+			key, err = os.ReadFile(config.PrivKey)
 			if err != nil {
 				return nil, err
 			}
-
-			sshconfig.Auth = append(sshconfig.Auth, ssh.PublicKeys(signer))
+		}
+		auth, err := sshAuth(key, config.Password)
+		if err != nil {
+			return nil, err
+		}
+		sshconfig := ssh.ClientConfig{
+			User:    config.User,
+			Auth:    auth,
+			Timeout: opts.Timeout,
 		}
 
-		sshconfig.Auth = append(sshconfig.Auth, ssh.Password(config.Password))
+		// The handshake error does not wrap the error of the callback, so it
+		// is recorded for mismatched host keys to not get retried, unless
+		// retrying handshakes: sshd may start with the host keys of the
+		// image before cloud-init replaces them.
+		var hostKeyErr error
+		verify, algorithms, err := hostKeyCallback(config)
+		if err != nil {
+			return nil, err
+		}
+		sshconfig.HostKeyAlgorithms = algorithms
+		sshconfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = verify(hostname, remote, key)
+			return hostKeyErr
+		}
 
-		client, err = sshclient.Dial("tcp", ip+":"+config.Port, &sshconfig)
+		client, err = dialThroughJumpHosts(net.JoinHostPort(ip, config.Port), config, &sshconfig)
 		var netErr *net.OpError
+		var chanErr *ssh.OpenChannelError
+		var jumpErr *JumpHostError
 		switch {
-		case errors.As(err, &netErr) && netErr.Op == "dial":
-			fmt.Fprintln(Debug, err)
-			time.Sleep(back.NextBackOff())
+		case errors.As(err, &jumpErr):
+			return nil, err
+		case err != nil && hostKeyErr != nil && !opts.RetryHandshake:
+			return nil, fmt.Errorf("verifying ssh host key of %s: %w", ip, hostKeyErr)
+		case errors.As(err, &netErr) && netErr.Op == "dial", errors.As(err, &chanErr), err != nil && opts.RetryHandshake:
+			logger.Debug("ssh connection failed, retrying", "addr", net.JoinHostPort(ip, config.Port), "err", err)
+			lastErr = err
+			select {
+			case <-time.After(back.NextBackOff()):
+			case <-ctx.Done():
+			}
 			continue
 		case err != nil:
 			return nil, err
@@ -211,3 +572,204 @@ func DialSSH(ctx context.Context, ip string, config SSHConfig, dialTimeout time.
 		return client, nil
 	}
 }
+
+// KeepAliveSSH sends a keepalive request over conn every interval until it
+// is closed, and closes it once countMax of them in a row went unanswered
+// within an interval. A non-positive interval disables keepalives.
+func KeepAliveSSH(conn *sshclient.Client, interval time.Duration, countMax int) {
+	if interval <= 0 {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.UnderlyingClient().Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		// Servers that don't know the request still answer it, which is
+		// all that matters.
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.UnderlyingClient().SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+			missed = 0
+			continue
+		case <-time.After(interval):
+			missed++
+		case <-closed:
+			return
+		}
+		logger.Debug("ssh keepalive unanswered", "missed", missed)
+		if countMax > 0 && missed >= countMax {
+			logger.Warn("ssh connection is dead, closing it", "missed", missed)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// hostKeyCallback returns how to verify the host key of the virtual
+// machine, and the host key algorithms to ask for: only the host key that
+// was provisioned with config.StrictHostKey, or any otherwise.
+func hostKeyCallback(config SSHConfig) (ssh.HostKeyCallback, []string, error) {
+	if !config.StrictHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	if config.HostKey == "" {
+		return nil, nil, fmt.Errorf("no ssh host key was provisioned for the virtual machine; was it created with --no-ssh-strict-host-key?")
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ssh host key: %w", err)
+	}
+	return ssh.FixedHostKey(key), []string{key.Type()}, nil
+}
+
+// sshAuth returns the ssh authentication methods for the private key, if
+// any, then the password.
+func sshAuth(key []byte, password string) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	if key != nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	return append(auth, ssh.Password(password)), nil
+}
+
+// JumpHostError is an error connecting to one of the jump hosts, rather
+// than to the virtual machine itself.
+type JumpHostError struct {
+	Host string
+	Err  error
+}
+
+func (e *JumpHostError) Error() string {
+	return fmt.Sprintf("jump host %s: %v", e.Host, e.Err)
+}
+
+func (e *JumpHostError) Unwrap() error {
+	return e.Err
+}
+
+// parseJumpHost parses a [user@]host[:port] jump host, defaulting to the
+// given user and port 22.
+func parseJumpHost(spec, user string) (string, string) {
+	host := spec
+	if i := strings.LastIndexByte(host, '@'); i != -1 {
+		user, host = host[:i], host[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return user, host
+}
+
+// jumpHostKeyCallback returns how the host keys of the jump hosts of config
+// are verified. Without known hosts, any host key is only accepted when
+// explicitly asked for.
+func jumpHostKeyCallback(config SSHConfig) (ssh.HostKeyCallback, error) {
+	switch {
+	case config.JumpKnownHosts != "":
+		verify, err := knownhosts.New(config.JumpKnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("loading known hosts of the jump hosts: %w", err)
+		}
+		return verify, nil
+	case config.JumpInsecureIgnoreHostKey:
+		return ssh.InsecureIgnoreHostKey(), nil
+	default:
+		return nil, ErrJumpHostKeyUnverified
+	}
+}
+
+// ErrJumpHostKeyUnverified is returned when jump hosts are configured
+// without a way to verify their host keys.
+var ErrJumpHostKeyUnverified = errors.New("verifying the host keys of the jump hosts requires --ssh-jump-known-hosts; pass --ssh-jump-insecure-ignore-host-key to accept any")
+
+// dialThroughJumpHosts connects to addr over ssh, hopping through the jump
+// hosts of config in order. The connections to the jump hosts are closed
+// along with the returned client.
+func dialThroughJumpHosts(addr string, config SSHConfig, sshconfig *ssh.ClientConfig) (*sshclient.Client, error) {
+	if len(config.JumpHosts) == 0 {
+		return sshclient.Dial("tcp", addr, sshconfig)
+	}
+
+	auth := sshconfig.Auth
+	if config.JumpPrivKey != "" || config.JumpPassword != "" {
+		var key []byte
+		if config.JumpPrivKey != "" {
+			var err error
+			if key, err = os.ReadFile(config.JumpPrivKey); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if auth, err = sshAuth(key, config.JumpPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	verify, err := jumpHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var hops []*sshclient.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	for _, spec := range config.JumpHosts {
+		user, host := parseJumpHost(spec, sshconfig.User)
+		jumpconfig := *sshconfig
+		jumpconfig.User = user
+		jumpconfig.Auth = auth
+		jumpconfig.HostKeyCallback = verify
+		jumpconfig.HostKeyAlgorithms = nil
+
+		logger.Debug("connecting to jump host", "addr", host, "user", user)
+		var hop *sshclient.Client
+		var err error
+		if len(hops) == 0 {
+			hop, err = sshclient.Dial("tcp", host, &jumpconfig)
+		} else {
+			hop, err = hops[len(hops)-1].Dial("tcp", host, &jumpconfig)
+		}
+		if err != nil {
+			closeHops()
+			return nil, &JumpHostError{Host: host, Err: err}
+		}
+		hops = append(hops, hop)
+	}
+
+	client, err := hops[len(hops)-1].Dial("tcp", addr, sshconfig)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	go func() {
+		_ = client.UnderlyingClient().Wait()
+		closeHops()
+	}()
+	return client, nil
+}
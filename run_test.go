@@ -0,0 +1,232 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/helloyi/go-sshclient"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKeepAliveSSH(t *testing.T) {
+	priv, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A hung guest still has its TCP connection open, but answers nothing.
+	silent := func(reqs <-chan *ssh.Request) {
+		for range reqs {
+		}
+	}
+
+	tests := []struct {
+		name      string
+		requests  func(<-chan *ssh.Request)
+		wantAlive bool
+	}{
+		{name: "answering server", requests: ssh.DiscardRequests, wantAlive: true},
+		{name: "silent server", requests: silent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveSSHRequests(t, priv, tt.requests)
+			conn, err := sshclient.Dial("tcp", addr, &ssh.ClientConfig{
+				User:            "root",
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				KeepAliveSSH(conn, 10*time.Millisecond, 3)
+			}()
+
+			select {
+			case <-done:
+				if tt.wantAlive {
+					t.Fatal("KeepAliveSSH gave up on a live connection")
+				}
+				// The connection was closed, so the script is not left
+				// hanging on it.
+				if _, _, err := conn.UnderlyingClient().SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					t.Error("the dead connection is still open")
+				}
+			case <-time.After(500 * time.Millisecond):
+				if !tt.wantAlive {
+					t.Fatal("KeepAliveSSH did not close the dead connection")
+				}
+				conn.Close()
+				<-done
+			}
+		})
+	}
+}
+
+func TestJobEnv(t *testing.T) {
+	got := JobEnv([]string{
+		"CUSTOM_ENV_CI_PROJECT_PATH=group/project",
+		"CUSTOM_ENV_CI_JOB_ID=42",
+		"CUSTOM_ENV_EQUALS=a=b",
+		"CUSTOM_ENV_not-an-identifier=x",
+		"CUSTOM_ENV_9LIVES=x",
+		"CUSTOM_ENV_=x",
+		"CUSTOM_ENV_NOVALUE",
+		"HOME=/root",
+	})
+	want := []string{"CI_JOB_ID=42", "CI_PROJECT_PATH=group/project", "EQUALS=a=b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JobEnv = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateEnvScript(t *testing.T) {
+	values := map[string]string{
+		"QUOTES":   `it's "quoted"`,
+		"DOLLAR":   "$HOME ${HOME} $(echo expanded) `echo expanded`",
+		"NEWLINES": "line 1\nline 2\n",
+		"SPECIAL":  `back\slash; & | > < * ? ! # ~`,
+		"SPACES":   "  padded  ",
+		"EMPTY":    "",
+	}
+	var env []string
+	for k, v := range values {
+		env = append(env, k+"="+v)
+	}
+
+	for _, shell := range []string{"sh", "bash"} {
+		t.Run(shell, func(t *testing.T) {
+			if _, err := exec.LookPath(shell); err != nil {
+				t.Skip(err)
+			}
+			dir := t.TempDir()
+			envScript := "kubevirt_build_script.env." + shell
+			script := "kubevirt_build_script." + shell
+			if err := os.WriteFile(filepath.Join(dir, envScript), []byte(generateEnvScript(shell, env)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var sb strings.Builder
+			for k := range values {
+				sb.WriteString(`printf '%s=%s\0' ` + k + ` "$` + k + `"` + "\n")
+			}
+			if err := os.WriteFile(filepath.Join(dir, script), []byte(sb.String()), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			argv := generateShellArgv(shell, script, envScript)
+			run := exec.Command(argv[0], argv[1:]...)
+			run.Dir = dir
+			run.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=/nonexistent"}
+			out, err := run.Output()
+			if err != nil {
+				t.Fatalf("running %q: %v", argv, err)
+			}
+
+			got := map[string]string{}
+			for _, kv := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+				kv := strings.SplitN(kv, "=", 2)
+				got[kv[0]] = kv[1]
+			}
+			if !reflect.DeepEqual(got, values) {
+				t.Errorf("script environment = %q, want %q", got, values)
+			}
+		})
+	}
+
+	t.Run("pwsh", func(t *testing.T) {
+		got := generateEnvScript("pwsh", []string{`QUOTES=it's "quoted"`, "DOLLAR=$env:HOME"})
+		want := "$env:QUOTES = 'it''s \"quoted\"'\r\n$env:DOLLAR = '$env:HOME'\r\n"
+		if got != want {
+			t.Errorf("env script = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestJumpHostKeyCallback(t *testing.T) {
+	hostKey := func() ssh.PublicKey {
+		_, pub, err := GenerateHostKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	known, impostor := hostKey(), hostKey()
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("bastion.example.com:22")}, known) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unverified by default", func(t *testing.T) {
+		_, err := jumpHostKeyCallback(SSHConfig{JumpHosts: []string{"bastion.example.com"}})
+		if !errors.Is(err, ErrJumpHostKeyUnverified) {
+			t.Errorf("err = %v, want %v", err, ErrJumpHostKeyUnverified)
+		}
+	})
+
+	t.Run("known hosts", func(t *testing.T) {
+		verify, err := jumpHostKeyCallback(SSHConfig{JumpHosts: []string{"bastion.example.com"}, JumpKnownHosts: knownHosts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify("bastion.example.com:22", addr, known); err != nil {
+			t.Errorf("known host key rejected: %v", err)
+		}
+		if err := verify("bastion.example.com:22", addr, impostor); err == nil {
+			t.Errorf("impostor host key accepted")
+		}
+	})
+
+	t.Run("missing known hosts", func(t *testing.T) {
+		_, err := jumpHostKeyCallback(SSHConfig{JumpHosts: []string{"bastion.example.com"}, JumpKnownHosts: knownHosts + ".missing"})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("err = %v, want a missing file", err)
+		}
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		verify, err := jumpHostKeyCallback(SSHConfig{JumpHosts: []string{"bastion.example.com"}, JumpInsecureIgnoreHostKey: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify("bastion.example.com:22", addr, impostor); err != nil {
+			t.Errorf("host key rejected: %v", err)
+		}
+	})
+
+	t.Run("both", func(t *testing.T) {
+		var cli struct {
+			SSH SSHConfig `embed:"" prefix:"ssh-"`
+		}
+		parser, err := kong.New(&cli, kong.Exit(func(int) { t.Fatal("kong exited") }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.Parse([]string{"--ssh-jump-known-hosts=" + knownHosts, "--ssh-jump-insecure-ignore-host-key"}); err == nil {
+			t.Errorf("both verifying and ignoring the host keys of the jump hosts was accepted")
+		}
+	})
+}
@@ -0,0 +1,296 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// The services of a job (services: in .gitlab-ci.yml) run as pods next to
+// its Virtual Machine instance, each with the hostname of the service, in a
+// subdomain backed by a headless Service that is specific to the job. That
+// subdomain is added to the DNS search domains of the instance, so that the
+// guest reaches a service by its hostname, as long as it resolves names
+// through the cluster DNS, e.g. over the pod network.
+//
+// Everything is owned by the instance, and goes away with it.
+
+// maxServices is how many services of a job are started; the others are
+// ignored.
+const maxServices = 1
+
+// Service is a service of the job, as passed by GitLab Runner in
+// CUSTOM_ENV_CI_JOB_SERVICES.
+type Service struct {
+	Name       string   `json:"name"`
+	Alias      string   `json:"alias"`
+	Entrypoint []string `json:"entrypoint"`
+	Command    []string `json:"command"`
+}
+
+// ParseServices parses the JSON list of services of the job.
+func ParseServices(data string) ([]Service, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var services []Service
+	if err := json.Unmarshal([]byte(data), &services); err != nil {
+		return nil, fmt.Errorf("invalid services: %w", err)
+	}
+	for i, svc := range services {
+		if svc.Name == "" {
+			return nil, fmt.Errorf("invalid services: service %d has no image", i)
+		}
+	}
+	return services, nil
+}
+
+// Hostname returns the hostname of the service: its alias, or else the
+// repository of its image with slashes replaced by dashes, like GitLab
+// Runner does, e.g. registry.internal/ci/postgres:13 gives
+// registry.internal-ci-postgres.
+func (svc Service) Hostname() string {
+	if svc.Alias != "" {
+		return svc.Alias
+	}
+	name := svc.Name
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		name = name[:i]
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// checkServices returns an error if a service of the job has an image that
+// isn't allowed, or a hostname that the cluster DNS cannot serve.
+func checkServices(jctx *JobContext) error {
+	hostnames := map[string]bool{}
+	for _, svc := range jctx.Services {
+		if err := checkImageAllowed(svc.Name, jctx.AllowedImages); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		hostname := svc.Hostname()
+		if errs := validation.IsDNS1123Label(hostname); len(errs) > 0 {
+			return fmt.Errorf("service %s: invalid hostname %q, set an alias: %s", svc.Name, hostname, strings.Join(errs, "; "))
+		}
+		if hostnames[hostname] {
+			return fmt.Errorf("service %s: hostname %q is used more than once", svc.Name, hostname)
+		}
+		hostnames[hostname] = true
+		if _, err := imagePullPolicy(jctx.ImagePullPolicy, svc.Name); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+	return nil
+}
+
+// servicesSubdomain returns the name of the headless Service of the
+// services of the job.
+func servicesSubdomain(jctx *JobContext) string {
+	return "svc-" + jctx.ID
+}
+
+// servicesSearchDomain returns the DNS search domain under which the
+// services of the job resolve.
+func servicesSearchDomain(jctx *JobContext) string {
+	return fmt.Sprintf("%s.%s.svc.%s", servicesSubdomain(jctx), jctx.Namespace, jctx.ClusterDomain)
+}
+
+// servicesSelector returns the labels of the pods of the services of the
+// job. They are distinct from the labels of the instance, which Selector
+// matches.
+func servicesSelector(jctx *JobContext) map[string]string {
+	return map[string]string{
+		jobLabel(jctx, "services-of"): jctx.ID,
+	}
+}
+
+// CreateJobServices starts the services of the job, passing them its CI
+// variables through a Secret rather than in the pod specs.
+func CreateJobServices(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	env []string,
+) error {
+	if len(jctx.Services) == 0 {
+		return nil
+	}
+	owner := []metav1.OwnerReference{OwnerReference(vm)}
+
+	headless := k8sapi.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            servicesSubdomain(jctx),
+			Labels:          servicesSelector(jctx),
+			OwnerReferences: owner,
+		},
+		Spec: k8sapi.ServiceSpec{
+			ClusterIP:                k8sapi.ClusterIPNone,
+			Selector:                 servicesSelector(jctx),
+			PublishNotReadyAddresses: true,
+		},
+	}
+	if _, err := client.CoreV1().Services(jctx.Namespace).Create(ctx, &headless, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating headless service: %w", err)
+	}
+
+	variables := k8sapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    jctx.BaseName + "-services-",
+			Labels:          servicesSelector(jctx),
+			OwnerReferences: owner,
+		},
+		StringData: map[string]string{},
+	}
+	for _, kv := range env {
+		kv := strings.SplitN(kv, "=", 2)
+		variables.StringData[kv[0]] = kv[1]
+	}
+	var secret *k8sapi.Secret
+	err := retryNameCollisions("create service variables secret", func() error {
+		var err error
+		secret, err = client.CoreV1().Secrets(jctx.Namespace).Create(ctx, &variables, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("storing service variables: %w", err)
+	}
+
+	var pullSecrets []k8sapi.LocalObjectReference
+	for _, name := range jctx.ImagePullSecrets {
+		pullSecrets = append(pullSecrets, k8sapi.LocalObjectReference{Name: name})
+	}
+
+	for _, svc := range jctx.Services {
+		pullPolicy, err := imagePullPolicy(jctx.ImagePullPolicy, svc.Name)
+		if err != nil {
+			return err
+		}
+		hostname := svc.Hostname()
+		labels := servicesSelector(jctx)
+		labels[jobLabel(jctx, "service")] = hostname
+
+		pod := k8sapi.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName:    jctx.BaseName + "-" + hostname + "-",
+				Labels:          labels,
+				OwnerReferences: owner,
+			},
+			Spec: k8sapi.PodSpec{
+				Hostname:         hostname,
+				Subdomain:        servicesSubdomain(jctx),
+				RestartPolicy:    k8sapi.RestartPolicyNever,
+				NodeSelector:     jctx.NodeSelector,
+				Tolerations:      jctx.Tolerations,
+				ImagePullSecrets: pullSecrets,
+				Containers: []k8sapi.Container{
+					{
+						Name:            "service",
+						Image:           svc.Name,
+						ImagePullPolicy: pullPolicy,
+						Command:         svc.Entrypoint,
+						Args:            svc.Command,
+						EnvFrom: []k8sapi.EnvFromSource{
+							{
+								SecretRef: &k8sapi.SecretEnvSource{
+									LocalObjectReference: k8sapi.LocalObjectReference{Name: secret.ObjectMeta.Name},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		var created *k8sapi.Pod
+		err = retryNameCollisions("create service pod", func() error {
+			var err error
+			created, err = client.CoreV1().Pods(jctx.Namespace).Create(ctx, &pod, metav1.CreateOptions{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("starting service %s: %w", svc.Name, err)
+		}
+		logger.Info("started service", "service", svc.Name, "hostname", hostname, "pod", created.ObjectMeta.Name)
+	}
+	return nil
+}
+
+// WaitForJobServices waits for the containers of the services of the job to
+// be running. Services have no way of telling when they are ready to serve,
+// so the job may still have to wait for them.
+func WaitForJobServices(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, timeout time.Duration) error {
+	if len(jctx.Services) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	selector := metav1.FormatLabelSelector(metav1.SetAsLabelSelector(servicesSelector(jctx)))
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		list, err := client.CoreV1().Pods(jctx.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return fmt.Errorf("listing services: %w", err)
+		}
+		running := 0
+		for _, pod := range list.Items {
+			if err := checkServicePod(jctx, &pod); err != nil {
+				return err
+			}
+			if pod.Status.Phase == k8sapi.PodRunning {
+				running++
+			}
+		}
+		if running == len(jctx.Services) {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for services: %d of %d running", running, len(jctx.Services))
+		}
+	}
+}
+
+func checkServicePod(jctx *JobContext, pod *k8sapi.Pod) error {
+	hostname := pod.ObjectMeta.Labels[jobLabel(jctx, "service")]
+	if pod.Status.Phase == k8sapi.PodFailed || pod.Status.Phase == k8sapi.PodSucceeded {
+		return fmt.Errorf("service %s exited", hostname)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && isFatalReason(jctx, status.State.Waiting.Reason) {
+			return fmt.Errorf("service %s: %w", hostname, reasonError(status.State.Waiting.Reason, status.State.Waiting.Message))
+		}
+	}
+	return nil
+}
+
+// selectServices returns the services of the job that get started, warning
+// about the others.
+func selectServices(services []Service) []Service {
+	if len(services) <= maxServices {
+		return services
+	}
+	for _, svc := range services[maxServices:] {
+		logger.Warn("ignoring service, too many services", "service", svc.Name, "max", maxServices)
+	}
+	return services[:maxServices]
+}
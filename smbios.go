@@ -0,0 +1,75 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// SMBIOS is the system information reported by the firmware of the guest.
+//
+// KubeVirt only lets instances set their serial number: the manufacturer,
+// product, version and family are configured cluster-wide, in the
+// spec.configuration.smbios of the KubeVirt resource. They are checked
+// against it, so that images expecting other values fail with an error
+// rather than refusing to boot.
+type SMBIOS struct {
+	Manufacturer string `name:"manufacturer" help:"SMBIOS manufacturer that the guest must see; must match the configuration of KubeVirt"`
+	Product      string `name:"product" help:"SMBIOS product that the guest must see; must match the configuration of KubeVirt"`
+	Version      string `name:"version" help:"SMBIOS version that the guest must see; must match the configuration of KubeVirt"`
+	Serial       string `name:"serial" help:"SMBIOS serial number of the guest"`
+	Family       string `name:"family" help:"SMBIOS family that the guest must see; must match the configuration of KubeVirt"`
+}
+
+// defaultSMBIOS is what KubeVirt reports when it configures no SMBIOS.
+var defaultSMBIOS = kubevirtapi.SMBiosConfiguration{
+	Manufacturer: "KubeVirt",
+	Product:      "None",
+	Family:       "KubeVirt",
+}
+
+// checkClusterSMBIOS returns an error unless the cluster-wide SMBIOS
+// configuration matches the fields of want other than the serial number.
+// Not being allowed to read the configuration is only logged.
+func checkClusterSMBIOS(client kubevirt.KubevirtClient, want SMBIOS) error {
+	if want.Manufacturer == "" && want.Product == "" && want.Version == "" && want.Family == "" {
+		return nil
+	}
+
+	list, err := client.KubeVirt(metav1.NamespaceAll).List(&metav1.ListOptions{})
+	if err != nil || len(list.Items) == 0 {
+		logger.Warn("cannot check the SMBIOS configuration of KubeVirt", "err", err)
+		return nil
+	}
+	actual := defaultSMBIOS
+	if config := list.Items[0].Spec.Configuration.SMBIOSConfig; config != nil {
+		actual = *config
+	}
+
+	fields := []struct {
+		Name, Want, Actual string
+	}{
+		{"manufacturer", want.Manufacturer, actual.Manufacturer},
+		{"product", want.Product, actual.Product},
+		{"version", want.Version, actual.Version},
+		{"family", want.Family, actual.Family},
+	}
+	var errs []string
+	for _, f := range fields {
+		if f.Want != "" && f.Want != f.Actual {
+			errs = append(errs, fmt.Sprintf("%s is %q, not %q", f.Name, f.Actual, f.Want))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the SMBIOS configuration of KubeVirt does not match: %s; only the serial number can be set per instance", strings.Join(errs, ", "))
+	}
+	return nil
+}
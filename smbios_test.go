@@ -0,0 +1,81 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+func TestCreateJobVMSMBIOS(t *testing.T) {
+	acme := &kubevirtapi.SMBiosConfiguration{Manufacturer: "Acme", Product: "Builder", Family: "CI"}
+
+	tests := []struct {
+		name       string
+		args       []string
+		cluster    *kubevirtapi.SMBiosConfiguration // nil: KubeVirt is not listed
+		defaults   bool                             // KubeVirt has no SMBIOS configuration
+		listErr    error
+		wantSerial string
+		wantErr    string
+	}{
+		{name: "empty"},
+		{name: "serial", args: []string{"--default-smbios-serial=build-1"}, wantSerial: "build-1"},
+		{
+			name:       "matching",
+			args:       []string{"--default-smbios-manufacturer=Acme", "--default-smbios-product=Builder", "--default-smbios-serial=build-1"},
+			cluster:    acme,
+			wantSerial: "build-1",
+		},
+		{name: "matching the defaults of KubeVirt", args: []string{"--default-smbios-manufacturer=KubeVirt"}, defaults: true},
+		{
+			name:    "mismatching",
+			args:    []string{"--default-smbios-manufacturer=Acme", "--default-smbios-family=Other"},
+			cluster: acme,
+			wantErr: `family is "CI", not "Other"`,
+		},
+		{name: "mismatching the defaults of KubeVirt", args: []string{"--default-smbios-manufacturer=Acme"}, defaults: true, wantErr: `manufacturer is "KubeVirt", not "Acme"`},
+		{name: "not allowed to check", args: []string{"--default-smbios-manufacturer=Acme"}, listErr: apierrors.NewForbidden(kubevirtapi.Resource("kubevirts"), "", nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testPrepareCmd(t, tt.args...)
+			c := newFakeCluster(t)
+			jctx := testJobContext(t, cmd)
+			rc := cmd.RunConfig
+
+			if tt.cluster != nil || tt.defaults || tt.listErr != nil {
+				kv := kubevirt.NewMockKubeVirtInterface(gomock.NewController(t))
+				c.EXPECT().KubeVirt(gomock.Any()).Return(kv)
+				list := &kubevirtapi.KubeVirtList{Items: []kubevirtapi.KubeVirt{{}}}
+				list.Items[0].Spec.Configuration.SMBIOSConfig = tt.cluster
+				if tt.listErr != nil {
+					list = nil
+				}
+				kv.EXPECT().List(gomock.Any()).Return(list, tt.listErr)
+			}
+
+			if tt.wantErr != "" {
+				createTestVMError(t, c, jctx, &rc, tt.wantErr)
+				return
+			}
+			firmware := createTestVM(t, c, jctx, &rc).Spec.Domain.Firmware
+			if tt.wantSerial == "" {
+				if firmware != nil {
+					t.Errorf("unexpected firmware %+v", firmware)
+				}
+				return
+			}
+			if firmware == nil || firmware.Serial != tt.wantSerial {
+				t.Errorf("firmware = %+v, want the serial %s", firmware, tt.wantSerial)
+			}
+		})
+	}
+}
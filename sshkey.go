@@ -0,0 +1,127 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// GenerateSSHKey generates an ephemeral ed25519 keypair, returning the
+// PEM-encoded private key and the public key in authorized_keys format.
+func GenerateSSHKey() (priv []byte, pub string, err error) {
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	sshpub, err := ssh.NewPublicKey(pubkey)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privkey)
+	if err != nil {
+		return nil, "", err
+	}
+	priv = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return priv, string(ssh.MarshalAuthorizedKey(sshpub)), nil
+}
+
+// GenerateHostKey generates an ECDSA P-256 ssh host key for the guest,
+// returning the PEM-encoded private key and the public key in
+// authorized_keys format. Unlike PKCS#8 ed25519 keys, OpenSSH reads such
+// private keys in any version.
+func GenerateHostKey() (priv []byte, pub string, err error) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	sshpub, err := ssh.NewPublicKey(&privkey.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalECPrivateKey(privkey)
+	if err != nil {
+		return nil, "", err
+	}
+	priv = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return priv, string(ssh.MarshalAuthorizedKey(sshpub)), nil
+}
+
+// CreateJobSSHKeySecret stores the job's private key in a Secret owned by
+// the job's Virtual Machine instance, so that it never outlives the job.
+func CreateJobSSHKeySecret(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	priv []byte,
+) error {
+	secret := k8sapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: jctx.BaseName,
+			Labels: map[string]string{
+				jobLabel(jctx, "id"): jctx.ID,
+			},
+			OwnerReferences: []metav1.OwnerReference{OwnerReference(vm)},
+		},
+		Type: k8sapi.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			k8sapi.SSHAuthPrivateKey: priv,
+		},
+	}
+	return retryNameCollisions("create ssh key secret", func() error {
+		_, err := client.CoreV1().Secrets(jctx.Namespace).Create(ctx, &secret, metav1.CreateOptions{})
+		return err
+	})
+}
+
+// FindJobSSHKey retrieves the private key generated for the job during the
+// prepare stage.
+func FindJobSSHKey(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) ([]byte, error) {
+	list, err := client.CoreV1().Secrets(jctx.Namespace).List(ctx, *Selector(jctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no ssh key secret found for job with ID %v", jctx.ID)
+	}
+	if len(list.Items) > 1 {
+		return nil, fmt.Errorf("ssh key secret has ambiguous ID! %d secrets found with ID %v", len(list.Items), jctx.ID)
+	}
+	key, ok := list.Items[0].Data[k8sapi.SSHAuthPrivateKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no %s key", list.Items[0].ObjectMeta.Name, k8sapi.SSHAuthPrivateKey)
+	}
+	return key, nil
+}
+
+// LoadSSHKeySecret reads the private key stored under key in the named
+// Secret of the namespace of the job, e.g. one matching a public key baked
+// into the image.
+func LoadSSHKeySecret(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, name, key string) ([]byte, error) {
+	secret, err := client.CoreV1().Secrets(jctx.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("reading ssh key secret %s: %w", name, err)
+	}
+	priv, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("ssh key secret %s has no %s key", name, key)
+	}
+	return priv, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSSH runs an ssh server presenting the host key priv on a local
+// port, accepting any client, until the test ends. It returns its address.
+func serveSSH(t *testing.T, priv []byte) string {
+	t.Helper()
+	return serveSSHRequests(t, priv, ssh.DiscardRequests)
+}
+
+// serveSSHRequests is like serveSSH, handling the global requests of the
+// clients with requests.
+func serveSSHRequests(t *testing.T, priv []byte, requests func(<-chan *ssh.Request)) string {
+	t.Helper()
+	signer, err := ssh.ParsePrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go requests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	priv, pub, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPub, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveSSH(t, priv)
+
+	tests := []struct {
+		name       string
+		config     SSHConfig
+		wantConfig bool
+		wantDial   bool
+	}{
+		{"strict with the provisioned key", SSHConfig{StrictHostKey: true, HostKey: pub}, true, true},
+		{"strict with another key", SSHConfig{StrictHostKey: true, HostKey: otherPub}, true, false},
+		{"strict without a key", SSHConfig{StrictHostKey: true}, false, false},
+		{"strict with a garbled key", SSHConfig{StrictHostKey: true, HostKey: "ecdsa-sha2-nistp256 garbage"}, false, false},
+		{"insecure", SSHConfig{}, true, true},
+		{"insecure with another key", SSHConfig{HostKey: otherPub}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verify, algorithms, err := hostKeyCallback(tt.config)
+			if (err == nil) != tt.wantConfig {
+				t.Fatalf("hostKeyCallback: err = %v, want error: %v", err, !tt.wantConfig)
+			}
+			if err != nil {
+				return
+			}
+			conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User:              "root",
+				HostKeyCallback:   verify,
+				HostKeyAlgorithms: algorithms,
+			})
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != tt.wantDial {
+				t.Errorf("dialing: err = %v, want error: %v", err, !tt.wantDial)
+			}
+		})
+	}
+}
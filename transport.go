@@ -0,0 +1,155 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/helloyi/go-sshclient"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Transport executes the scripts of the job on its Virtual Machine instance.
+type Transport interface {
+	// RunScript uploads the local script for the given stage, and executes
+	// it with shell, streaming its output to stdout and stderr. A script
+	// that ran but failed results in a *ScriptError.
+	RunScript(ctx context.Context, shell, script, stage string, env []string) error
+
+	// RunCommand executes a command, and returns its output, standard
+	// error included. A command that ran but failed results in a
+	// *ScriptError.
+	RunCommand(ctx context.Context, command string) ([]byte, error)
+
+	// CopyOut copies a remote file or directory tree to a local path.
+	CopyOut(ctx context.Context, remote, local string) error
+
+	Close() error
+}
+
+// Connect establishes a transport to the Virtual Machine instance of the
+// job with the method of rc.
+//
+// Only ssh is implemented; Windows guests need to run an OpenSSH server,
+// with rc.Shell set to pwsh. A WinRM transport would implement Transport.
+func Connect(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	rc *RunConfig,
+	opts DialOptions,
+) (Transport, error) {
+	switch rc.Method {
+	case "ssh":
+		switch {
+		case rc.SSH.privateKey != nil:
+		case rc.SSH.KeySecret != "":
+			key, err := LoadSSHKeySecret(ctx, client, jctx, rc.SSH.KeySecret, rc.SSH.KeySecretKey)
+			if err != nil {
+				return nil, err
+			}
+			rc.SSH.privateKey = key
+		case rc.SSH.UseGeneratedKey():
+			key, err := FindJobSSHKey(ctx, client, jctx)
+			if err != nil {
+				return nil, err
+			}
+			rc.SSH.privateKey = key
+		}
+		conn, err := DialVM(ctx, client, jctx, vm, rc, opts)
+		if err != nil {
+			return nil, err
+		}
+		go KeepAliveSSH(conn, rc.SSH.KeepaliveInterval, rc.SSH.KeepaliveCountMax)
+		return &sshTransport{conn}, nil
+	default:
+		return nil, fmt.Errorf("unsupported run method %q", rc.Method)
+	}
+}
+
+type sshTransport struct {
+	conn *sshclient.Client
+}
+
+func (t *sshTransport) RunScript(ctx context.Context, shell, script, stage string, env []string) error {
+	return RunScript(ctx, t.conn, shell, script, stage, env)
+}
+
+func (t *sshTransport) RunCommand(ctx context.Context, command string) ([]byte, error) {
+	return RunCommand(ctx, t.conn, command)
+}
+
+func (t *sshTransport) CopyOut(ctx context.Context, remote, local string) error {
+	return CopyOut(ctx, t.conn, remote, local)
+}
+
+func (t *sshTransport) Close() error {
+	return t.conn.Close()
+}
+
+// RunRunnerScript runs a script of the runner rather than of the job, e.g.
+// --pre-script, for the given stage, exporting the CI variables of the job
+// to it. The script not being the one of the user, its failure is not a
+// build failure, so the *ScriptError is not passed on.
+func RunRunnerScript(ctx context.Context, conn Transport, shell, script, stage string) error {
+	err := conn.RunScript(ctx, shell, script, stage, JobEnv(os.Environ()))
+	var scripterr *ScriptError
+	if errors.As(err, &scripterr) {
+		return fmt.Errorf("%s failed: %v", path.Base(script), scripterr)
+	}
+	return err
+}
+
+// maxReadinessOutput is how much of the output of the readiness command is
+// kept for reporting a timeout.
+const maxReadinessOutput = 4096
+
+// WaitForReadinessCommand runs command through conn every interval, until
+// it succeeds or timeout elapses. On timeout, the error reports the output
+// of the last failed attempt.
+func WaitForReadinessCommand(ctx context.Context, conn Transport, command string, interval, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastOut []byte
+	var lastErr error
+	for {
+		out, err := conn.RunCommand(ctx, command)
+		if err == nil {
+			return nil
+		}
+		var scripterr *ScriptError
+		if ctx.Err() == nil && !errors.As(err, &scripterr) {
+			return fmt.Errorf("running readiness command %q: %w", command, err)
+		}
+		if ctx.Err() == nil {
+			lastOut, lastErr = out, err
+			logger.Debug("readiness command failed", "command", command, "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if lastErr == nil {
+				return fmt.Errorf("readiness command %q did not succeed within %v", command, timeout)
+			}
+			if len(lastOut) > maxReadinessOutput {
+				lastOut = lastOut[len(lastOut)-maxReadinessOutput:]
+			}
+			return fmt.Errorf("readiness command %q did not succeed within %v: %v; last output:\n%s", command, timeout, lastErr, lastOut)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// recordingTransport is a Transport recording what it is asked to run.
+// Commands fail with a *ScriptError while failures is positive, and
+// scripts fail with scriptErr.
+type recordingTransport struct {
+	calls     []string
+	env       []string
+	failures  int
+	scriptErr error
+}
+
+func (t *recordingTransport) RunScript(ctx context.Context, shell, script, stage string, env []string) error {
+	t.calls = append(t.calls, fmt.Sprintf("script %s %s %s", shell, filepath.Base(script), stage))
+	t.env = env
+	return t.scriptErr
+}
+
+func (t *recordingTransport) RunCommand(ctx context.Context, command string) ([]byte, error) {
+	t.calls = append(t.calls, "command "+command)
+	if t.failures > 0 {
+		t.failures--
+		return []byte("not yet"), &ScriptError{ExitStatus: 1}
+	}
+	return nil, nil
+}
+
+func (t *recordingTransport) CopyOut(ctx context.Context, remote, local string) error {
+	t.calls = append(t.calls, "copyout "+remote)
+	return nil
+}
+
+func (t *recordingTransport) Close() error {
+	return nil
+}
+
+func TestProvisionPreScript(t *testing.T) {
+	t.Setenv("CUSTOM_ENV_CI_JOB_ID", "42")
+
+	script := filepath.Join(t.TempDir(), "pre.sh")
+	if err := os.WriteFile(script, []byte("mount /cache\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := testPrepareCmd(t,
+		"--readiness-command=systemctl is-active docker",
+		"--readiness-command-interval=1ms",
+		"--pre-script="+script)
+	jctx := testJobContext(t, cmd)
+	rc := &RunConfig{Shell: "bash"}
+
+	t.Run("runs after readiness", func(t *testing.T) {
+		conn := &recordingTransport{failures: 2}
+		if err := cmd.provision(context.Background(), conn, jctx, rc); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"command systemctl is-active docker",
+			"command systemctl is-active docker",
+			"command systemctl is-active docker",
+			"script bash pre.sh kubevirt_pre_script",
+		}
+		if !reflect.DeepEqual(conn.calls, want) {
+			t.Errorf("calls = %q, want %q", conn.calls, want)
+		}
+		if !reflect.DeepEqual(conn.env, []string{"CI_JOB_ID=42"}) {
+			t.Errorf("pre-script env = %q, want the job environment", conn.env)
+		}
+	})
+
+	t.Run("failure is a system failure", func(t *testing.T) {
+		conn := &recordingTransport{scriptErr: &ScriptError{ExitStatus: 3}}
+		err := cmd.provision(context.Background(), conn, jctx, rc)
+		if err == nil {
+			t.Fatal("failed pre-script succeeded")
+		}
+		var scripterr *ScriptError
+		if errors.As(err, &scripterr) {
+			t.Errorf("failed pre-script is a build failure: %v", err)
+		}
+	})
+
+	t.Run("never runs on an instance that is not ready", func(t *testing.T) {
+		conn := &recordingTransport{failures: 1}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := cmd.provision(ctx, conn, jctx, rc); err == nil {
+			t.Fatal("provisioning a cancelled job succeeded")
+		}
+		for _, call := range conn.calls {
+			if call == "script bash pre.sh kubevirt_pre_script" {
+				t.Errorf("pre-script ran before readiness")
+			}
+		}
+	})
+}
+
+func TestRunRunnerScript(t *testing.T) {
+	t.Run("script failure", func(t *testing.T) {
+		conn := &recordingTransport{scriptErr: &ScriptError{ExitStatus: 1}}
+		err := RunRunnerScript(context.Background(), conn, "sh", "/etc/ci/post.sh", "kubevirt_post_script")
+		if err == nil {
+			t.Fatal("failed post-script succeeded")
+		}
+		var scripterr *ScriptError
+		if errors.As(err, &scripterr) {
+			t.Errorf("failed post-script is a build failure: %v", err)
+		}
+	})
+
+	t.Run("transport failure", func(t *testing.T) {
+		lost := errors.New("connection lost")
+		conn := &recordingTransport{scriptErr: lost}
+		err := RunRunnerScript(context.Background(), conn, "sh", "/etc/ci/post.sh", "kubevirt_post_script")
+		if !errors.Is(err, lost) {
+			t.Errorf("err = %v, want %v", err, lost)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags '-X main.version=... -X main.commit=...
+// -X main.buildDate=...'. Whatever is left unset is taken from the build
+// information of the binary, when available.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// BuildInfo describes the build of the executor.
+type BuildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	BuildDate     string `json:"buildDate,omitempty"`
+	GoVersion     string `json:"goVersion"`
+	KubernetesAPI string `json:"kubernetesAPI,omitempty"`
+	KubeVirtAPI   string `json:"kubevirtAPI,omitempty"`
+}
+
+// GetBuildInfo returns the build information of the executor.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	binfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, mod := range binfo.Deps {
+		switch mod.Path {
+		case "k8s.io/api":
+			info.KubernetesAPI = mod.Version
+		case "kubevirt.io/api":
+			info.KubeVirtAPI = mod.Version
+		}
+	}
+	for _, s := range binfo.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = s.Value
+		case s.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = s.Value
+		}
+	}
+	if info.Version == "" {
+		info.Version = binfo.Main.Version
+	}
+	if info.Version == "(devel)" && info.Commit != "" {
+		info.Version = info.Commit + " (devel)"
+	}
+	return info
+}
+
+func (info BuildInfo) String() string {
+	return fmt.Sprintf("%v (%v; k8s.io/api: %v; kubevirt.io/api: %v)", info.Version, info.GoVersion, info.KubernetesAPI, info.KubeVirtAPI)
+}
+
+type VersionCmd struct {
+	JSON bool `name:"json" help:"print the build information as JSON"`
+}
+
+func (cmd *VersionCmd) Run() error {
+	info := GetBuildInfo()
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(&info)
+	}
+	fmt.Println("gitlab-runner-kubevirt", info.Version)
+	if info.Commit != "" {
+		fmt.Println("Commit:", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Println("Built:", info.BuildDate)
+	}
+	fmt.Println("Go:", info.GoVersion)
+	fmt.Println("k8s.io/api:", info.KubernetesAPI)
+	fmt.Println("kubevirt.io/api:", info.KubeVirtAPI)
+	return nil
+}
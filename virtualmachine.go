@@ -0,0 +1,180 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// With jctx.UseVirtualMachine, the Virtual Machine instance of the job is
+// created through a VirtualMachine with the RerunOnFailure run strategy, so
+// that KubeVirt restarts the instance when it fails, e.g. when the guest
+// crashes while booting. The restarted instance has the same name and
+// labels, but whatever the earlier stages did in the guest is gone, so the
+// prepare stage records the instance it readied on the VirtualMachine, and
+// the later stages refuse to carry on with another one.
+
+// virtualMachineStartTimeout is how long to wait for the VirtualMachine of
+// the job to (re)create its instance.
+const virtualMachineStartTimeout = 2 * time.Minute
+
+// PreparedInstanceKey is the annotation of the VirtualMachine recording the
+// UID of the instance readied by the prepare stage.
+const PreparedInstanceKey = labelPrefix + "/prepared-instance"
+
+// ErrJobVMRestarting is returned by FindJobVM while the VirtualMachine of
+// the job is recreating its instance.
+var ErrJobVMRestarting = errors.New("Virtual Machine instance is restarting")
+
+// JobVirtualMachine returns the VirtualMachine wrapping the instance.
+func JobVirtualMachine(jctx *JobContext, instance *kubevirtapi.VirtualMachineInstance) *kubevirtapi.VirtualMachine {
+	strategy := kubevirtapi.RunStrategyRerunOnFailure
+	return &kubevirtapi.VirtualMachine{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: kubevirtapi.GroupVersion.String(),
+			Kind:       kubevirtapi.VirtualMachineGroupVersionKind.Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: instance.ObjectMeta.GenerateName,
+			Labels:       instance.ObjectMeta.Labels,
+		},
+		Spec: kubevirtapi.VirtualMachineSpec{
+			RunStrategy: &strategy,
+			Template: &kubevirtapi.VirtualMachineInstanceTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      instance.ObjectMeta.Labels,
+					Annotations: instance.ObjectMeta.Annotations,
+				},
+				Spec: instance.Spec,
+			},
+		},
+	}
+}
+
+// createJobVirtualMachine creates the VirtualMachine, unless retrying finds
+// it already exists, and returns its instance once it has been created.
+func createJobVirtualMachine(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	machine *kubevirtapi.VirtualMachine,
+	retrying bool,
+) (*kubevirtapi.VirtualMachineInstance, error) {
+	var created *kubevirtapi.VirtualMachine
+	if retrying {
+		list, err := client.VirtualMachine(jctx.Namespace).List(Selector(jctx))
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Items) > 0 {
+			created = &list.Items[0]
+		}
+	}
+	if created == nil {
+		err := retryNameCollisions("create VirtualMachine", func() error {
+			var err error
+			created, err = client.VirtualMachine(jctx.Namespace).Create(machine)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("created VirtualMachine", "vm", created.ObjectMeta.Name)
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, virtualMachineStartTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		vm, err := client.VirtualMachineInstance(jctx.Namespace).Get(startCtx, created.ObjectMeta.Name, &metav1.GetOptions{})
+		if err == nil {
+			return vm, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		select {
+		case <-ticker.C:
+		case <-startCtx.Done():
+			return nil, fmt.Errorf("VirtualMachine %s did not create its instance: %w", created.ObjectMeta.Name, startCtx.Err())
+		}
+	}
+}
+
+// RecordPreparedInstance records on the VirtualMachine controlling the
+// instance, if any, that the instance is the one the job was prepared on.
+func RecordPreparedInstance(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	ref := controllingVM(vm)
+	if ref == nil {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				PreparedInstanceKey: string(vm.ObjectMeta.UID),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.VirtualMachine(jctx.Namespace).Patch(ref.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	return err
+}
+
+// CheckPreparedInstance returns an error if the VirtualMachine controlling
+// the instance restarted it since the prepare stage.
+func CheckPreparedInstance(client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	ref := controllingVM(vm)
+	if ref == nil {
+		return nil
+	}
+	machine, err := client.VirtualMachine(jctx.Namespace).Get(ref.Name, &metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if prepared := machine.ObjectMeta.Annotations[PreparedInstanceKey]; prepared != string(vm.ObjectMeta.UID) {
+		return fmt.Errorf("Virtual Machine instance %s was restarted since the prepare stage, and lost the state of the job", vm.ObjectMeta.Name)
+	}
+	return nil
+}
+
+// controllingVM returns the reference to the VirtualMachine controlling the
+// instance, if any.
+func controllingVM(vm *kubevirtapi.VirtualMachineInstance) *metav1.OwnerReference {
+	ref := metav1.GetControllerOf(vm)
+	if ref == nil || ref.Kind != kubevirtapi.VirtualMachineGroupVersionKind.Kind {
+		return nil
+	}
+	return ref
+}
+
+// deleteInstance deletes the Virtual Machine instance, or the VirtualMachine
+// controlling it, which would restart it otherwise.
+func deleteInstance(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	namespace string,
+	vm *kubevirtapi.VirtualMachineInstance,
+	opts *metav1.DeleteOptions,
+) error {
+	if ref := controllingVM(vm); ref != nil {
+		return client.VirtualMachine(namespace).Delete(ref.Name, opts)
+	}
+	return client.VirtualMachineInstance(namespace).Delete(ctx, vm.ObjectMeta.Name, opts)
+}
@@ -0,0 +1,105 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+// testVMInstance returns an instance with the given UID, controlled by the
+// VirtualMachine named machine if it isn't empty.
+func testVMInstance(machine string, uid types.UID) *kubevirtapi.VirtualMachineInstance {
+	vm := &kubevirtapi.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "runner-1-x7k2p", Namespace: "ci", UID: uid},
+	}
+	if machine != "" {
+		controller := true
+		vm.ObjectMeta.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: kubevirtapi.GroupVersion.String(),
+			Kind:       kubevirtapi.VirtualMachineGroupVersionKind.Kind,
+			Name:       machine,
+			UID:        "uid-" + types.UID(machine),
+			Controller: &controller,
+		}}
+	}
+	return vm
+}
+
+func TestRecordPreparedInstance(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	jctx := testJobContext(t, cmd)
+
+	c := newFakeCluster(t)
+	c.VMs.EXPECT().Patch("runner-1-vm", types.MergePatchType, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ string, _ types.PatchType, data []byte, _ *metav1.PatchOptions, _ ...string) (*kubevirtapi.VirtualMachine, error) {
+			var patch struct {
+				Metadata metav1.ObjectMeta `json:"metadata"`
+			}
+			if err := json.Unmarshal(data, &patch); err != nil {
+				t.Fatal(err)
+			}
+			if got := patch.Metadata.Annotations[PreparedInstanceKey]; got != "uid-1" {
+				t.Errorf("recorded instance %q, want uid-1", got)
+			}
+			return &kubevirtapi.VirtualMachine{}, nil
+		})
+	if err := RecordPreparedInstance(context.Background(), c, jctx, testVMInstance("runner-1-vm", "uid-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bare instances have nothing to record on; any call fails the mock.
+	if err := RecordPreparedInstance(context.Background(), newFakeCluster(t), jctx, testVMInstance("", "uid-1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckPreparedInstance(t *testing.T) {
+	cmd := testPrepareCmd(t)
+	jctx := testJobContext(t, cmd)
+
+	tests := []struct {
+		name     string
+		machine  string
+		prepared string
+		uid      types.UID
+		wantErr  string
+	}{
+		{name: "same instance", machine: "runner-1-vm", prepared: "uid-1", uid: "uid-1"},
+		{name: "restarted instance", machine: "runner-1-vm", prepared: "uid-1", uid: "uid-2", wantErr: "restarted since the prepare stage"},
+		{name: "never prepared", machine: "runner-1-vm", uid: "uid-1", wantErr: "restarted since the prepare stage"},
+		{name: "bare instance", uid: "uid-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeCluster(t)
+			if tt.machine != "" {
+				machine := &kubevirtapi.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: tt.machine, Namespace: "ci"}}
+				if tt.prepared != "" {
+					machine.ObjectMeta.Annotations = map[string]string{PreparedInstanceKey: tt.prepared}
+				}
+				c.VMs.EXPECT().Get(tt.machine, gomock.Any()).Return(machine, nil)
+			}
+			err := CheckPreparedInstance(c, jctx, testVMInstance(tt.machine, tt.uid))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Names of the disks (and their volumes) managed by the executor itself.
+const (
+	containerDiskName  = "containervolume"
+	dataVolumeDiskName = "datavolume"
+	cloudInitDiskName  = "cloudinitvolume"
+)
+
+// ExtraVolume is a pre-existing PersistentVolumeClaim attached to the
+// Virtual Machine instance as an additional disk.
+type ExtraVolume struct {
+	Name      string
+	ClaimName string
+	Bus       string
+	ReadOnly  bool
+
+	// VolumeMode is the volume mode that the claim must have, Block or
+	// Filesystem, or empty to accept either.
+	VolumeMode string
+
+	// BootOrder is the position of the disk in the boot order, starting
+	// from 1, or 0 to leave it out.
+	BootOrder uint
+
+	// DedicatedIOThread gives the disk an I/O thread of its own.
+	DedicatedIOThread bool
+
+	// Cache is the cache mode of the disk, none, writethrough or
+	// writeback, or empty for the KubeVirt default.
+	Cache string
+}
+
+// ScratchDisk is an empty disk attached to the Virtual Machine instance for
+// scratch space, which lives as long as the instance.
+type ScratchDisk struct {
+	Name string
+	Size resource.Quantity
+	Bus  string
+
+	// Filesystem, if set, is the filesystem that cloud-init formats the
+	// disk with, and MountPoint where it mounts it, if set.
+	Filesystem string
+	MountPoint string
+}
+
+// maxDiskSerialLength is the length past which QEMU truncates the serial
+// of virtio disks, which the guest names them by under /dev/disk/by-id.
+const maxDiskSerialLength = 20
+
+// ParseScratchDisk parses a scratch disk from a comma-separated list of
+// options, e.g. "name=scratch,size=10Gi,bus=virtio,fs=ext4,mount=/scratch".
+func ParseScratchDisk(spec string) (ScratchDisk, error) {
+	disk := ScratchDisk{Bus: "virtio"}
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			disk.Name = value
+		case "size":
+			size, err := resource.ParseQuantity(value)
+			if err != nil {
+				return fmt.Errorf("invalid size %q: %w", value, err)
+			}
+			if size.Sign() <= 0 {
+				return fmt.Errorf("invalid size %q, must be positive", value)
+			}
+			disk.Size = size
+		case "bus":
+			disk.Bus = value
+		case "fs":
+			disk.Filesystem = value
+		case "mount":
+			disk.MountPoint = value
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+	case disk.Name == "":
+		err = fmt.Errorf("missing name")
+	case disk.Size.IsZero():
+		err = fmt.Errorf("missing size")
+	case disk.MountPoint != "" && disk.Filesystem == "":
+		err = fmt.Errorf("mounting the disk requires a filesystem")
+	case disk.Filesystem != "" && disk.Bus != string(kubevirtapi.DiskBusVirtio):
+		err = fmt.Errorf("formatting the disk requires the virtio bus")
+	case disk.Filesystem != "" && len(disk.Name) > maxDiskSerialLength:
+		err = fmt.Errorf("formatting the disk requires a name of at most %d characters", maxDiskSerialLength)
+	}
+	if err != nil {
+		return disk, fmt.Errorf("invalid scratch disk %q: %w", spec, err)
+	}
+	return disk, nil
+}
+
+// device returns the path of the disk in the guest, which only holds for
+// virtio disks.
+func (disk ScratchDisk) device() string {
+	return "/dev/disk/by-id/virtio-" + disk.Name
+}
+
+// IOThrottle keeps the disk I/O of the guest from starving other guests of
+// the same host, by running it on I/O threads of its own rather than on the
+// main QEMU thread.
+type IOThrottle struct {
+	// ThreadsPolicy is the I/O threads policy of the guest, shared or auto,
+	// or empty to run disk I/O on the main thread. It defaults to shared
+	// when a disk asks for a dedicated I/O thread.
+	ThreadsPolicy string
+
+	// DedicatedRootThread gives the root disk an I/O thread of its own.
+	DedicatedRootThread bool
+}
+
+// ParseExtraVolume parses an extra volume from a comma-separated list of
+// options, e.g. "name=cache,claim=shared-cache,bus=scsi,mode=block,boot=1,iothread,cache=writeback,readonly".
+func ParseExtraVolume(spec string) (ExtraVolume, error) {
+	vol := ExtraVolume{Bus: "virtio"}
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			vol.Name = value
+		case "claim":
+			vol.ClaimName = value
+		case "bus":
+			vol.Bus = value
+		case "readonly":
+			vol.ReadOnly = value == "" || value == "true"
+		case "iothread":
+			vol.DedicatedIOThread = value == "" || value == "true"
+		case "cache":
+			mode, err := parseCacheMode(value)
+			if err != nil {
+				return err
+			}
+			vol.Cache = mode
+		case "mode":
+			mode, err := parseVolumeMode(value)
+			if err != nil {
+				return err
+			}
+			vol.VolumeMode = mode
+		case "boot":
+			order, err := parseBootOrder(value)
+			if err != nil {
+				return err
+			}
+			vol.BootOrder = order
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return vol, fmt.Errorf("invalid extra volume %q: %w", spec, err)
+	}
+	if vol.ClaimName == "" {
+		return vol, fmt.Errorf("invalid extra volume %q: missing claim name", spec)
+	}
+	if vol.Name == "" {
+		vol.Name = vol.ClaimName
+	}
+	return vol, nil
+}
+
+// parseVolumeMode parses the volume mode of a claim, case-insensitively.
+func parseVolumeMode(value string) (string, error) {
+	for _, mode := range []k8sapi.PersistentVolumeMode{k8sapi.PersistentVolumeBlock, k8sapi.PersistentVolumeFilesystem} {
+		if strings.EqualFold(value, string(mode)) {
+			return string(mode), nil
+		}
+	}
+	return "", fmt.Errorf("unknown volume mode %q, must be block or filesystem", value)
+}
+
+// parseCacheMode parses the cache mode of a disk, case-insensitively.
+func parseCacheMode(value string) (string, error) {
+	for _, mode := range []kubevirtapi.DriverCache{kubevirtapi.CacheNone, kubevirtapi.CacheWriteThrough, kubevirtapi.CacheWriteBack} {
+		if strings.EqualFold(value, string(mode)) {
+			return string(mode), nil
+		}
+	}
+	return "", fmt.Errorf("unknown cache mode %q, must be none, writethrough or writeback", value)
+}
+
+// parseBootOrder parses a boot order, which must be a positive integer.
+func parseBootOrder(value string) (uint, error) {
+	order, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || order == 0 {
+		return 0, fmt.Errorf("invalid boot order %q, must be a positive integer", value)
+	}
+	return uint(order), nil
+}
+
+// checkClaimVolumeMode returns an error unless the claim has the given
+// volume mode.
+func checkClaimVolumeMode(ctx context.Context, client kubevirt.KubevirtClient, namespace, claim, mode string) error {
+	pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claim, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("checking volume mode of claim %s: %w", claim, err)
+	}
+	actual := k8sapi.PersistentVolumeFilesystem
+	if pvc.Spec.VolumeMode != nil {
+		actual = *pvc.Spec.VolumeMode
+	}
+	if string(actual) != mode {
+		return fmt.Errorf("claim %s has volume mode %s, not %s", claim, actual, mode)
+	}
+	return nil
+}
+
+// Filesystem is a PersistentVolumeClaim shared with the guest as a virtiofs
+// filesystem, which the guest mounts with its name as the tag.
+type Filesystem struct {
+	Name      string
+	ClaimName string
+	ReadOnly  bool
+}
+
+// ParseFilesystem parses a virtiofs filesystem from a comma-separated list
+// of options, e.g. "name=cache,claim=shared-cache,readonly".
+func ParseFilesystem(spec string) (Filesystem, error) {
+	var fs Filesystem
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			fs.Name = value
+		case "claim":
+			fs.ClaimName = value
+		case "readonly":
+			fs.ReadOnly = value == "" || value == "true"
+		case "mode":
+			mode, err := parseVolumeMode(value)
+			if err != nil {
+				return err
+			}
+			if mode == string(k8sapi.PersistentVolumeBlock) {
+				return fmt.Errorf("block volumes can only be attached as disks, see --default-extra-volume")
+			}
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fs, fmt.Errorf("invalid filesystem %q: %w", spec, err)
+	}
+	if fs.ClaimName == "" {
+		return fs, fmt.Errorf("invalid filesystem %q: missing claim name", spec)
+	}
+	if fs.Name == "" {
+		fs.Name = fs.ClaimName
+	}
+	return fs, nil
+}
+
+// SecretVolume is a Secret attached to the Virtual Machine instance as a
+// disk. The Secret must live in the namespace of the instance.
+type SecretVolume struct {
+	Name       string
+	SecretName string
+}
+
+// ParseSecretVolume parses a secret volume from a comma-separated list of
+// options, e.g. "name=creds,secret=registry-credentials".
+func ParseSecretVolume(spec string) (SecretVolume, error) {
+	var vol SecretVolume
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			vol.Name = value
+		case "secret":
+			vol.SecretName = value
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return vol, fmt.Errorf("invalid secret volume %q: %w", spec, err)
+	}
+	if vol.Name == "" {
+		vol.Name = vol.SecretName
+	}
+	return vol, nil
+}
+
+// ConfigMapVolume is a ConfigMap attached to the Virtual Machine instance
+// as a read-only disk. When Optional is set, a missing ConfigMap does not
+// prevent the instance from starting.
+type ConfigMapVolume struct {
+	Name          string
+	ConfigMapName string
+	Optional      bool
+}
+
+// ParseConfigMapVolume parses a configmap volume from a comma-separated list
+// of options, e.g. "name=config,configmap=job-config,optional".
+func ParseConfigMapVolume(spec string) (ConfigMapVolume, error) {
+	var vol ConfigMapVolume
+	err := parseOptions(spec, func(key, value string) error {
+		switch key {
+		case "name":
+			vol.Name = value
+		case "configmap":
+			vol.ConfigMapName = value
+		case "optional":
+			vol.Optional = value == "" || value == "true"
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return vol, fmt.Errorf("invalid configmap volume %q: %w", spec, err)
+	}
+	if vol.Name == "" {
+		vol.Name = vol.ConfigMapName
+	}
+	return vol, nil
+}
+
+// attachVolume adds a disk backed by a volume of the same name to vm.
+func attachVolume(vm *kubevirtapi.VirtualMachineInstance, disk kubevirtapi.Disk, source kubevirtapi.VolumeSource) {
+	vm.Spec.Domain.Devices.Disks = append(vm.Spec.Domain.Devices.Disks, disk)
+	vm.Spec.Volumes = append(vm.Spec.Volumes, kubevirtapi.Volume{
+		Name:         disk.Name,
+		VolumeSource: source,
+	})
+}
+
+// parseOptions calls fn for each of the comma-separated key[=value] options
+// in spec.
+func parseOptions(spec string, fn func(key, value string) error) error {
+	for _, opt := range strings.Split(spec, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		if err := fn(kv[0], value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBus(bus string) error {
+	switch kubevirtapi.DiskBus(bus) {
+	case kubevirtapi.DiskBusVirtio, kubevirtapi.DiskBusSATA, kubevirtapi.DiskBusSCSI, kubevirtapi.DiskBusUSB:
+		return nil
+	}
+	return fmt.Errorf("unknown disk bus %q", bus)
+}
+
+// diskNames keeps track of the names of the disks attached to the Virtual
+// Machine instance, so that user-provided ones don't collide with each
+// other or with the disks managed by the executor.
+type diskNames map[string]bool
+
+func (names diskNames) add(name string) error {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("invalid disk name %q: %s", name, strings.Join(errs, "; "))
+	}
+	switch name {
+	case containerDiskName, dataVolumeDiskName, cloudInitDiskName:
+		return fmt.Errorf("disk name %q is reserved", name)
+	}
+	if names[name] {
+		return fmt.Errorf("disk name %q is used more than once", name)
+	}
+	names[name] = true
+	return nil
+}
+
+// bootOrders keeps track of the boot orders of the disks attached to the
+// Virtual Machine instance, so that no two disks share one.
+type bootOrders map[uint]string
+
+// set sets the boot order of disk, unless order is 0.
+func (orders bootOrders) set(disk *kubevirtapi.Disk, order uint) error {
+	if order == 0 {
+		return nil
+	}
+	if other, ok := orders[order]; ok {
+		return fmt.Errorf("disks %s and %s have the same boot order %d", other, disk.Name, order)
+	}
+	orders[order] = disk.Name
+	disk.BootOrder = &order
+	return nil
+}
+
+// setDedicatedIOThread gives disk an I/O thread of its own, which only
+// virtio disks support.
+func setDedicatedIOThread(disk *kubevirtapi.Disk) error {
+	if disk.Disk == nil || disk.Disk.Bus != kubevirtapi.DiskBusVirtio {
+		return fmt.Errorf("disk %s: dedicated I/O threads require the virtio bus", disk.Name)
+	}
+	dedicated := true
+	disk.DedicatedIOThread = &dedicated
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseScratchDisk(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ScratchDisk
+		wantErr string
+	}{
+		{
+			spec: "name=scratch,size=10Gi,fs=ext4,mount=/scratch",
+			want: ScratchDisk{Name: "scratch", Size: resource.MustParse("10Gi"), Bus: "virtio", Filesystem: "ext4", MountPoint: "/scratch"},
+		},
+		{spec: "name=raw,size=1Gi,bus=sata", want: ScratchDisk{Name: "raw", Size: resource.MustParse("1Gi"), Bus: "sata"}},
+		{spec: "size=10Gi", wantErr: "missing name"},
+		{spec: "name=scratch", wantErr: "missing size"},
+		{spec: "name=scratch,size=0", wantErr: "must be positive"},
+		{spec: "name=scratch,size=lots", wantErr: "invalid size"},
+		{spec: "name=scratch,size=10Gi,mount=/scratch", wantErr: "requires a filesystem"},
+		{spec: "name=scratch,size=10Gi,bus=sata,fs=ext4", wantErr: "requires the virtio bus"},
+		{spec: "name=a-very-long-scratch-disk,size=10Gi,fs=ext4", wantErr: "at most 20 characters"},
+		{spec: "name=scratch,size=10Gi,color=blue", wantErr: "unknown option"},
+	}
+	for _, tt := range tests {
+		got, err := ParseScratchDisk(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseScratchDisk(%q): err = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseScratchDisk(%q): %v", tt.spec, err)
+			continue
+		}
+		if got.Name != tt.want.Name || got.Size.Cmp(tt.want.Size) != 0 || got.Bus != tt.want.Bus ||
+			got.Filesystem != tt.want.Filesystem || got.MountPoint != tt.want.MountPoint {
+			t.Errorf("ParseScratchDisk(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseExtraVolumeMode(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{spec: "claim=cache"},
+		{spec: "claim=cache,mode=block", want: "Block"},
+		{spec: "claim=cache,mode=Filesystem", want: "Filesystem"},
+		{spec: "claim=cache,mode=raw", wantErr: `unknown volume mode "raw"`},
+	}
+	for _, tt := range tests {
+		got, err := ParseExtraVolume(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseExtraVolume(%q): err = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseExtraVolume(%q): %v", tt.spec, err)
+			continue
+		}
+		if got.VolumeMode != tt.want {
+			t.Errorf("ParseExtraVolume(%q): volume mode %q, want %q", tt.spec, got.VolumeMode, tt.want)
+		}
+	}
+
+	// Block volumes have no filesystem to share.
+	if _, err := ParseFilesystem("claim=cache,mode=block"); err == nil || !strings.Contains(err.Error(), "can only be attached as disks") {
+		t.Errorf("ParseFilesystem with a block volume: err = %v", err)
+	}
+	if _, err := ParseFilesystem("claim=cache,mode=filesystem"); err != nil {
+		t.Errorf("ParseFilesystem with a filesystem volume: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// WarmCmd pulls a containerdisk image on nodes ahead of the jobs using it,
+// by starting a short-lived Virtual Machine instance with it on each of
+// them, built from the same settings as those of the prepare stage.
+type WarmCmd struct {
+	Image        string            `arg:"" help:"containerdisk image to pull"`
+	NodeSelector map[string]string `name:"node-selector" mapsep:"," help:"comma-separated key=value labels of the nodes to pull the image on; defaults to --default-node-selector"`
+	PullTimeout  time.Duration     `name:"pull-timeout" default:"10m" help:"how long to wait for the image to be pulled on each node"`
+
+	Prepare PrepareCmd `embed:""`
+}
+
+func (cmd *WarmCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	jctx.Image = cmd.Image
+	if cmd.NodeSelector != nil {
+		jctx.NodeSelector = cmd.NodeSelector
+	}
+	if err := cmd.Prepare.applyDefaults(jctx); err != nil {
+		return err
+	}
+	if err := CheckJobImage(ctx, client, jctx); err != nil {
+		return err
+	}
+
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(jctx.NodeSelector).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("listing nodes: %w", err)
+	}
+	var nodes []k8sapi.Node
+	for _, node := range list.Items {
+		if !node.Spec.Unschedulable {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("no schedulable node matches the node selector %v", jctx.NodeSelector)
+	}
+
+	fmt.Fprintf(os.Stderr, "Pulling image %v on %d nodes\n", jctx.Image, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = warmNode(ctx, client, *jctx, cmd.Prepare.RunConfig, &nodes[i], cmd.PullTimeout)
+		}(i)
+	}
+	wg.Wait()
+
+	var warm, failed []string
+	for i, node := range nodes {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "Could not pull image on node %v: %v\n", node.ObjectMeta.Name, errs[i])
+			failed = append(failed, node.ObjectMeta.Name)
+			continue
+		}
+		warm = append(warm, node.ObjectMeta.Name)
+	}
+	sort.Strings(warm)
+	fmt.Fprintf(os.Stderr, "Image %v is now on %d of %d nodes: %v\n", jctx.Image, len(warm), len(nodes), strings.Join(warm, ", "))
+	if len(failed) > 0 {
+		return fmt.Errorf("could not pull image %s on %d nodes", jctx.Image, len(failed))
+	}
+	return nil
+}
+
+// warmNode pulls the image of jctx on node, by creating a Virtual Machine
+// instance scheduled on it, and deleting it once its virt-launcher pod,
+// which holds the containerdisk, runs.
+func warmNode(ctx context.Context, client kubevirt.KubevirtClient, jctx JobContext, rc RunConfig, node *k8sapi.Node, timeout time.Duration) error {
+	hostname := node.ObjectMeta.Labels[k8sapi.LabelHostname]
+	if hostname == "" {
+		return fmt.Errorf("node has no %s label", k8sapi.LabelHostname)
+	}
+	selector := map[string]string{k8sapi.LabelHostname: hostname}
+	for k, v := range jctx.NodeSelector {
+		selector[k] = v
+	}
+	jctx.NodeSelector = selector
+
+	baseName, err := sanitizeBaseName("warm-" + node.ObjectMeta.Name)
+	if err != nil {
+		return err
+	}
+	jctx.BaseName = baseName
+	jctx.ID = digest(sha1.New, "warm", jctx.Image, node.ObjectMeta.Name)
+
+	// The guest never boots far enough to need anything but its image, and
+	// the volumes of jobs may not be attachable on several nodes at once. A
+	// data volume would also replace the containerdisk as the root disk, and
+	// leave the image unpulled.
+	jctx.UseVirtualMachine = false
+	jctx.DataVolumeImage = ""
+	jctx.DataVolumeName = ""
+	jctx.CloudInitUserData = ""
+	jctx.CloudInitNetworkData = ""
+	jctx.ExtraVolumes = nil
+	jctx.ScratchDisks = nil
+	jctx.Filesystems = nil
+	jctx.SecretVolumes = nil
+	jctx.ConfigMapVolumes = nil
+
+	vm, err := CreateJobVM(ctx, client, &jctx, &rc)
+	if err != nil || jctx.DryRun {
+		return err
+	}
+	defer func() {
+		seconds := int64(0)
+		err := deleteInstance(context.Background(), client, jctx.Namespace, vm, &metav1.DeleteOptions{GracePeriodSeconds: &seconds})
+		if err != nil {
+			logger.Warn("deleting Virtual Machine instance", "vmi", vm.ObjectMeta.Name, "err", err)
+		}
+	}()
+	return waitForImagePull(ctx, client, &jctx, vm, timeout)
+}
+
+// waitForImagePull waits for the virt-launcher pod of the Virtual Machine
+// instance to run, which it only does once its images are pulled.
+func waitForImagePull(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(failureCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-timeoutCtx.Done():
+			return fmt.Errorf("timed out after %v (phase: %v)%s", timeout, vm.Status.Phase, describeConditions(vm))
+		}
+
+		latest, err := client.VirtualMachineInstance(jctx.Namespace).Get(timeoutCtx, vm.ObjectMeta.Name, &metav1.GetOptions{})
+		if err != nil {
+			if isTransientAPIError(err) {
+				continue
+			}
+			return err
+		}
+		vm = latest
+		switch vm.Status.Phase {
+		case kubevirtapi.Scheduled, kubevirtapi.Running:
+			return nil
+		case kubevirtapi.Failed, kubevirtapi.Succeeded:
+			return fmt.Errorf("Virtual Machine instance %s stopped (phase: %v)%s", vm.ObjectMeta.Name, vm.Status.Phase, describeConditions(vm))
+		}
+		if err := checkConditionFailure(jctx, vm.Status.Conditions); err != nil {
+			return err
+		}
+		if err := CheckLauncherPodFailure(timeoutCtx, client, jctx, vm); err != nil {
+			return err
+		}
+	}
+}